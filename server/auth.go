@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication methods, listed in the auth setting.
+const (
+	authAPIKey = "api-key"
+	authHMAC   = "hmac"
+	authJWT    = "jwt"
+)
+
+// clientIDPattern keeps client IDs fit for logs and metric labels.
+var clientIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@:/+|-]{0,127}$`)
+
+// errNoCredentials is returned by an authMethod for a request carrying none
+// of its credentials.
+var errNoCredentials = errors.New("no credentials")
+
+// requestAuth authenticates the clients of the API; main rebuilds it from the
+// effective config. Without methods, requests are served anonymously.
+var requestAuth = &authenticator{}
+
+// authMethod resolves the client of a request from its credentials.
+type authMethod interface {
+	authenticate(r *http.Request) (clientID string, err error)
+}
+
+// authenticator accepts a request when one of its methods does.
+type authenticator struct {
+	methods []authMethod
+	bearer  bool // a method takes an Authorization: Bearer header
+}
+
+func newAuthenticator(cfg *Config) (*authenticator, error) {
+	a := &authenticator{}
+	for _, name := range cfg.Auth {
+		var m authMethod
+		var err error
+		switch name {
+		case authAPIKey:
+			m, err = newAPIKeyAuth(cfg.AuthAPIKeysFile)
+			a.bearer = true
+		case authHMAC:
+			m, err = newHMACAuth(cfg.AuthHMACKeysFile, cfg.AuthMaxSkew)
+		case authJWT:
+			m, err = newJWTAuth(cfg)
+			a.bearer = true
+		default:
+			err = errors.New("unknown method")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("auth %s: %w", name, err)
+		}
+		a.methods = append(a.methods, m)
+	}
+	return a, nil
+}
+
+// authenticate returns the client of r. When no method accepts it, the
+// error is that of the first method r has credentials for.
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	var failed error
+	for _, m := range a.methods {
+		clientID, err := m.authenticate(r)
+		if err == nil {
+			return clientID, nil
+		}
+		if failed == nil && !errors.Is(err, errNoCredentials) {
+			failed = err
+		}
+	}
+	if failed == nil {
+		failed = errors.New("missing credentials")
+	}
+	return "", failed
+}
+
+// withAuth serves the requests authenticated by requestAuth, with the client
+// ID in their context and logger, and refuses the others.
+func withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(requestAuth.methods) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+
+		// An HMAC check replaces the body with its spooled copy.
+		defer func() { r.Body.Close() }()
+		clientID, err := requestAuth.authenticate(r)
+		if err != nil {
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				if requestAuth.bearer {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="kwkhtmltopdf"`)
+				}
+				err = newAPIError(http.StatusUnauthorized, codeUnauthorized, err)
+			}
+			httpError(ctx, w, err)
+			return
+		}
+
+		logger := &Logger{Entry: loggerFromContext(ctx).WithField("client-id", clientID)}
+		ctx = context.WithValue(ctx, LoggerContextKey, logger)
+		ctx = context.WithValue(ctx, ClientIDContextKey, clientID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// loadClientKeys reads a file of "<client-id> <key>" lines. Blank lines and
+// lines starting with # are ignored.
+func loadClientKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want <client-id> <key>", path, n)
+		}
+		clientID, key := fields[0], fields[1]
+		switch {
+		case !clientIDPattern.MatchString(clientID):
+			return nil, fmt.Errorf("%s:%d: invalid client ID %q", path, n, clientID)
+		case keys[clientID] != "":
+			return nil, fmt.Errorf("%s:%d: client %s is listed more than once", path, n, clientID)
+		}
+		keys[clientID] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s lists no client", path)
+	}
+	return keys, nil
+}
+
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// apiKeyAuth accepts static keys, given in an X-API-Key or an
+// Authorization: Bearer header.
+type apiKeyAuth struct {
+	clients map[[sha256.Size]byte]string // by hash of the key
+}
+
+func newAPIKeyAuth(path string) (*apiKeyAuth, error) {
+	keys, err := loadClientKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &apiKeyAuth{clients: map[[sha256.Size]byte]string{}}
+	for clientID, key := range keys {
+		sum := sha256.Sum256([]byte(key))
+		if other, ok := a.clients[sum]; ok {
+			return nil, fmt.Errorf("clients %s and %s share a key", other, clientID)
+		}
+		a.clients[sum] = clientID
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuth) authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return "", errNoCredentials
+	}
+	// Looking up the hash does not leak how much of a key matched.
+	clientID, ok := a.clients[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", errors.New("invalid API key")
+	}
+	return clientID, nil
+}
+
+// hmacAuth accepts requests signed with the secret of their client: the
+// X-Signature header is sha256=<hex> of the HMAC-SHA256 of
+// "<X-Timestamp>.<method>.<path and query>.<body>".
+type hmacAuth struct {
+	secrets map[string][]byte
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+func newHMACAuth(path string, maxSkew time.Duration) (*hmacAuth, error) {
+	keys, err := loadClientKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &hmacAuth{secrets: map[string][]byte{}, maxSkew: maxSkew, now: time.Now}
+	for clientID, key := range keys {
+		a.secrets[clientID] = []byte(key)
+	}
+	return a, nil
+}
+
+func (a *hmacAuth) authenticate(r *http.Request) (string, error) {
+	signature := r.Header.Get("X-Signature")
+	if signature == "" {
+		return "", errNoCredentials
+	}
+	clientID := r.Header.Get("X-Client-ID")
+	secret, ok := a.secrets[clientID]
+	if !ok {
+		return "", fmt.Errorf("unknown client %q in X-Client-ID", clientID)
+	}
+	hexSum, ok := strings.CutPrefix(signature, "sha256=")
+	sum, err := hex.DecodeString(hexSum)
+	if !ok || err != nil {
+		return "", errors.New("invalid X-Signature: want sha256=<hex>")
+	}
+	timestamp := r.Header.Get("X-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid X-Timestamp: want Unix seconds")
+	}
+	if skew := a.now().Sub(time.Unix(unix, 0)).Abs(); skew > a.maxSkew {
+		return "", fmt.Errorf("X-Timestamp is %s off the server clock", skew.Truncate(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s.%s.%s.", timestamp, r.Method, r.URL.RequestURI())
+	if err := spoolBody(r, mac); err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return "", errors.New("invalid signature")
+	}
+	return clientID, nil
+}
+
+// spoolBody copies the body of r to w and to a temporary file that replaces
+// it, so that the handler reads the body that was checked. The file is
+// removed when the body is closed.
+func spoolBody(r *http.Request, w io.Writer) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	dir, cleanup, err := activeRenders.tempDir("kwkauth")
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeTempDirFailed, err)
+	}
+	file, err := os.Create(filepath.Join(dir, "body"))
+	if err != nil {
+		cleanup()
+		return newAPIError(http.StatusInternalServerError, codeTempDirFailed, err)
+	}
+	body := &spooledBody{File: file, cleanup: cleanup}
+
+	src := io.Reader(r.Body)
+	if config.MaxBodySize > 0 {
+		src = io.LimitReader(r.Body, config.MaxBodySize+1)
+	}
+	n, err := io.Copy(io.MultiWriter(file, w), src)
+	if err != nil {
+		err = fmt.Errorf("reading the signed body: %w", err)
+	} else if config.MaxBodySize > 0 && n > config.MaxBodySize {
+		err = newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Errorf("request body too large: the limit is %d bytes", config.MaxBodySize))
+	} else {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
+// spooledBody is a request body read back from its temporary file.
+type spooledBody struct {
+	*os.File
+	cleanup func()
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	b.cleanup()
+	return err
+}
+
+// jwtAuth accepts JSON Web Tokens, given in an Authorization: Bearer header,
+// signed by a key of the JWKS file. The client ID is a claim of the token.
+type jwtAuth struct {
+	keys     []*jsonWebKey
+	issuer   string
+	audience string
+	claim    string
+	maxSkew  time.Duration
+	now      func() time.Time
+}
+
+// jsonWebKey is a public key of the JWKS file.
+type jsonWebKey struct {
+	kid string
+	alg string // empty: any algorithm of the key type
+	key crypto.PublicKey
+}
+
+func newJWTAuth(cfg *Config) (*jwtAuth, error) {
+	keys, err := loadJWKS(cfg.AuthJWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtAuth{
+		keys:     keys,
+		issuer:   cfg.AuthJWTIssuer,
+		audience: cfg.AuthJWTAudience,
+		claim:    cfg.AuthJWTClientClaim,
+		maxSkew:  cfg.AuthMaxSkew,
+		now:      time.Now,
+	}, nil
+}
+
+// loadJWKS reads the RSA, EC and Ed25519 signing keys of a JWKS file.
+func loadJWKS(path string) ([]*jsonWebKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty, Kid, Alg, Use string
+			N, E, Crv, X, Y    string
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var keys []*jsonWebKey
+	for n, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaPublicKey(k.N, k.E)
+		case "EC":
+			key, err = ecPublicKey(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = ed25519PublicKey(k.Crv, k.X)
+		default:
+			err = fmt.Errorf("unsupported kty %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %w", path, n+1, err)
+		}
+		keys = append(keys, &jsonWebKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no signing key", path)
+	}
+	return keys, nil
+}
+
+func rsaPublicKey(n, e string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid n: %w", err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil || len(eBytes) == 0 || len(eBytes) > 4 {
+		return nil, errors.New("invalid e")
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(new(big.Int).SetBytes(eBytes).Int64())}
+	if key.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA keys of %d bits are too short", key.N.BitLen())
+	}
+	return key, nil
+}
+
+func ecPublicKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	var check ecdh.Curve
+	switch crv {
+	case "P-256":
+		curve, check = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, check = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, check = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported crv %q", crv)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	xBytes, errX := base64.RawURLEncoding.DecodeString(x)
+	yBytes, errY := base64.RawURLEncoding.DecodeString(y)
+	if errX != nil || errY != nil || len(xBytes) != size || len(yBytes) != size {
+		return nil, errors.New("invalid x or y")
+	}
+	// ecdh refuses points that are not on the curve.
+	if _, err := check.NewPublicKey(slices.Concat([]byte{4}, xBytes, yBytes)); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}, nil
+}
+
+func ed25519PublicKey(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported crv %q", crv)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid x")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verify reports whether sig is the signature of signed by k with alg.
+func (k *jsonWebKey) verify(alg string, signed, sig []byte) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	if key, ok := k.key.(ed25519.PublicKey); ok {
+		return alg == "EdDSA" && ed25519.Verify(key, signed, sig)
+	}
+
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		// ES512 is signed with P-521.
+		if !strings.HasPrefix(alg, "ES") || alg[2:] != strconv.Itoa(min(key.Curve.Params().BitSize, 512)) || len(sig) != 2*size {
+			return false
+		}
+		return ecdsa.Verify(key, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:]))
+	}
+	return false
+}
+
+func (a *jwtAuth) authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errNoCredentials
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("invalid token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.keys {
+		if (header.Kid == "" || header.Kid == k.kid) && k.verify(header.Alg, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", errors.New("invalid token signature")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid token claims: %w", err)
+	}
+	now := a.now()
+	exp, ok := timeClaim(claims, "exp")
+	if !ok {
+		return "", errors.New("the token has no exp claim")
+	}
+	if now.After(exp.Add(a.maxSkew)) {
+		return "", errors.New("the token expired")
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Add(a.maxSkew).Before(nbf) {
+		return "", errors.New("the token is not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return "", fmt.Errorf("the token is not issued by %s", a.issuer)
+	}
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return "", fmt.Errorf("the token is not for audience %s", a.audience)
+	}
+	clientID, _ := claims[a.claim].(string)
+	if !clientIDPattern.MatchString(clientID) {
+		return "", fmt.Errorf("invalid client ID in the %s claim", a.claim)
+	}
+	return clientID, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// timeClaim returns the NumericDate claim name.
+func timeClaim(claims map[string]any, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience reports whether the aud claim, a string or a list, holds
+// audience.
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useAuth authenticates requests as the config changed by change says.
+func useAuth(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	setTestConfig(t, change)
+	a, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := requestAuth
+	requestAuth = a
+	t.Cleanup(func() { requestAuth = saved })
+}
+
+func writeAuthFile(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveAuth serves req with a handler echoing its client ID and body.
+func serveAuth(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	withTraceID(withAuth(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s:%s", clientIDFromContext(r.Context()), body)
+	}))(rec, req)
+	return rec
+}
+
+func checkUnauthorized(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("X-Error-Code") != codeUnauthorized {
+		t.Fatalf("status %d code %q body %q, want 401", rec.Code, rec.Header().Get("X-Error-Code"), rec.Body.String())
+	}
+}
+
+func TestWithAuth_apiKey(t *testing.T) {
+	keys := writeAuthFile(t, "keys", "# billing\nacme   k-acme\nglobex\tk-globex\n")
+	useAuth(t, func(c *Config) {
+		c.Auth = []string{authAPIKey}
+		c.AuthAPIKeysFile = keys
+	})
+
+	tests := []struct {
+		name, header, value, client string
+	}{
+		{"x-api-key", "X-API-Key", "k-acme", "acme"},
+		{"bearer", "Authorization", "Bearer k-globex", "globex"},
+		{"wrong key", "X-API-Key", "k-initech", ""},
+		{"other scheme", "Authorization", "Basic k-acme", ""},
+		{"none", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/templates", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := serveAuth(req)
+			if tt.client == "" {
+				checkUnauthorized(t, rec)
+				if rec.Header().Get("WWW-Authenticate") == "" {
+					t.Fatal("no WWW-Authenticate header")
+				}
+				return
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.client+":" {
+				t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+// signRequest signs req and its body as client with secret at now.
+func signRequest(req *http.Request, client, secret, body string, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + req.Method + "." + req.URL.RequestURI() + "." + body))
+	req.Header.Set("X-Client-ID", client)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestWithAuth_hmac(t *testing.T) {
+	secrets := writeAuthFile(t, "secrets", "acme s3cret\n")
+	useAuth(t, func(c *Config) {
+		c.Auth = []string{authHMAC}
+		c.AuthHMACKeysFile = secrets
+		c.TempDir = t.TempDir()
+		c.MaxBodySize = 64
+	})
+
+	tests := []struct {
+		name   string
+		body   string
+		sign   func(req *http.Request)
+		status int
+	}{
+		{"signed", "<p>a</p>", func(req *http.Request) { signRequest(req, "acme", "s3cret", "<p>a</p>", time.Now()) }, http.StatusOK},
+		{"tampered body", "<p>b</p>", func(req *http.Request) { signRequest(req, "acme", "s3cret", "<p>a</p>", time.Now()) }, http.StatusUnauthorized},
+		{"wrong secret", "<p>a</p>", func(req *http.Request) { signRequest(req, "acme", "guess", "<p>a</p>", time.Now()) }, http.StatusUnauthorized},
+		{"unknown client", "<p>a</p>", func(req *http.Request) { signRequest(req, "globex", "s3cret", "<p>a</p>", time.Now()) }, http.StatusUnauthorized},
+		{"stale", "<p>a</p>", func(req *http.Request) { signRequest(req, "acme", "s3cret", "<p>a</p>", time.Now().Add(-time.Hour)) }, http.StatusUnauthorized},
+		{"unsigned", "<p>a</p>", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"too large", strings.Repeat("a", 65), func(req *http.Request) { signRequest(req, "acme", "s3cret", strings.Repeat("a", 65), time.Now()) }, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/pdf?x=1", strings.NewReader(tt.body))
+			tt.sign(req)
+			rec := serveAuth(req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d body %q, want %d", rec.Code, rec.Body.String(), tt.status)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != "acme:"+tt.body {
+				t.Fatalf("body %q", rec.Body.String())
+			}
+		})
+	}
+	// The spooled bodies are removed.
+	if entries, _ := os.ReadDir(config.TempDir); len(entries) != 0 {
+		t.Fatalf("%d temporary files left", len(entries))
+	}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT returns the token of claims signed by key with alg.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	if key == nil {
+		return signed + "."
+	}
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+		// JWS wants r || s rather than ASN.1.
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		sig = append(parsed.R.FillBytes(make([]byte, size)), parsed.S.FillBytes(make([]byte, size))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestWithAuth_jwt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "RSA", "use": "enc", "n": "", "e": ""},
+	}})
+	jwksFile := writeAuthFile(t, "jwks.json", string(jwks))
+	useAuth(t, func(c *Config) {
+		c.Auth = []string{authJWT}
+		c.AuthJWKSFile = jwksFile
+		c.AuthJWTIssuer = "https://id.example.com"
+		c.AuthJWTAudience = "kwkhtmltopdf"
+	})
+
+	now := time.Now().Unix()
+	claims := func(change func(c map[string]any)) map[string]any {
+		c := map[string]any{"iss": "https://id.example.com", "aud": []string{"kwkhtmltopdf"}, "sub": "acme", "exp": now + 60}
+		change(c)
+		return c
+	}
+	valid := claims(func(map[string]any) {})
+	tests := []struct {
+		name   string
+		token  string
+		client string
+	}{
+		{"rs256", signJWT(t, "RS256", "rsa-1", rsaKey, valid), "acme"},
+		{"es256 without kid", signJWT(t, "ES256", "", ecKey, claims(func(c map[string]any) { c["sub"] = "globex"; c["aud"] = "kwkhtmltopdf" })), "globex"},
+		{"wrong kid", signJWT(t, "RS256", "ec-1", rsaKey, valid), ""},
+		{"alg of another key", signJWT(t, "ES256", "rsa-1", ecKey, valid), ""},
+		{"alg none", signJWT(t, "none", "", nil, valid), ""},
+		{"expired", signJWT(t, "RS256", "rsa-1", rsaKey, claims(func(c map[string]any) { c["exp"] = now - 3600 })), ""},
+		{"no exp", signJWT(t, "RS256", "rsa-1", rsaKey, claims(func(c map[string]any) { delete(c, "exp") })), ""},
+		{"not yet valid", signJWT(t, "RS256", "rsa-1", rsaKey, claims(func(c map[string]any) { c["nbf"] = now + 3600 })), ""},
+		{"other issuer", signJWT(t, "RS256", "rsa-1", rsaKey, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), ""},
+		{"other audience", signJWT(t, "RS256", "rsa-1", rsaKey, claims(func(c map[string]any) { c["aud"] = "billing" })), ""},
+		{"bad client ID", signJWT(t, "RS256", "rsa-1", rsaKey, claims(func(c map[string]any) { c["sub"] = "a b" })), ""},
+	}
+	tampered := strings.Split(signJWT(t, "RS256", "rsa-1", rsaKey, valid), ".")
+	payload, _ := json.Marshal(claims(func(c map[string]any) { c["sub"] = "globex" }))
+	tampered[1] = b64(payload)
+	tests = append(tests, struct{ name, token, client string }{"tampered", strings.Join(tampered, "."), ""})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/templates", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := serveAuth(req)
+			if tt.client == "" {
+				checkUnauthorized(t, rec)
+				return
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.client+":" {
+				t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRouter_auth(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	keys := writeAuthFile(t, "keys", "acme k-acme\n")
+	useAuth(t, func(c *Config) {
+		c.Auth = []string{authAPIKey, authJWT}
+		c.AuthAPIKeysFile = keys
+		c.AuthJWKSFile = writeAuthFile(t, "jwks.json", `{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`)
+	})
+
+	// The probes are served without credentials.
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/healthz", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("/healthz: status %d", rec.Code)
+	}
+	if rec := serve(newPDFRequest(t, nil)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("/pdf without a key: status %d", rec.Code)
+	}
+
+	before := testutil.ToFloat64(requestsTotal.WithLabelValues("/pdf", "200", "acme"))
+	req := newPDFRequest(t, nil)
+	req.Header.Set("X-API-Key", "k-acme")
+	if rec := serve(req); rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("/pdf: status %d body %q", rec.Code, rec.Body.String())
+	}
+	if n := testutil.ToFloat64(requestsTotal.WithLabelValues("/pdf", "200", "acme")) - before; n != 1 {
+		t.Fatalf("%v requests counted for client acme", n)
+	}
+}
+
+func TestNewAuthenticator_invalidFiles(t *testing.T) {
+	for name, tc := range map[string]struct {
+		method, file string
+	}{
+		"bad line":        {authAPIKey, "acme\n"},
+		"bad client ID":   {authAPIKey, "a$b key\n"},
+		"duplicate":       {authHMAC, "acme a\nacme b\n"},
+		"shared key":      {authAPIKey, "acme k\nglobex k\n"},
+		"empty":           {authHMAC, "# no client\n"},
+		"not JSON":        {authJWT, "keys"},
+		"short RSA key":   {authJWT, `{"keys": [{"kty": "RSA", "n": "AQAB", "e": "AQAB"}]}`},
+		"point off curve": {authJWT, `{"keys": [{"kty": "EC", "crv": "P-256", "x": "` + b64(make([]byte, 32)) + `", "y": "` + b64(make([]byte, 32)) + `"}]}`},
+		"no signing key":  {authJWT, `{"keys": [{"kty": "RSA", "use": "enc"}]}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := writeAuthFile(t, "keys", tc.file)
+			setTestConfig(t, func(c *Config) {
+				c.Auth = []string{tc.method}
+				c.AuthAPIKeysFile, c.AuthHMACKeysFile, c.AuthJWKSFile = file, file, file
+			})
+			if _, err := newAuthenticator(config); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
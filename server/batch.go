@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	batchItemSucceeded = "succeeded"
+	batchItemFailed    = "failed"
+)
+
+// batchItemIDPattern restricts item IDs to safe zip entry names.
+var batchItemIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// batchManifest is the manifest field of a POST /batch/pdf request.
+type batchManifest struct {
+	Items []*batchItem `json:"items"`
+}
+
+// batchItem is one document of a batch. Its files are uploads of the batch
+// request.
+type batchItem struct {
+	ID         string          `json:"id"` // default: the position from 1
+	Entrypoint string          `json:"entrypoint"`
+	Header     string          `json:"header"`
+	Footer     string          `json:"footer"`
+	Options    map[string]any  `json:"options"` // in the JSON body syntax
+	Data       json.RawMessage `json:"data"`    // template data, see applyTemplates
+}
+
+// batchItemResult is the outcome of one item in the manifest.json of the
+// response.
+type batchItemResult struct {
+	ID              string         `json:"id"`
+	Status          string         `json:"status"`
+	File            string         `json:"file,omitempty"`
+	Size            int64          `json:"size,omitempty"`
+	FailedResources []string       `json:"failed_resources,omitempty"`
+	Error           *errorResponse `json:"error,omitempty"`
+}
+
+// batchPDFHandler serves POST /batch/pdf: it renders every item of the
+// manifest against the files of the request, a few at a time, and streams a
+// zip of the PDFs followed by manifest.json. A failed item is reported in
+// manifest.json without failing the others.
+func batchPDFHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := loggerFromContext(ctx)
+
+	if r.Method != http.MethodPost {
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+
+	timeout, err := renderTimeout(r)
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		httpError(ctx, w, newAPIError(http.StatusBadRequest, codeInvalidMultipart, err))
+		return
+	}
+	tmpdir, cleanup, err := activeRenders.tempDir("kwkbatch")
+	if err != nil {
+		httpError(ctx, w, newAPIError(http.StatusInternalServerError, codeTempDirFailed, err))
+		return
+	}
+	defer cleanup()
+
+	manifest, err := parseBatchForm(reader, tmpdir)
+	if err != nil {
+		logger.Errorf("Invalid batch: %v", err)
+		httpError(ctx, w, parseFormError(err))
+		return
+	}
+	logger.Infof("Rendering a batch of %d documents", len(manifest.Items))
+
+	type done struct {
+		n        int
+		result   *renderResult
+		err      error
+		duration time.Duration
+	}
+	// results holds every item, so that workers never block on it: when the
+	// response breaks, the handler stops reading, cancels the renders left
+	// and removes the results nobody read.
+	ctx, cancel := context.WithCancel(ctx)
+	queue := make(chan int)
+	results := make(chan done, len(manifest.Items))
+	var wg sync.WaitGroup
+	workers := min(config.BatchConcurrency, len(manifest.Items))
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range queue {
+				start := time.Now()
+				result, err := renderBatchItem(ctx, tmpdir, manifest.Items[n], timeout)
+				results <- done{n, result, err, time.Since(start)}
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for n := range manifest.Items {
+			select {
+			case queue <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+		close(results)
+		for d := range results {
+			if d.result != nil {
+				os.RemoveAll(filepath.Dir(d.result.Path))
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="batch.zip"`)
+	zw := zip.NewWriter(w)
+	outcomes := make([]batchItemResult, len(manifest.Items))
+	failed := 0
+	client := clientIDFromContext(ctx)
+	for range manifest.Items {
+		d := <-results
+		item := manifest.Items[d.n]
+		outcome := &outcomes[d.n]
+		outcome.ID = item.ID
+		// The output is checked before its zip entry is created, so that a
+		// failed item never leaves a truncated entry behind.
+		var pdf *os.File
+		if d.err == nil {
+			pdf, d.err = openBatchResult(d.result)
+			if d.err != nil {
+				os.RemoveAll(filepath.Dir(d.result.Path))
+			}
+		}
+		status := http.StatusOK
+		if d.err != nil {
+			logger.Errorf("Batch item %s failed: %v", item.ID, d.err)
+			failed++
+			apiErr := asAPIError(d.err)
+			status = apiErr.Status
+			outcome.Status = batchItemFailed
+			outcome.Error = &errorResponse{Code: apiErr.Code, Message: apiErr.Error(), Stderr: apiErr.Stderr}
+			var optErr *optionValidationError
+			if errors.As(apiErr, &optErr) {
+				outcome.Error.Fields = optErr.Errors
+			}
+		} else {
+			outcome.Status = batchItemSucceeded
+			outcome.File = item.ID + ".pdf"
+			outcome.Size = d.result.Size
+			outcome.FailedResources = d.result.FailedResources
+			pdfSize.Observe(float64(d.result.Size))
+		}
+		// Each document counts like a /pdf request.
+		requestDuration.WithLabelValues(r.URL.Path, client).Observe(d.duration.Seconds())
+		requestsTotal.WithLabelValues(r.URL.Path, strconv.Itoa(status), client).Inc()
+		batchItems.WithLabelValues(outcome.Status).Inc()
+
+		if pdf != nil {
+			err := addZipFile(zw, outcome.File, pdf)
+			pdf.Close()
+			os.RemoveAll(filepath.Dir(d.result.Path))
+			if err != nil {
+				// The response is broken: the client cannot read further items.
+				logger.Errorf("Failed to write the batch zip: %v", err)
+				return
+			}
+		}
+	}
+
+	if err := writeZipJSON(zw, "manifest.json", map[string]any{"items": outcomes}); err != nil {
+		logger.Errorf("Failed to write the batch manifest: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		logger.Errorf("Failed to write the batch zip: %v", err)
+		return
+	}
+	logger.Infof("Batch done: %d documents, %d failed", len(manifest.Items), failed)
+}
+
+// parseBatchForm saves the files of a batch request, uploaded as file parts
+// or in a bundle, to tmpdir and returns its checked manifest.
+func parseBatchForm(reader *multipart.Reader, tmpdir string) (*batchManifest, error) {
+	var manifest *batchManifest
+	bundled := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch part.FormName() {
+		case "bundle":
+			if bundled {
+				return nil, bundleError("only one bundle part is allowed")
+			}
+			bundled = true
+			if err := extractBundle(part, tmpdir, func(string, string) {}); err != nil {
+				return nil, err
+			}
+		case "file":
+			name, err := cleanUploadName(uploadName(part))
+			if err != nil {
+				return nil, uploadError("file", uploadName(part), err)
+			}
+			file, _, err := createUpload(tmpdir, name)
+			if err != nil {
+				return nil, uploadError("file", name, err)
+			}
+			_, err = io.Copy(file, part)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+		case "manifest":
+			if manifest != nil {
+				return nil, batchError("only one manifest part is allowed")
+			}
+			dec := json.NewDecoder(part)
+			dec.DisallowUnknownFields()
+			dec.UseNumber()
+			if err := dec.Decode(&manifest); err != nil {
+				return nil, batchError("invalid manifest: %v", err)
+			}
+		default:
+			return nil, batchError("unknown field %q: want file, bundle or manifest", part.FormName())
+		}
+	}
+
+	if manifest == nil || len(manifest.Items) == 0 {
+		return nil, batchError("a manifest with at least one item is required")
+	}
+	if config.BatchMaxItems > 0 && len(manifest.Items) > config.BatchMaxItems {
+		return nil, newAPIError(http.StatusRequestEntityTooLarge, codeBatchTooLarge, fmt.Errorf("the batch has %d items, more than %d", len(manifest.Items), config.BatchMaxItems))
+	}
+	ids := make(map[string]bool, len(manifest.Items))
+	for n, item := range manifest.Items {
+		if item == nil {
+			return nil, batchError("item %d is null", n+1)
+		}
+		if item.ID == "" {
+			item.ID = strconv.Itoa(n + 1)
+		}
+		if !batchItemIDPattern.MatchString(item.ID) {
+			return nil, batchError("invalid item id %q: use letters, digits, '.', '_' and '-'", item.ID)
+		}
+		if ids[item.ID] {
+			return nil, batchError("item id %q is given more than once", item.ID)
+		}
+		ids[item.ID] = true
+	}
+	return manifest, nil
+}
+
+// renderBatchItem renders one item of a batch, whose files are in tmpdir,
+// once a render slot is free. The result is in a directory of its own.
+func renderBatchItem(ctx context.Context, tmpdir string, item *batchItem, timeout time.Duration) (*renderResult, error) {
+	logger := &Logger{Entry: loggerFromContext(ctx).WithField("batch-item", item.ID)}
+	ctx = context.WithValue(ctx, LoggerContextKey, logger)
+
+	args, err := jsonOptionArgs(logger, item.Options, pdfOptions, tmpdir)
+	if err != nil {
+		return nil, parseFormError(err)
+	}
+	outDir, err := os.MkdirTemp(tmpdir, ".item-")
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeTempDirFailed, err)
+	}
+
+	// The shared files are outside outDir, the tmpdir of the render.
+	form := &renderForm{args: append(args, "--allow", tmpdir)}
+	if len(item.Data) > 0 && string(item.Data) != "null" {
+		form.data = item.Data
+	}
+	for _, doc := range []struct {
+		field, name string
+		path        *string
+	}{
+		{"entrypoint", cmp.Or(item.Entrypoint, "index.html"), &form.indexPath},
+		{"header", item.Header, &form.headerPath},
+		{"footer", item.Footer, &form.footerPath},
+	} {
+		if doc.name == "" {
+			continue
+		}
+		p, err := uploadedFile(tmpdir, doc.name)
+		if err != nil {
+			return nil, parseFormError(&optionValidationError{Errors: []optionError{{Field: doc.field, Value: doc.name, Reason: err.Error()}}})
+		}
+		if form.data != nil {
+			// Templates are rendered in place: work on a copy next to the
+			// original, so that relative links still resolve.
+			if p, err = copyBatchDocument(tmpdir, doc.name, filepath.Base(outDir)); err != nil {
+				return nil, err
+			}
+		}
+		*doc.path = p
+	}
+
+	prepared, err := preparePDFForm(ctx, form, outDir, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// The key covers outDir only, not the shared files.
+	prepared.key = ""
+	return prepared.execute(ctx, nil)
+}
+
+// copyBatchDocument copies the upload name to a new file in the same
+// directory, named after the item, and returns its path.
+func copyBatchDocument(tmpdir, name, item string) (string, error) {
+	name, _ = cleanUploadName(name)
+	copyName := path.Join(path.Dir(name), item+"-"+path.Base(name))
+	dst, p, err := createUpload(tmpdir, copyName)
+	if err != nil {
+		return "", err
+	}
+	src, err := os.Open(filepath.Join(tmpdir, filepath.FromSlash(name)))
+	if err != nil {
+		dst.Close()
+		return "", err
+	}
+	defer src.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return p, dst.Close()
+}
+
+// openBatchResult opens the output of a batch item, checking that it is
+// complete.
+func openBatchResult(result *renderResult) (*os.File, error) {
+	f, err := os.Open(result.Path)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeReadOutputFailed, err)
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() != result.Size {
+		err = fmt.Errorf("%s: %d bytes, want %d", filepath.Base(result.Path), info.Size(), result.Size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, newAPIError(http.StatusInternalServerError, codeReadOutputFailed, err)
+	}
+	return f, nil
+}
+
+// addZipFile copies r to the zip as name. PDFs are already compressed, so it
+// is stored as is.
+func addZipFile(zw *zip.Writer, name string, r io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// batchError reports an invalid batch request.
+func batchError(format string, args ...any) error {
+	return newAPIError(http.StatusBadRequest, codeInvalidBatch, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newBatchRequest(t *testing.T, files map[string]string, manifest string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, body := range files {
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte(body))
+	}
+	if manifest != "" {
+		mw.WriteField("manifest", manifest)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/batch/pdf", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func TestBatchPDFHandler(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	succeeded := requestsTotal.WithLabelValues("/batch/pdf", "200", "")
+	failed := requestsTotal.WithLabelValues("/batch/pdf", "400", "")
+	beforeSucceeded, beforeFailed := testutil.ToFloat64(succeeded), testutil.ToFloat64(failed)
+
+	rec := serve(newBatchRequest(t, map[string]string{
+		"index.html":           "<p>a</p>",
+		"statements/acct.html": "<p>{{.name}}</p>",
+		"statements/style.css": "p {}",
+	}, `{"items": [
+		{"id": "plain", "options": {"page-size": "A4"}},
+		{"id": "acct-1", "entrypoint": "statements/acct.html", "data": {"name": "A"}},
+		{"id": "acct-2", "entrypoint": "statements/acct.html", "data": {"nme": "B"}},
+		{"entrypoint": "missing.html"},
+		{"id": "bad-option", "options": {"page-size": "A11"}}
+	]}`))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	if len(files) != 3 || files["plain.pdf"] != fakePDF || files["acct-1.pdf"] != fakePDF {
+		t.Fatalf("zip entries %q", files)
+	}
+
+	var manifest struct{ Items []batchItemResult }
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ id, status, code string }{
+		{"plain", batchItemSucceeded, ""},
+		{"acct-1", batchItemSucceeded, ""},
+		{"acct-2", batchItemFailed, codeTemplateError},
+		{"4", batchItemFailed, codeInvalidOption},
+		{"bad-option", batchItemFailed, codeInvalidOption},
+	}
+	if len(manifest.Items) != len(want) {
+		t.Fatalf("manifest %+v", manifest)
+	}
+	for i, w := range want {
+		item := manifest.Items[i]
+		code := ""
+		if item.Error != nil {
+			code = item.Error.Code
+		}
+		if item.ID != w.id || item.Status != w.status || code != w.code {
+			t.Errorf("item %d: %+v, want %+v", i, item, w)
+		}
+		if w.status == batchItemSucceeded && (item.File != w.id+".pdf" || item.Size != int64(len(fakePDF))) {
+			t.Errorf("item %d: file %q size %d", i, item.File, item.Size)
+		}
+	}
+
+	// Each document is counted like a /pdf request.
+	if n := testutil.ToFloat64(succeeded) - beforeSucceeded; n != 2 {
+		t.Errorf("%v documents counted as succeeded", n)
+	}
+	if n := testutil.ToFloat64(failed) - beforeFailed; n != 3 {
+		t.Errorf("%v documents counted as failed", n)
+	}
+}
+
+func TestBatchPDFHandler_invalid(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.BatchMaxItems = 2 })
+
+	files := map[string]string{"index.html": "<p>a</p>"}
+	cases := map[string]struct {
+		manifest string
+		status   int
+		code     string
+	}{
+		"no manifest":   {"", http.StatusBadRequest, codeInvalidBatch},
+		"no items":      {`{"items": []}`, http.StatusBadRequest, codeInvalidBatch},
+		"unknown field": {`{"items": [{"name": "x"}]}`, http.StatusBadRequest, codeInvalidBatch},
+		"duplicate id":  {`{"items": [{"id": "a"}, {"id": "a"}]}`, http.StatusBadRequest, codeInvalidBatch},
+		"bad id":        {`{"items": [{"id": "../a"}]}`, http.StatusBadRequest, codeInvalidBatch},
+		"too many":      {`{"items": [{}, {}, {}]}`, http.StatusRequestEntityTooLarge, codeBatchTooLarge},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rec := serve(newBatchRequest(t, files, tc.manifest))
+			if rec.Code != tc.status || rec.Header().Get("X-Error-Code") != tc.code {
+				t.Fatalf("status %d code %q, want %d %s", rec.Code, rec.Header().Get("X-Error-Code"), tc.status, tc.code)
+			}
+		})
+	}
+}
+
+// brokenResponse fails every write, like a client that went away.
+type brokenResponse struct{ *httptest.ResponseRecorder }
+
+func (brokenResponse) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestBatchPDFHandler_brokenResponse(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	tmp := t.TempDir()
+	setTestConfig(t, func(c *Config) {
+		c.TempDir = tmp
+		c.BatchConcurrency = 2
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newRouter().ServeHTTP(brokenResponse{httptest.NewRecorder()}, newBatchRequest(t, map[string]string{"index.html": "<p>a</p>"},
+			`{"items": [{"id": "a"}, {"id": "b"}, {"id": "c"}, {"id": "d"}, {"id": "e"}]}`))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the batch did not stop")
+	}
+	// The renders are over and their outputs removed.
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("left in the temp dir: %v", entries)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// bundleExtractor extracts the files of a bundle under a request temp dir,
+// within the configured limits.
+type bundleExtractor struct {
+	tmpdir     string
+	add        func(name, path string)
+	maxEntries int
+	maxSize    int64
+	entries    int
+	size       int64
+}
+
+// extractBundle extracts the zip, tar or tar.gz archive read from r under
+// tmpdir and calls add with the name and path of each file. The format is
+// detected from the content. Entries must be regular files or directories
+// with safe relative names; symlinks and other special files are refused.
+func extractBundle(r io.Reader, tmpdir string, add func(name, path string)) error {
+	spool, err := os.CreateTemp(tmpdir, ".bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return err
+	}
+
+	var magic [512]byte
+	n, _ := spool.ReadAt(magic[:], 0)
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	b := &bundleExtractor{
+		tmpdir:     tmpdir,
+		add:        add,
+		maxEntries: config.BundleMaxEntries,
+		maxSize:    config.BundleMaxSize,
+	}
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte("PK\x03\x04")), bytes.HasPrefix(magic[:n], []byte("PK\x05\x06")):
+		return b.extractZip(spool, size)
+	case bytes.HasPrefix(magic[:n], []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(spool)
+		if err != nil {
+			return bundleError("%v", err)
+		}
+		defer gz.Close()
+		return b.extractTar(gz)
+	case n >= 262 && string(magic[257:262]) == "ustar":
+		return b.extractTar(spool)
+	default:
+		return bundleError("unsupported format, want zip, tar or tar.gz")
+	}
+}
+
+func (b *bundleExtractor) extractZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return bundleError("%v", err)
+	}
+	for _, f := range zr.File {
+		if err := b.checkEntry(f.Name, f.Mode()); err != nil {
+			return err
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return bundleError("%s: %v", f.Name, err)
+		}
+		err = b.extractFile(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bundleExtractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return bundleError("%v", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		mode := hdr.FileInfo().Mode()
+		if err := b.checkEntry(hdr.Name, mode); err != nil {
+			return err
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		if err := b.extractFile(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkEntry counts an entry and refuses it unless it is a regular file or a
+// directory.
+func (b *bundleExtractor) checkEntry(name string, mode fs.FileMode) error {
+	b.entries++
+	if b.maxEntries > 0 && b.entries > b.maxEntries {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeBundleTooLarge, fmt.Errorf("bundle: more than %d entries", b.maxEntries))
+	}
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return bundleError("%s: symlinks are not allowed", name)
+	case !mode.IsRegular() && !mode.IsDir():
+		return bundleError("%s: not a regular file", name)
+	}
+	return nil
+}
+
+func (b *bundleExtractor) extractFile(entry string, r io.Reader) error {
+	name, err := cleanUploadName(strings.TrimPrefix(entry, "./"))
+	if err != nil {
+		return bundleError("%s: %v", entry, err)
+	}
+	file, path, err := createUpload(b.tmpdir, name)
+	if errors.Is(err, errUploadExists) {
+		return bundleError("%s: %v", entry, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	limit := int64(-1)
+	if b.maxSize > 0 {
+		limit = b.maxSize - b.size
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	b.size += n
+	if limit >= 0 && n > limit {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeBundleTooLarge, fmt.Errorf("bundle: more than %d bytes once extracted", b.maxSize))
+	}
+	if err != nil {
+		return bundleError("%s: %v", entry, err)
+	}
+	b.add(name, path)
+	return nil
+}
+
+func bundleError(format string, args ...any) error {
+	return newAPIError(http.StatusBadRequest, codeInvalidBundle, fmt.Errorf("bundle: "+format, args...))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// bundleEntry is a file of a test bundle; link makes it a symlink.
+type bundleEntry struct {
+	name, body, link string
+}
+
+func zipBundle(t *testing.T, entries ...bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		if e.link != "" {
+			h.SetMode(os.ModeSymlink | 0o777)
+			body = e.link
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarBundle(t *testing.T, gzipped bool, entries ...bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body)), Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+		if e.link != "" {
+			h = &tar.Header{Name: e.name, Mode: 0o777, Linkname: e.link, Typeflag: tar.TypeSymlink, Format: tar.FormatPAX}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+var testBundle = []bundleEntry{
+	{name: "index.html", body: "<html>index</html>"},
+	{name: "header.html", body: "<html>header</html>"},
+	{name: "css/style.css", body: "body {}"},
+	{name: "./img/logo.png", body: "png"},
+}
+
+func TestExtractBundle(t *testing.T) {
+	for format, bundle := range map[string][]byte{
+		"zip":    zipBundle(t, testBundle...),
+		"tar":    tarBundle(t, false, testBundle...),
+		"tar.gz": tarBundle(t, true, testBundle...),
+	} {
+		t.Run(format, func(t *testing.T) {
+			tmpdir := t.TempDir()
+			var names []string
+			err := extractBundle(bytes.NewReader(bundle), tmpdir, func(name, path string) {
+				names = append(names, name)
+				if path != filepath.Join(tmpdir, filepath.FromSlash(name)) {
+					t.Errorf("%s extracted to %s", name, path)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(names)
+			want := []string{"css/style.css", "header.html", "img/logo.png", "index.html"}
+			if !reflect.DeepEqual(names, want) {
+				t.Fatalf("names %q want %q", names, want)
+			}
+			if data, _ := os.ReadFile(filepath.Join(tmpdir, "css", "style.css")); string(data) != "body {}" {
+				t.Fatalf("style.css %q", data)
+			}
+			// The spooled archive is removed.
+			if leftovers, _ := filepath.Glob(filepath.Join(tmpdir, ".bundle-*")); len(leftovers) > 0 {
+				t.Fatalf("leftovers %q", leftovers)
+			}
+		})
+	}
+}
+
+func TestExtractBundle_rejected(t *testing.T) {
+	index := bundleEntry{name: "index.html", body: "x"}
+	cases := map[string]struct {
+		bundle []byte
+		code   string
+	}{
+		"zip slip":         {zipBundle(t, index, bundleEntry{name: "../evil.sh", body: "x"}), codeInvalidBundle},
+		"tar slip":         {tarBundle(t, false, index, bundleEntry{name: "css/../../evil.sh", body: "x"}), codeInvalidBundle},
+		"absolute":         {tarBundle(t, true, bundleEntry{name: "/etc/cron.d/evil", body: "x"}), codeInvalidBundle},
+		"zip symlink":      {zipBundle(t, bundleEntry{name: "passwd", link: "/etc/passwd"}), codeInvalidBundle},
+		"tar symlink":      {tarBundle(t, false, bundleEntry{name: "css", link: "/etc"}, bundleEntry{name: "css/x", body: "x"}), codeInvalidBundle},
+		"duplicate":        {tarBundle(t, false, index, index), codeInvalidBundle},
+		"not an archive":   {[]byte("<html></html>"), codeInvalidBundle},
+		"truncated gzip":   {tarBundle(t, true, index)[:20], codeInvalidBundle},
+		"too many entries": {zipBundle(t, index, bundleEntry{name: "a"}, bundleEntry{name: "b"}), codeBundleTooLarge},
+		"too large":        {tarBundle(t, true, bundleEntry{name: "big", body: string(make([]byte, 2048))}), codeBundleTooLarge},
+	}
+	setTestConfig(t, func(c *Config) {
+		c.BundleMaxEntries = 2
+		c.BundleMaxSize = 1024
+	})
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := t.TempDir()
+			err := extractBundle(bytes.NewReader(tc.bundle), tmpdir, func(string, string) {})
+			if apiErrorCode(err) != tc.code {
+				t.Fatalf("error %v, want %s", err, tc.code)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(tmpdir), "evil.sh")); err == nil {
+				t.Fatal("file written outside tmpdir")
+			}
+		})
+	}
+}
+
+func newBundleRequest(t *testing.T, path string, bundle []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("bundle", "template.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bundle)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestParseMultipartForm_bundle(t *testing.T) {
+	req := newBundleRequest(t, "/pdf", zipBundle(t, append(testBundle, bundleEntry{name: "docs/report.html", body: "x"})...), map[string]string{"entrypoint": "docs/report.html"})
+	reader, err := req.MultipartReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpdir := t.TempDir()
+	form, err := parseMultipartForm(context.Background(), reader, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.indexPath != filepath.Join(tmpdir, "docs", "report.html") || form.headerPath != filepath.Join(tmpdir, "header.html") {
+		t.Fatalf("form %+v", form)
+	}
+	if len(form.args) != 0 {
+		t.Fatalf("args %q", form.args)
+	}
+}
+
+func TestPDFHandler_bundle(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newBundleRequest(t, "/pdf", tarBundle(t, true, testBundle...), map[string]string{"page-size": "A4"}))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newBundleRequest(t, "/pdf", zipBundle(t, testBundle...), map[string]string{"entrypoint": "missing.html"}))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+		t.Fatalf("status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestImageHandler_jsonBundle(t *testing.T) {
+	t.Setenv("KWKHTMLTOIMAGE_BIN", writeFakeWkhtmltoimage(t))
+
+	bundle := base64.StdEncoding.EncodeToString(zipBundle(t, bundleEntry{name: "site/home.html", body: "<html></html>"}))
+	rec := httptest.NewRecorder()
+	withTraceID(imageHandler)(rec, newJSONRequest(t, "/image", `{"bundle": "`+bundle+`", "entrypoint": "site/home.html"}`))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheMemory = "memory"
+	cacheDisk   = "disk"
+)
+
+// renderCache holds the results of past renders by content, or is nil when
+// the cache setting is off.
+var renderCache resultCache
+
+// resultCache stores render results by cache key. Implementations must be
+// safe for concurrent use.
+type resultCache interface {
+	// Get copies the result cached under key to path and returns it, or
+	// returns nil if there is none.
+	Get(key, path string) (*renderResult, error)
+	// Put stores a copy of result under key.
+	Put(key string, result *renderResult) error
+}
+
+// newResultCache opens the cache selected by the cache setting.
+func newResultCache(cfg *Config) (resultCache, error) {
+	switch cfg.Cache {
+	case "":
+		return nil, nil
+	case cacheMemory:
+		return newMemoryResultCache(cfg.CacheMaxSize, cfg.CacheTTL), nil
+	case cacheDisk:
+		return newDiskResultCache(cfg.CacheDir, cfg.CacheMaxSize, cfg.CacheTTL)
+	}
+	return nil, fmt.Errorf("unknown cache %q", cfg.Cache)
+}
+
+// cacheEntry describes one cached result.
+type cacheEntry struct {
+	Key             string    `json:"key"`
+	ContentType     string    `json:"content_type"`
+	Size            int64     `json:"size"`
+	FailedResources []string  `json:"failed_resources,omitempty"`
+	Expires         time.Time `json:"expires"`
+
+	data []byte // memory cache only
+}
+
+// lruIndex tracks the cache entries by recency, evicting the least recently
+// used ones beyond maxSize bytes and the expired ones. It is not safe for
+// concurrent use.
+type lruIndex struct {
+	maxSize int64
+	ttl     time.Duration
+	evict   func(e *cacheEntry) // called for each entry removed
+
+	size    int64
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+func newLRUIndex(maxSize int64, ttl time.Duration, evict func(e *cacheEntry)) *lruIndex {
+	return &lruIndex{
+		maxSize: maxSize,
+		ttl:     ttl,
+		evict:   evict,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns the entry of key and marks it used, or returns nil if there is
+// none or it expired.
+func (l *lruIndex) get(key string, now time.Time) *cacheEntry {
+	el, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.Expires) {
+		l.remove(el)
+		return nil
+	}
+	l.order.MoveToFront(el)
+	return e
+}
+
+// add inserts e as the most recently used entry, replacing any entry with
+// the same key, and evicts entries until the cache fits. It reports false,
+// keeping nothing, when e alone is larger than the cache.
+func (l *lruIndex) add(e *cacheEntry) bool {
+	if el, ok := l.entries[e.Key]; ok {
+		l.remove(el)
+	}
+	if e.Size > l.maxSize {
+		return false
+	}
+	l.entries[e.Key] = l.order.PushFront(e)
+	l.size += e.Size
+	for l.size > l.maxSize {
+		l.remove(l.order.Back())
+	}
+	return true
+}
+
+func (l *lruIndex) remove(el *list.Element) {
+	e := l.order.Remove(el).(*cacheEntry)
+	delete(l.entries, e.Key)
+	l.size -= e.Size
+	if l.evict != nil {
+		l.evict(e)
+	}
+}
+
+// memoryResultCache keeps the results in memory; they are lost on restart.
+type memoryResultCache struct {
+	mu  sync.Mutex
+	lru *lruIndex
+}
+
+func newMemoryResultCache(maxSize int64, ttl time.Duration) *memoryResultCache {
+	return &memoryResultCache{lru: newLRUIndex(maxSize, ttl, nil)}
+}
+
+func (c *memoryResultCache) Get(key, path string) (*renderResult, error) {
+	c.mu.Lock()
+	e := c.lru.get(key, time.Now())
+	c.mu.Unlock()
+	if e == nil {
+		return nil, nil
+	}
+	// The data of an entry is never modified, only replaced.
+	if err := os.WriteFile(path, e.data, 0o600); err != nil {
+		return nil, err
+	}
+	return e.result(path), nil
+}
+
+func (c *memoryResultCache) Put(key string, result *renderResult) error {
+	if result.Size > c.lru.maxSize {
+		return nil
+	}
+	data, err := os.ReadFile(result.Path)
+	if err != nil {
+		return err
+	}
+	e := newCacheEntry(key, result, c.lru.ttl)
+	e.data = data
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.add(e)
+	return nil
+}
+
+// cacheKeyPattern matches the keys made by renderKey. The disk cache
+// checks it so that a key cannot name a path outside its directory.
+var cacheKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// diskResultCache keeps each result as <key>.result next to its entry
+// <key>.json, so that the cache survives a restart. The modification time of
+// the result records its last use.
+type diskResultCache struct {
+	dir string
+	mu  sync.Mutex
+	lru *lruIndex
+}
+
+// newDiskResultCache opens the cache in dir, creating it if needed, and
+// indexes the results already there.
+func newDiskResultCache(dir string, maxSize int64, ttl time.Duration) (*diskResultCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &diskResultCache{dir: dir}
+	c.lru = newLRUIndex(maxSize, ttl, c.removeFiles)
+
+	// Copies interrupted by a restart.
+	partial, _ := filepath.Glob(filepath.Join(dir, ".result-*"))
+	for _, name := range partial {
+		os.Remove(name)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		entry   *cacheEntry
+		lastUse time.Time
+	}
+	var entries []found
+	for _, name := range names {
+		key := strings.TrimSuffix(filepath.Base(name), ".json")
+		if !cacheKeyPattern.MatchString(key) {
+			continue
+		}
+		e, lastUse, err := c.load(key)
+		if err != nil {
+			c.removeFiles(&cacheEntry{Key: key})
+			continue
+		}
+		entries = append(entries, found{e, lastUse})
+	}
+	// Add the least recently used first, so that they are evicted first.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUse.Before(entries[j].lastUse) })
+	now := time.Now()
+	for _, f := range entries {
+		if !now.Before(f.entry.Expires) {
+			c.removeFiles(f.entry)
+			continue
+		}
+		c.lru.add(f.entry)
+	}
+	return c, nil
+}
+
+func (c *diskResultCache) path(key, ext string) string {
+	return filepath.Join(c.dir, key+ext)
+}
+
+// load reads the entry of key and the last use of its result.
+func (c *diskResultCache) load(key string) (*cacheEntry, time.Time, error) {
+	data, err := os.ReadFile(c.path(key, ".json"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := os.Stat(c.path(key, ".result"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if e.Key != key || info.Size() != e.Size {
+		return nil, time.Time{}, errors.New("inconsistent cache entry")
+	}
+	return &e, info.ModTime(), nil
+}
+
+// removeFiles deletes the files of e, the entry first so that a result is
+// never indexed without its file.
+func (c *diskResultCache) removeFiles(e *cacheEntry) {
+	os.Remove(c.path(e.Key, ".json"))
+	os.Remove(c.path(e.Key, ".result"))
+}
+
+func (c *diskResultCache) Get(key, path string) (*renderResult, error) {
+	if !cacheKeyPattern.MatchString(key) {
+		return nil, nil
+	}
+	c.mu.Lock()
+	e := c.lru.get(key, time.Now())
+	var src *os.File
+	if e != nil {
+		// Opened under the lock: an eviction after this does not affect
+		// the copy.
+		var err error
+		if src, err = os.Open(c.path(key, ".result")); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		now := time.Now()
+		os.Chtimes(c.path(key, ".result"), now, now)
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil, nil
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	return e.result(path), nil
+}
+
+func (c *diskResultCache) Put(key string, result *renderResult) error {
+	if !cacheKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid cache key %q", key)
+	}
+	if result.Size > c.lru.maxSize {
+		return nil
+	}
+	e := newCacheEntry(key, result, c.lru.ttl)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result outside the lock, under a name of its own.
+	tmp, err := os.CreateTemp(c.dir, ".result-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	src, err := os.Open(result.Path)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	src.Close()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.lru.entries[key]; ok {
+		c.lru.remove(el)
+	}
+	if err := os.Rename(tmp.Name(), c.path(key, ".result")); err != nil {
+		return err
+	}
+	// The entry is written last: a result exists once it is readable.
+	if err := writeFileAtomic(c.path(key, ".json"), data); err != nil {
+		os.Remove(c.path(key, ".result"))
+		return err
+	}
+	c.lru.add(e)
+	return nil
+}
+
+func newCacheEntry(key string, result *renderResult, ttl time.Duration) *cacheEntry {
+	return &cacheEntry{
+		Key:             key,
+		ContentType:     result.ContentType,
+		Size:            result.Size,
+		FailedResources: result.FailedResources,
+		Expires:         time.Now().Add(ttl),
+	}
+}
+
+// result returns the render result of e, copied to path.
+func (e *cacheEntry) result(path string) *renderResult {
+	return &renderResult{
+		Path:            path,
+		ContentType:     e.ContentType,
+		Size:            e.Size,
+		FailedResources: slices.Clone(e.FailedResources),
+		CacheKey:        e.Key,
+		Cached:          true,
+	}
+}
+
+// binaryVersions caches the --version output of the render binaries, which
+// is part of the cache key.
+var binaryVersions sync.Map // bin -> string
+
+func cachedBinaryVersion(ctx context.Context, bin string) (string, error) {
+	if v, ok := binaryVersions.Load(bin); ok {
+		return v.(string), nil
+	}
+	v, err := binaryVersion(ctx, bin)
+	if err != nil {
+		return "", err
+	}
+	binaryVersions.Store(bin, v)
+	return v, nil
+}
+
+// renderKey returns the key of a render of bin, which identifies its result
+// for the render cache and request coalescing: a SHA-256 over the binary
+// version, the options sorted by name, the other arguments in order, the
+// template data, if any, and every file in tmpdir. The templates are applied
+// by the render, so the files are their sources. It returns "" when both are
+// off or the render reads a remote URL, whose content may change.
+func renderKey(ctx context.Context, bin, tmpdir string, options, inputs []string, data []byte) string {
+	if renderCache == nil && !config.Coalesce {
+		return ""
+	}
+	logger := loggerFromContext(ctx)
+
+	for _, arg := range inputs {
+		if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+			return ""
+		}
+	}
+	version, err := cachedBinaryVersion(ctx, bin)
+	if err != nil {
+		logger.Warnf("Render key unavailable, not caching or coalescing: %v", err)
+		return ""
+	}
+
+	h := sha256.New()
+	field := func(s string) {
+		fmt.Fprintf(h, "%d:%s\n", len(s), s)
+	}
+	field("kwkhtmltopdf render cache v1")
+	field(version)
+	field(config.LocalFileAccess)
+	field(config.NetworkPolicy)
+	field(strings.Join(config.NetworkAllowHosts, ","))
+
+	// Paths vary with the request tmpdir.
+	relative := func(args []string) []string {
+		out := make([]string, len(args))
+		for i, arg := range args {
+			out[i] = strings.ReplaceAll(arg, tmpdir, "$TMPDIR")
+		}
+		return out
+	}
+	groups := optionGroups(relative(options))
+	sort.Slice(groups, func(i, j int) bool { return slices.Compare(groups[i], groups[j]) < 0 })
+	for _, g := range groups {
+		field(strings.Join(g, "\x00"))
+	}
+	field("inputs")
+	for _, arg := range relative(inputs) {
+		field(arg)
+	}
+	if data != nil {
+		field("data")
+		field(string(data))
+	}
+
+	err = filepath.WalkDir(tmpdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(tmpdir, path)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		field(filepath.ToSlash(rel))
+		fmt.Fprintf(h, "%d\n", info.Size())
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Render key unavailable, not caching or coalescing: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// optionGroups splits option arguments into one group per option: the
+// --name argument and its values.
+func optionGroups(args []string) [][]string {
+	var groups [][]string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") || len(groups) == 0 {
+			groups = append(groups, []string{arg})
+			continue
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], arg)
+	}
+	return groups
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useRenderCache(t *testing.T, cache resultCache) {
+	t.Helper()
+	saved := renderCache
+	renderCache = cache
+	t.Cleanup(func() { renderCache = saved })
+}
+
+func TestLRUIndex(t *testing.T) {
+	var evicted []string
+	l := newLRUIndex(10, time.Minute, func(e *cacheEntry) { evicted = append(evicted, e.Key) })
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		l.add(&cacheEntry{Key: key, Size: 4, Expires: now.Add(time.Minute)})
+		if key == "b" {
+			l.get("a", now) // a is now more recent than b
+		}
+	}
+	if len(evicted) != 1 || evicted[0] != "b" || l.size != 8 {
+		t.Fatalf("evicted %q, size %d", evicted, l.size)
+	}
+
+	if l.add(&cacheEntry{Key: "big", Size: 11}) {
+		t.Fatal("added an entry larger than the cache")
+	}
+	if e := l.get("a", now.Add(time.Minute)); e != nil || l.size != 4 {
+		t.Fatalf("expired entry %+v, size %d", e, l.size)
+	}
+}
+
+func TestRenderCacheKey(t *testing.T) {
+	bin := writeFakeWkhtmltopdf(t)
+	useRenderCache(t, newMemoryResultCache(1<<20, time.Hour))
+	ctx := context.Background()
+
+	key := func(files map[string]string, options []string) string {
+		tmpdir := t.TempDir()
+		for name, body := range files {
+			os.MkdirAll(filepath.Dir(filepath.Join(tmpdir, name)), 0o700)
+			os.WriteFile(filepath.Join(tmpdir, name), []byte(body), 0o600)
+		}
+		return renderKey(ctx, bin, tmpdir, options, []string{filepath.Join(tmpdir, "index.html")}, nil)
+	}
+
+	files := map[string]string{"index.html": "<p>1</p>", "css/style.css": "p {}"}
+	base := key(files, []string{"--page-size", "A4", "--grayscale"})
+	if !cacheKeyPattern.MatchString(base) {
+		t.Fatalf("key %q", base)
+	}
+	if k := key(files, []string{"--grayscale", "--page-size", "A4"}); k != base {
+		t.Error("the option order changes the key")
+	}
+	for name, k := range map[string]string{
+		"option value": key(files, []string{"--page-size", "A5", "--grayscale"}),
+		"file content": key(map[string]string{"index.html": "<p>2</p>", "css/style.css": "p {}"}, []string{"--page-size", "A4", "--grayscale"}),
+		"file name":    key(map[string]string{"index.html": "<p>1</p>", "css/main.css": "p {}"}, []string{"--page-size", "A4", "--grayscale"}),
+	} {
+		if k == base {
+			t.Errorf("%s: same key", name)
+		}
+	}
+
+	if k := renderKey(ctx, bin, t.TempDir(), nil, []string{"https://example.com/"}, nil); k != "" {
+		t.Errorf("URL input: key %q", k)
+	}
+	useRenderCache(t, nil)
+	if k := key(files, nil); k != "" {
+		t.Errorf("cache off: key %q", k)
+	}
+}
+
+func TestDiskResultCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newDiskResultCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key, body string) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "output.pdf")
+		os.WriteFile(path, []byte(body), 0o600)
+		if err := cache.Put(key, &renderResult{Path: path, ContentType: "application/pdf", Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyA, keyB := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	put(keyA, "aaaa")
+	put(keyB, "bbbbbbbb") // evicts a
+
+	// The index is rebuilt on open.
+	cache, err = newDiskResultCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if result, err := cache.Get(keyA, out); result != nil || err != nil {
+		t.Fatalf("evicted entry: %+v %v", result, err)
+	}
+	result, err := cache.Get(keyB, out)
+	if err != nil || result == nil || !result.Cached || result.ContentType != "application/pdf" {
+		t.Fatalf("Get: %+v %v", result, err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "bbbbbbbb" {
+		t.Fatalf("result %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, keyA+".result")); !os.IsNotExist(err) {
+		t.Fatalf("evicted result left on disk: %v", err)
+	}
+}
+
+func TestPDFHandler_cache(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	for name, cache := range map[string]func() resultCache{
+		"memory": func() resultCache { return newMemoryResultCache(1<<20, time.Hour) },
+		"disk": func() resultCache {
+			c, err := newDiskResultCache(t.TempDir(), 1<<20, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			useRenderCache(t, cache())
+
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A4"}))
+			etag := rec.Header().Get("ETag")
+			if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" || etag == "" {
+				t.Fatalf("first: status %d X-Cache %q ETag %q", rec.Code, rec.Header().Get("X-Cache"), etag)
+			}
+
+			// A hit needs no render slot.
+			saved := renderSlots
+			renderSlots = newRenderLimiter(1, 0, time.Second)
+			defer func() { renderSlots = saved }()
+			release, err := renderSlots.Acquire(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+
+			rec = httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A4"}))
+			if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("ETag") != etag || rec.Body.String() != fakePDF {
+				t.Fatalf("second: status %d X-Cache %q ETag %q body %q", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("ETag"), rec.Body.String())
+			}
+
+			req := newPDFRequest(t, map[string]string{"page-size": "A4"})
+			req.Header.Set("If-None-Match", etag)
+			rec = httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, req)
+			if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+				t.Fatalf("If-None-Match: status %d body %q", rec.Code, rec.Body.String())
+			}
+
+			// A different request misses, and waits for the held slot.
+			rec = httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A5"}))
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("miss: status %d", rec.Code)
+			}
+		})
+	}
+}
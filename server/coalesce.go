@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// renderFlights shares renders between identical concurrent requests.
+var renderFlights = &flightGroup{flights: map[string]*flight{}}
+
+// flightGroup tracks the renders in progress by render key.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is one render shared by the requests that asked for it while it
+// ran. The render runs in the tmpdir of the first request, which waits for
+// the others to copy the result before returning, and is cancelled only once
+// every request gave up on it.
+type flight struct {
+	done   chan struct{}
+	result *renderResult
+	err    error
+
+	waiting int // requests still interested, under flightGroup.mu
+	cancel  context.CancelCauseFunc
+	copies  sync.WaitGroup // requests copying the result
+}
+
+// do runs p, or waits for the identical render in progress and copies its
+// result to the tmpdir of p. Each request stops waiting when its own ctx is
+// done. An accepted p runs itself if the render it waited for found no slot.
+func (g *flightGroup) do(ctx context.Context, p *preparedRender, started func() error) (*renderResult, error) {
+	g.mu.Lock()
+	// A flight every request gave up on is being cancelled: start afresh.
+	if f, ok := g.flights[p.key]; ok && f.waiting > 0 {
+		f.waiting++
+		f.copies.Add(1)
+		g.mu.Unlock()
+		result, err := g.wait(ctx, f, p, started)
+		f.copies.Done()
+		if p.accepted && (errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout)) {
+			// The request that ran the render found no slot in time,
+			// which an accepted render waits for.
+			return p.run(ctx, nil)
+		}
+		return result, err
+	}
+	renderCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	f := &flight{done: make(chan struct{}), waiting: 1, cancel: cancel}
+	g.flights[p.key] = f
+	g.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { g.leave(f, context.Cause(ctx)) })
+	f.result, f.err = p.run(renderCtx, started)
+	stop()
+	cancel(nil)
+
+	g.mu.Lock()
+	if g.flights[p.key] == f {
+		delete(g.flights, p.key)
+	}
+	g.mu.Unlock()
+	close(f.done)
+	f.copies.Wait()
+
+	return f.result, f.err
+}
+
+// wait waits for the render of f and copies its result to the tmpdir of p.
+// started, if not nil, is called first: the request is served by a render
+// that has started.
+func (g *flightGroup) wait(ctx context.Context, f *flight, p *preparedRender, started func() error) (*renderResult, error) {
+	logger := loggerFromContext(ctx)
+
+	logger.Infof("Waiting for the identical render in progress %s", p.key)
+	coalescedRenders.Inc()
+	if started != nil {
+		if err := started(); err != nil {
+			g.leave(f, err)
+			return nil, err
+		}
+	}
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		g.leave(f, context.Cause(ctx))
+		return nil, renderCancelledError(ctx)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	result := *f.result
+	result.Path = filepath.Join(p.tmpdir, filepath.Base(f.result.Path))
+	result.FailedResources = slices.Clone(f.result.FailedResources)
+	if err := copyFile(f.result.Path, result.Path); err != nil {
+		p.errors.WithLabelValues("read_output_failed", err.Error()).Inc()
+		return nil, newAPIError(http.StatusInternalServerError, codeReadOutputFailed, err)
+	}
+	return &result, nil
+}
+
+// leave records that a request gave up on f, cancelling the render when it
+// was the last one.
+func (g *flightGroup) leave(f *flight, cause error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f.waiting--
+	if f.waiting == 0 {
+		f.cancel(cause)
+	}
+}
+
+// copyFile copies the regular file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
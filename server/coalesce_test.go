@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeBlockedWkhtmltopdf installs a fake wkhtmltopdf that logs each run to
+// the returned runs file and renders once the go file exists.
+func writeBlockedWkhtmltopdf(t *testing.T) (runs, goFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	runs, goFile = filepath.Join(dir, "runs"), filepath.Join(dir, "go")
+	path := filepath.Join(dir, "fake-wkhtmltopdf.sh")
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = --version ] && { echo 'wkhtmltopdf 0.12.6 (fake)'; exit 0; }\n" +
+		"echo run >> " + runs + "\n" +
+		"while [ ! -e " + goFile + " ]; do sleep 0.01; done\n" +
+		"for OUT in \"$@\"; do :; done\n" +
+		"printf '%s' '" + fakePDF + "' > \"$OUT\"\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", path)
+	return runs, goFile
+}
+
+// waitForFlight waits until n requests wait for the single render in progress.
+func waitForFlight(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		renderFlights.mu.Lock()
+		waiting := 0
+		for _, f := range renderFlights.flights {
+			waiting += f.waiting
+		}
+		renderFlights.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d requests never joined the render", n)
+}
+
+func TestPDFHandler_coalesce(t *testing.T) {
+	runs, goFile := writeBlockedWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { c.Coalesce = true })
+
+	const requests = 4
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, requests)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			withTraceID(pdfHandler)(recs[i], newPDFRequest(t, map[string]string{"page-size": "A4"}))
+		}()
+		if i == 0 {
+			waitForFlight(t, 1) // the first request leads
+		}
+	}
+	waitForFlight(t, requests)
+
+	// A waiter gives up on its own.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A4"}).WithContext(ctx))
+		done <- rec
+	}()
+	waitForFlight(t, requests+1)
+	cancel()
+	if rec := <-done; rec.Code != http.StatusRequestTimeout {
+		t.Fatalf("cancelled waiter: status %d", rec.Code)
+	}
+
+	os.WriteFile(goFile, nil, 0o600)
+	wg.Wait()
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+			t.Fatalf("request %d: status %d body %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 1 {
+		t.Fatalf("%d renders, want 1", strings.Count(string(data), "run"))
+	}
+}
+
+func TestPDFHandler_coalesceAllCancelled(t *testing.T) {
+	runs, _ := writeBlockedWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { c.Coalesce = true })
+
+	var cancels []context.CancelFunc
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		go func() {
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, nil).WithContext(ctx))
+			done <- rec.Code
+		}()
+		waitForFlight(t, i+1)
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for range cancels {
+		select {
+		case code := <-done:
+			if code != http.StatusRequestTimeout {
+				t.Fatalf("status %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the render was not cancelled")
+		}
+	}
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 1 {
+		t.Fatalf("%d renders, want 1", strings.Count(string(data), "run"))
+	}
+}
+
+func TestJobs_coalesceStarted(t *testing.T) {
+	_, goFile := writeBlockedWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { c.Coalesce = true })
+	useMemoryJobStore(t)
+	router := newRouter()
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		req := newPDFRequest(t, nil)
+		req.URL.Path = "/jobs/pdf"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var queued job
+		if err := json.NewDecoder(rec.Body).Decode(&queued); err != nil || rec.Code != http.StatusAccepted {
+			t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+		}
+		ids = append(ids, queued.ID)
+		waitForFlight(t, i+1)
+	}
+
+	// The job that joined the render is running too.
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for {
+			j, err := renderJobs.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.Status == jobRunning && j.StartedAt != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job %+v", j)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	os.WriteFile(goFile, nil, 0o600)
+	jobWorkers.Wait()
+	for _, id := range ids {
+		if j, _ := renderJobs.Get(id); j.Status != jobSucceeded {
+			t.Fatalf("job %+v", j)
+		}
+	}
+}
+
+func TestJobs_coalescedQueueTimeout(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { c.Coalesce = true })
+	useMemoryJobStore(t)
+	saved := renderSlots
+	renderSlots = newRenderLimiter(1, 1, 200*time.Millisecond)
+	defer func() { renderSlots = saved }()
+	release, err := renderSlots.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	router := newRouter()
+
+	// A synchronous request leads the render and waits in the queue...
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		withTraceID(pdfHandler)(rec, newPDFRequest(t, nil))
+		done <- rec.Code
+	}()
+	waitForFlight(t, 1)
+
+	// ...which an identical job joins.
+	req := newPDFRequest(t, nil)
+	req.URL.Path = "/jobs/pdf"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var queued job
+	if err := json.NewDecoder(rec.Body).Decode(&queued); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+	waitForFlight(t, 2)
+
+	// The request times out in the queue, the job renders once a slot is free.
+	if code := <-done; code != http.StatusServiceUnavailable {
+		t.Fatalf("/pdf: status %d", code)
+	}
+	release()
+	jobWorkers.Wait()
+	if j, _ := renderJobs.Get(queued.ID); j.Status != jobSucceeded {
+		t.Fatalf("job %+v error %+v", j, j.Error)
+	}
+}
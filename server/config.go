@@ -0,0 +1,550 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings. Each setting can be given, from lowest to
+// highest precedence, in the YAML config file, in an environment variable or
+// as a command line flag.
+type Config struct {
+	ListenAddr        string
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxBodySize       int64
+	BundleMaxEntries  int
+	BundleMaxSize     int64
+	BatchMaxItems     int
+	BatchConcurrency  int
+	TempDir           string
+	WkhtmltopdfBin    string
+	WkhtmltoimageBin  string
+	OptionValidation  string
+	LocalFileAccess   string
+	OptionAllow       []string
+	OptionDeny        []string
+	TemplateStrict    bool
+	TemplateStoreDir  string
+	MaxConcurrency    int
+	MaxQueue          int
+	QueueTimeout      time.Duration
+	RenderTimeout     time.Duration
+	MaxRenderTimeout  time.Duration
+
+	RenderMaxMemory    int64
+	RenderMaxCPU       time.Duration
+	RenderMaxOpenFiles int
+	RenderMaxFileSize  int64
+	SandboxNamespaces  string
+
+	Cache        string
+	CacheDir     string
+	CacheMaxSize int64
+	CacheTTL     time.Duration
+	Coalesce     bool
+
+	ShutdownDelay       time.Duration
+	ShutdownGracePeriod time.Duration
+
+	MinFreeSpace        int64
+	ReadyQueueThreshold int
+	CanaryInterval      time.Duration
+
+	JobStore          string
+	JobStoreDir       string
+	JobTTL            time.Duration
+	WebhookSecretFile string
+	WebhookTimeout    time.Duration
+
+	URLAllowHosts   []string
+	URLDenyHosts    []string
+	URLAllowPrivate bool
+	URLMaxRedirects int
+	URLTimeout      time.Duration
+
+	NetworkPolicy     string
+	NetworkAllowHosts []string
+
+	Auth               []string
+	AuthAPIKeysFile    string
+	AuthHMACKeysFile   string
+	AuthJWKSFile       string
+	AuthJWTIssuer      string
+	AuthJWTAudience    string
+	AuthJWTClientClaim string
+	AuthMaxSkew        time.Duration
+}
+
+// config is the effective configuration, set by main before serving.
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:        ":8080",
+		TLSReloadInterval: time.Minute,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       5 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxBodySize:       100 << 20,
+		BundleMaxEntries:  1000,
+		BundleMaxSize:     500 << 20,
+		BatchMaxItems:     1000,
+		BatchConcurrency:  4,
+		OptionValidation:  validationStrict,
+		LocalFileAccess:   localFileAccessTmpdir,
+		TemplateStrict:    true,
+		MaxConcurrency:    runtime.NumCPU(),
+		MaxQueue:          50,
+		QueueTimeout:      30 * time.Second,
+		RenderTimeout:     60 * time.Second,
+		MaxRenderTimeout:  5 * time.Minute,
+
+		SandboxNamespaces: sandboxOff,
+
+		CacheMaxSize: 256 << 20,
+		CacheTTL:     time.Hour,
+
+		ShutdownDelay:       5 * time.Second,
+		ShutdownGracePeriod: 30 * time.Second,
+
+		MinFreeSpace: 100 << 20,
+
+		JobStore:       jobStoreMemory,
+		JobTTL:         time.Hour,
+		WebhookTimeout: 10 * time.Second,
+
+		URLMaxRedirects: 5,
+		URLTimeout:      10 * time.Second,
+
+		NetworkPolicy: networkOpen,
+
+		AuthJWTClientClaim: "sub",
+		AuthMaxSkew:        5 * time.Minute,
+	}
+}
+
+// setting binds one Config field to its flag, config file key and
+// environment variable.
+type setting struct {
+	name  string // flag name and config file key
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen-addr", "KWKHTMLTOPDF_LISTEN_ADDR", "address to listen on", (*stringValue)(&c.ListenAddr)},
+		{"tls-cert-file", "KWKHTMLTOPDF_TLS_CERT_FILE", "TLS certificate file; enables HTTPS together with tls-key-file", (*stringValue)(&c.TLSCertFile)},
+		{"tls-key-file", "KWKHTMLTOPDF_TLS_KEY_FILE", "TLS private key file", (*stringValue)(&c.TLSKeyFile)},
+		{"tls-reload-interval", "KWKHTMLTOPDF_TLS_RELOAD_INTERVAL", "how often to check the TLS files for changes", (*durationValue)(&c.TLSReloadInterval)},
+		{"read-header-timeout", "KWKHTMLTOPDF_READ_HEADER_TIMEOUT", "maximum time to read request headers", (*durationValue)(&c.ReadHeaderTimeout)},
+		{"read-timeout", "KWKHTMLTOPDF_READ_TIMEOUT", "maximum time to read a whole request, 0 for none", (*durationValue)(&c.ReadTimeout)},
+		{"write-timeout", "KWKHTMLTOPDF_WRITE_TIMEOUT", "maximum time to write a response, 0 for none", (*durationValue)(&c.WriteTimeout)},
+		{"idle-timeout", "KWKHTMLTOPDF_IDLE_TIMEOUT", "maximum keep-alive idle time", (*durationValue)(&c.IdleTimeout)},
+		{"max-body-size", "KWKHTMLTOPDF_MAX_BODY_SIZE", "maximum request body size in bytes, 0 for no limit", (*int64Value)(&c.MaxBodySize)},
+		{"bundle-max-entries", "KWKHTMLTOPDF_BUNDLE_MAX_ENTRIES", "maximum entries in a bundle, 0 for no limit", (*intValue)(&c.BundleMaxEntries)},
+		{"bundle-max-size", "KWKHTMLTOPDF_BUNDLE_MAX_SIZE", "maximum extracted size of a bundle in bytes, 0 for no limit", (*int64Value)(&c.BundleMaxSize)},
+		{"batch-max-items", "KWKHTMLTOPDF_BATCH_MAX_ITEMS", "maximum documents in a batch, 0 for no limit", (*intValue)(&c.BatchMaxItems)},
+		{"batch-concurrency", "KWKHTMLTOPDF_BATCH_CONCURRENCY", "documents of one batch rendered at once", (*intValue)(&c.BatchConcurrency)},
+		{"temp-dir", "KWKHTMLTOPDF_TEMP_DIR", "root of the per-request temporary directories (default: system temp dir)", (*stringValue)(&c.TempDir)},
+		{"wkhtmltopdf-bin", "KWKHTMLTOPDF_BIN", "wkhtmltopdf binary (default: wkhtmltopdf on PATH)", (*stringValue)(&c.WkhtmltopdfBin)},
+		{"wkhtmltoimage-bin", "KWKHTMLTOIMAGE_BIN", "wkhtmltoimage binary (default: wkhtmltoimage on PATH)", (*stringValue)(&c.WkhtmltoimageBin)},
+		{"option-validation", "KWKHTMLTOPDF_OPTION_VALIDATION", "form field validation: strict, warn or off", (*stringValue)(&c.OptionValidation)},
+		{"option-allow", "KWKHTMLTOPDF_OPTION_ALLOW", "comma-separated options clients may give (default: any but run-script and the proxy options)", (*stringListValue)(&c.OptionAllow)},
+		{"option-deny", "KWKHTMLTOPDF_OPTION_DENY", "comma-separated options clients may not give", (*stringListValue)(&c.OptionDeny)},
+		{"local-file-access", "KWKHTMLTOPDF_LOCAL_FILE_ACCESS", "local files a render can read: tmpdir (the request files) or any", (*stringValue)(&c.LocalFileAccess)},
+		{"template-strict", "KWKHTMLTOPDF_TEMPLATE_STRICT", "fail template renders that use a key missing from the data", (*boolValue)(&c.TemplateStrict)},
+		{"template-store-dir", "KWKHTMLTOPDF_TEMPLATE_STORE_DIR", "directory of the template registry (default: registry disabled)", (*stringValue)(&c.TemplateStoreDir)},
+		{"max-concurrency", "KWKHTMLTOPDF_MAX_CONCURRENCY", "maximum concurrent render processes", (*intValue)(&c.MaxConcurrency)},
+		{"max-queue", "KWKHTMLTOPDF_MAX_QUEUE", "maximum requests waiting for a render slot", (*intValue)(&c.MaxQueue)},
+		{"queue-timeout", "KWKHTMLTOPDF_QUEUE_TIMEOUT", "maximum wait for a render slot", (*durationValue)(&c.QueueTimeout)},
+		{"render-timeout", "KWKHTMLTOPDF_RENDER_TIMEOUT", "default render timeout", (*durationValue)(&c.RenderTimeout)},
+		{"max-render-timeout", "KWKHTMLTOPDF_MAX_RENDER_TIMEOUT", "maximum render timeout a client may request", (*durationValue)(&c.MaxRenderTimeout)},
+		{"render-max-memory", "KWKHTMLTOPDF_RENDER_MAX_MEMORY", "address space limit of a render process in bytes, 0 for none", (*int64Value)(&c.RenderMaxMemory)},
+		{"render-max-cpu", "KWKHTMLTOPDF_RENDER_MAX_CPU", "CPU time limit of a render process, 0 for none", (*durationValue)(&c.RenderMaxCPU)},
+		{"render-max-open-files", "KWKHTMLTOPDF_RENDER_MAX_OPEN_FILES", "open files limit of a render process, 0 for none", (*intValue)(&c.RenderMaxOpenFiles)},
+		{"render-max-file-size", "KWKHTMLTOPDF_RENDER_MAX_FILE_SIZE", "largest file a render process may write in bytes, 0 for none", (*int64Value)(&c.RenderMaxFileSize)},
+		{"sandbox-namespaces", "KWKHTMLTOPDF_SANDBOX_NAMESPACES", "run render processes in user, mount and network namespaces: off, auto (when the kernel allows) or on", (*stringValue)(&c.SandboxNamespaces)},
+		{"cache", "KWKHTMLTOPDF_CACHE", "render cache: memory or disk (default: off)", (*stringValue)(&c.Cache)},
+		{"cache-dir", "KWKHTMLTOPDF_CACHE_DIR", "directory of the disk render cache", (*stringValue)(&c.CacheDir)},
+		{"cache-max-size", "KWKHTMLTOPDF_CACHE_MAX_SIZE", "maximum size of the cached results in bytes", (*int64Value)(&c.CacheMaxSize)},
+		{"cache-ttl", "KWKHTMLTOPDF_CACHE_TTL", "how long a result stays in the render cache", (*durationValue)(&c.CacheTTL)},
+		{"coalesce", "KWKHTMLTOPDF_COALESCE", "share one render between identical concurrent requests", (*boolValue)(&c.Coalesce)},
+		{"shutdown-delay", "KWKHTMLTOPDF_SHUTDOWN_DELAY", "time /status fails before the server stops accepting connections", (*durationValue)(&c.ShutdownDelay)},
+		{"shutdown-grace-period", "KWKHTMLTOPDF_SHUTDOWN_GRACE_PERIOD", "time allowed for in-flight renders to finish on shutdown", (*durationValue)(&c.ShutdownGracePeriod)},
+		{"min-free-space", "KWKHTMLTOPDF_MIN_FREE_SPACE", "free bytes required in temp-dir for /readyz", (*int64Value)(&c.MinFreeSpace)},
+		{"ready-queue-threshold", "KWKHTMLTOPDF_READY_QUEUE_THRESHOLD", "queue depth at which /readyz fails (default: max-queue)", (*intValue)(&c.ReadyQueueThreshold)},
+		{"canary-interval", "KWKHTMLTOPDF_CANARY_INTERVAL", "interval between canary renders checked by /readyz, 0 to disable", (*durationValue)(&c.CanaryInterval)},
+		{"job-store", "KWKHTMLTOPDF_JOB_STORE", "where async jobs are kept: memory or disk", (*stringValue)(&c.JobStore)},
+		{"job-store-dir", "KWKHTMLTOPDF_JOB_STORE_DIR", "directory of the disk job store", (*stringValue)(&c.JobStoreDir)},
+		{"job-ttl", "KWKHTMLTOPDF_JOB_TTL", "how long finished jobs and their results are kept", (*durationValue)(&c.JobTTL)},
+		{"webhook-secret-file", "KWKHTMLTOPDF_WEBHOOK_SECRET_FILE", "file holding the key that signs job callbacks (default: unsigned)", (*stringValue)(&c.WebhookSecretFile)},
+		{"webhook-timeout", "KWKHTMLTOPDF_WEBHOOK_TIMEOUT", "timeout of one job callback attempt", (*durationValue)(&c.WebhookTimeout)},
+		{"url-allow-hosts", "KWKHTMLTOPDF_URL_ALLOW_HOSTS", "comma-separated hosts allowed in URL mode, *.example.com for subdomains (default: any)", (*stringListValue)(&c.URLAllowHosts)},
+		{"url-deny-hosts", "KWKHTMLTOPDF_URL_DENY_HOSTS", "comma-separated hosts refused in URL mode", (*stringListValue)(&c.URLDenyHosts)},
+		{"url-allow-private", "KWKHTMLTOPDF_URL_ALLOW_PRIVATE", "allow URL mode to reach private, loopback and link-local addresses", (*boolValue)(&c.URLAllowPrivate)},
+		{"url-max-redirects", "KWKHTMLTOPDF_URL_MAX_REDIRECTS", "maximum redirects followed for an input URL", (*intValue)(&c.URLMaxRedirects)},
+		{"url-timeout", "KWKHTMLTOPDF_URL_TIMEOUT", "timeout for checking an input URL", (*durationValue)(&c.URLTimeout)},
+		{"network-policy", "KWKHTMLTOPDF_NETWORK_POLICY", "what renders may fetch: open, offline or proxy", (*stringValue)(&c.NetworkPolicy)},
+		{"network-allow-hosts", "KWKHTMLTOPDF_NETWORK_ALLOW_HOSTS", "comma-separated hosts renders may fetch from with network-policy proxy (default: any public host)", (*stringListValue)(&c.NetworkAllowHosts)},
+		{"auth", "KWKHTMLTOPDF_AUTH", "comma-separated authentication methods: api-key, hmac and jwt (default: none)", (*stringListValue)(&c.Auth)},
+		{"auth-api-keys-file", "KWKHTMLTOPDF_AUTH_API_KEYS_FILE", "file of \"<client-id> <key>\" lines for auth api-key", (*stringValue)(&c.AuthAPIKeysFile)},
+		{"auth-hmac-keys-file", "KWKHTMLTOPDF_AUTH_HMAC_KEYS_FILE", "file of \"<client-id> <secret>\" lines for auth hmac", (*stringValue)(&c.AuthHMACKeysFile)},
+		{"auth-jwks-file", "KWKHTMLTOPDF_AUTH_JWKS_FILE", "JWKS file of the keys signing tokens for auth jwt", (*stringValue)(&c.AuthJWKSFile)},
+		{"auth-jwt-issuer", "KWKHTMLTOPDF_AUTH_JWT_ISSUER", "required iss claim of tokens (default: any)", (*stringValue)(&c.AuthJWTIssuer)},
+		{"auth-jwt-audience", "KWKHTMLTOPDF_AUTH_JWT_AUDIENCE", "required aud claim of tokens (default: any)", (*stringValue)(&c.AuthJWTAudience)},
+		{"auth-jwt-client-claim", "KWKHTMLTOPDF_AUTH_JWT_CLIENT_CLAIM", "token claim holding the client ID", (*stringValue)(&c.AuthJWTClientClaim)},
+		{"auth-max-skew", "KWKHTMLTOPDF_AUTH_MAX_SKEW", "clock difference tolerated for HMAC timestamps and token expiry", (*durationValue)(&c.AuthMaxSkew)},
+	}
+}
+
+// loadConfig builds the configuration from defaults, the optional config
+// file, the environment and the command line, in increasing precedence.
+func loadConfig(args []string, getenv func(string) string) (cfg *Config, printConfig bool, err error) {
+	cfg = defaultConfig()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("kwkhtmltopdf", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("KWKHTMLTOPDF_CONFIG"), "YAML config file (env KWKHTMLTOPDF_CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	for _, s := range settings {
+		fs.Var(s.value, s.name, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	// Flags were applied by Parse; remember them so that they can be
+	// re-applied over the config file and the environment.
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, s := range settings {
+		if v := getenv(s.env); v != "" {
+			if err := s.value.Set(v); err != nil {
+				return nil, false, fmt.Errorf("invalid %s %q: %w", s.env, v, err)
+			}
+		}
+		if v, ok := flags[s.name]; ok {
+			s.value.Set(v)
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, false, err
+	}
+	return cfg, printConfig, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	byName := map[string]setting{}
+	for _, s := range c.settings() {
+		byName[s.name] = s
+	}
+	for key, node := range values {
+		s, ok := byName[key]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown setting %q", path, key)
+		}
+		value := node.Value
+		if _, isList := s.value.(*stringListValue); isList && node.Kind == yaml.SequenceNode {
+			var items []string
+			if err := node.Decode(&items); err != nil {
+				return fmt.Errorf("config file %s: %s must be a list of strings", path, key)
+			}
+			value = strings.Join(items, ",")
+		} else if node.Kind != yaml.ScalarNode {
+			return fmt.Errorf("config file %s: %s must be a scalar", path, key)
+		}
+		if err := s.value.Set(value); err != nil {
+			return fmt.Errorf("config file %s: invalid %s %q: %w", path, key, value, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen-addr must not be empty"))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls-cert-file and tls-key-file must be set together"))
+	}
+	for _, f := range []string{c.TLSCertFile, c.TLSKeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, fmt.Errorf("TLS file: %w", err))
+		}
+	}
+	if c.TLSCertFile != "" && c.TLSReloadInterval <= 0 {
+		errs = append(errs, errors.New("tls-reload-interval must be positive"))
+	}
+	for name, d := range map[string]time.Duration{
+		"read-header-timeout":   c.ReadHeaderTimeout,
+		"read-timeout":          c.ReadTimeout,
+		"write-timeout":         c.WriteTimeout,
+		"idle-timeout":          c.IdleTimeout,
+		"queue-timeout":         c.QueueTimeout,
+		"shutdown-delay":        c.ShutdownDelay,
+		"shutdown-grace-period": c.ShutdownGracePeriod,
+		"canary-interval":       c.CanaryInterval,
+		"webhook-timeout":       c.WebhookTimeout,
+		"url-timeout":           c.URLTimeout,
+		"auth-max-skew":         c.AuthMaxSkew,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	if c.WriteTimeout > 0 && c.WriteTimeout <= c.QueueTimeout+c.MaxRenderTimeout {
+		errs = append(errs, errors.New("write-timeout must exceed queue-timeout + max-render-timeout"))
+	}
+	if c.MaxBodySize < 0 {
+		errs = append(errs, errors.New("max-body-size must not be negative"))
+	}
+	if c.BundleMaxEntries < 0 || c.BundleMaxSize < 0 {
+		errs = append(errs, errors.New("bundle-max-entries and bundle-max-size must not be negative"))
+	}
+	if c.TempDir != "" {
+		if info, err := os.Stat(c.TempDir); err != nil {
+			errs = append(errs, fmt.Errorf("temp-dir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("temp-dir: %s is not a directory", c.TempDir))
+		}
+	}
+	switch c.OptionValidation {
+	case validationStrict, validationWarn, validationOff:
+	default:
+		errs = append(errs, fmt.Errorf("option-validation must be strict, warn or off, not %q", c.OptionValidation))
+	}
+	for _, name := range slices.Concat(c.OptionAllow, c.OptionDeny) {
+		if !optionNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("invalid option name %q in option-allow or option-deny: give it without --", name))
+		}
+	}
+	switch c.LocalFileAccess {
+	case localFileAccessTmpdir, localFileAccessAny:
+	default:
+		errs = append(errs, fmt.Errorf("local-file-access must be tmpdir or any, not %q", c.LocalFileAccess))
+	}
+	if c.MaxConcurrency < 1 {
+		errs = append(errs, errors.New("max-concurrency must be at least 1"))
+	}
+	if c.BatchConcurrency < 1 {
+		errs = append(errs, errors.New("batch-concurrency must be at least 1"))
+	}
+	if c.MaxQueue < 0 {
+		errs = append(errs, errors.New("max-queue must not be negative"))
+	}
+	if c.ReadyQueueThreshold < 0 || c.ReadyQueueThreshold > c.MaxQueue {
+		errs = append(errs, errors.New("ready-queue-threshold must be between 0 and max-queue"))
+	}
+	if c.MinFreeSpace < 0 {
+		errs = append(errs, errors.New("min-free-space must not be negative"))
+	}
+	if c.RenderTimeout <= 0 || c.MaxRenderTimeout <= 0 {
+		errs = append(errs, errors.New("render-timeout and max-render-timeout must be positive"))
+	} else if c.RenderTimeout > c.MaxRenderTimeout {
+		errs = append(errs, errors.New("render-timeout must not exceed max-render-timeout"))
+	}
+	switch c.Cache {
+	case "", cacheMemory:
+	case cacheDisk:
+		if c.CacheDir == "" {
+			errs = append(errs, errors.New("cache-dir is required with cache disk"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache must be empty, memory or disk, not %q", c.Cache))
+	}
+	if c.Cache != "" && (c.CacheMaxSize <= 0 || c.CacheTTL <= 0) {
+		errs = append(errs, errors.New("cache-max-size and cache-ttl must be positive"))
+	}
+	switch c.JobStore {
+	case jobStoreMemory:
+	case jobStoreDisk:
+		if c.JobStoreDir == "" {
+			errs = append(errs, errors.New("job-store-dir is required with job-store disk"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("job-store must be memory or disk, not %q", c.JobStore))
+	}
+	if c.JobTTL <= 0 {
+		errs = append(errs, errors.New("job-ttl must be positive"))
+	}
+	if c.WebhookSecretFile != "" {
+		if _, err := os.Stat(c.WebhookSecretFile); err != nil {
+			errs = append(errs, fmt.Errorf("webhook-secret-file: %w", err))
+		}
+	}
+	if c.URLMaxRedirects < 0 {
+		errs = append(errs, errors.New("url-max-redirects must not be negative"))
+	}
+	if c.RenderMaxMemory < 0 || c.RenderMaxCPU < 0 || c.RenderMaxOpenFiles < 0 || c.RenderMaxFileSize < 0 {
+		errs = append(errs, errors.New("render-max-memory, render-max-cpu, render-max-open-files and render-max-file-size must not be negative"))
+	}
+	switch c.SandboxNamespaces {
+	case sandboxOff, sandboxAuto, sandboxOn:
+	default:
+		errs = append(errs, fmt.Errorf("sandbox-namespaces must be off, auto or on, not %q", c.SandboxNamespaces))
+	}
+	switch c.NetworkPolicy {
+	case networkOpen, networkOffline, networkProxy:
+	default:
+		errs = append(errs, fmt.Errorf("network-policy must be open, offline or proxy, not %q", c.NetworkPolicy))
+	}
+	for _, host := range slices.Concat(c.URLAllowHosts, c.URLDenyHosts, c.NetworkAllowHosts) {
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.Contains(host, "/") {
+			errs = append(errs, fmt.Errorf("invalid host pattern %q: use example.com or *.example.com", host))
+		}
+	}
+	for _, method := range c.Auth {
+		file, name := "", ""
+		switch method {
+		case authAPIKey:
+			file, name = c.AuthAPIKeysFile, "auth-api-keys-file"
+		case authHMAC:
+			file, name = c.AuthHMACKeysFile, "auth-hmac-keys-file"
+		case authJWT:
+			file, name = c.AuthJWKSFile, "auth-jwks-file"
+			if c.AuthJWTClientClaim == "" {
+				errs = append(errs, errors.New("auth-jwt-client-claim is required with auth jwt"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("auth methods are api-key, hmac and jwt, not %q", method))
+			continue
+		}
+		if file == "" {
+			errs = append(errs, fmt.Errorf("%s is required with auth %s", name, method))
+		} else if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Print writes the effective settings in the config file format.
+func (c *Config) Print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range c.settings() {
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: s.name},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: s.value.String()},
+		)
+	}
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+	return enc.Encode(doc)
+}
+
+// flag.Value implementations pointing into Config fields.
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type int64Value int64
+
+func (v *int64Value) String() string { return strconv.FormatInt(int64(*v), 10) }
+func (v *int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	*v = int64Value(n)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("not a boolean")
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value.
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// stringListValue is a comma-separated list; a YAML list is also accepted in
+// the config file. Items are trimmed and lowercased.
+type stringListValue []string
+
+func (v *stringListValue) String() string { return strings.Join(*v, ",") }
+func (v *stringListValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("not a duration such as 30s")
+	}
+	*v = durationValue(d)
+	return nil
+}
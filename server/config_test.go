@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestConfig applies change to a copy of the current configuration for
+// the duration of the test.
+func setTestConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	saved := config
+	cfg := *config
+	change(&cfg)
+	config = &cfg
+	t.Cleanup(func() { config = saved })
+}
+
+func envMap(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadConfig_precedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	content := "listen-addr: \":9000\"\nmax-queue: 10\nrender-timeout: 20s\nmax-concurrency: 3\n"
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := envMap(map[string]string{
+		"KWKHTMLTOPDF_CONFIG":          file,
+		"KWKHTMLTOPDF_MAX_QUEUE":       "20",
+		"KWKHTMLTOPDF_RENDER_TIMEOUT":  "30s",
+		"KWKHTMLTOPDF_MAX_CONCURRENCY": "4",
+	})
+	cfg, printConfig, err := loadConfig([]string{"--max-queue", "30"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Error("print-config set without the flag")
+	}
+	if cfg.ListenAddr != ":9000" {
+		t.Errorf("listen-addr %q: config file not applied", cfg.ListenAddr)
+	}
+	if cfg.MaxConcurrency != 4 || cfg.RenderTimeout != 30*time.Second {
+		t.Errorf("environment does not override the config file: %+v", cfg)
+	}
+	if cfg.MaxQueue != 30 {
+		t.Errorf("max-queue %d: flag does not override the environment", cfg.MaxQueue)
+	}
+	if cfg.ReadHeaderTimeout != defaultConfig().ReadHeaderTimeout {
+		t.Errorf("default read-header-timeout lost: %v", cfg.ReadHeaderTimeout)
+	}
+}
+
+func TestLoadConfig_invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, []byte("listen-adr: \":9000\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"unknown file key", []string{"--config", file}, nil},
+		{"bad env duration", nil, map[string]string{"KWKHTMLTOPDF_QUEUE_TIMEOUT": "soon"}},
+		{"bad flag", []string{"--max-concurrency", "many"}, nil},
+		{"cert without key", []string{"--tls-cert-file", file}, nil},
+		{"bad validation mode", []string{"--option-validation", "lenient"}, nil},
+		{"render timeout above max", []string{"--render-timeout", "10m"}, nil},
+		{"write timeout too short", []string{"--write-timeout", "1m"}, nil},
+		{"missing temp dir", []string{"--temp-dir", "/does/not/exist"}, nil},
+		{"bad local file access", []string{"--local-file-access", "none"}, nil},
+		{"bad network policy", []string{"--network-policy", "closed"}, nil},
+		{"bad sandbox namespaces", []string{"--sandbox-namespaces", "yes"}, nil},
+		{"option name with dashes", []string{"--option-deny", "--run-script"}, nil},
+		{"negative render limit", []string{"--render-max-memory", "-1"}, nil},
+		{"unknown auth method", []string{"--auth", "basic"}, nil},
+		{"auth without keys file", nil, map[string]string{"KWKHTMLTOPDF_AUTH": "api-key,jwt"}},
+		{"missing JWKS file", []string{"--auth", "jwt", "--auth-jwks-file", "/does/not/exist"}, nil},
+	}
+	for _, tt := range tests {
+		if _, _, err := loadConfig(tt.args, envMap(tt.env)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestConfig_print(t *testing.T) {
+	cfg, printConfig, err := loadConfig([]string{"--print-config", "--listen-addr", ":9090", "--url-allow-hosts", "example.com, *.Example.org", "--url-allow-private"}, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Fatal("print-config not set")
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `listen-addr: :9090`) {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	// The output is a valid config file.
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _, err := loadConfig([]string{"--config", file}, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded, cfg) {
+		t.Fatalf("round trip mismatch:\n%+v\n%+v", reloaded, cfg)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space check not supported on this platform")
+}
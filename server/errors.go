@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stable error codes returned to clients. Callers should match on these
+// rather than on the message text.
+const (
+	codeMethodNotAllowed       = "method_not_allowed"
+	codeUnauthorized           = "unauthorized"
+	codeInvalidMultipart       = "invalid_multipart"
+	codeInvalidJSON            = "invalid_json"
+	codeBodyTooLarge           = "body_too_large"
+	codeMissingIndexHTML       = "missing_index_html"
+	codeInvalidBundle          = "invalid_bundle"
+	codeBundleTooLarge         = "bundle_too_large"
+	codeInvalidURL             = "invalid_url"
+	codeURLForbidden           = "url_forbidden"
+	codeURLFetchFailed         = "url_fetch_failed"
+	codeInvalidOption          = "invalid_option"
+	codeTemplateError          = "template_error"
+	codeInvalidTemplate        = "invalid_template"
+	codeTemplateNotFound       = "template_not_found"
+	codeTempDirFailed          = "tempdir_failed"
+	codeProcessStartFailed     = "process_start_failed"
+	codeProcessFailed          = "process_failed"
+	codeTimeout                = "timeout"
+	codeRenderTimeout          = "render_timeout"
+	codeInvalidRenderTimeout   = "invalid_render_timeout"
+	codeQueueFull              = "queue_full"
+	codeQueueTimeout           = "queue_timeout"
+	codeReadOutputFailed       = "read_output_failed"
+	codeEmptyOutput            = "empty_output"
+	codeCPULimitExceeded       = "cpu_limit_exceeded"
+	codeMemoryLimitExceeded    = "memory_limit_exceeded"
+	codeFileSizeLimitExceeded  = "file_size_limit_exceeded"
+	codeOpenFilesLimitExceeded = "open_files_limit_exceeded"
+	codeInvalidCallbackURL     = "invalid_callback_url"
+	codeJobNotFound            = "job_not_found"
+	codeJobNotFinished         = "job_not_finished"
+	codeJobFailed              = "job_failed"
+	codeJobInterrupted         = "job_interrupted"
+	codeInvalidBatch           = "invalid_batch"
+	codeBatchTooLarge          = "batch_too_large"
+	codeInternal               = "internal_error"
+)
+
+// apiError carries the HTTP status and error code of a failed request.
+type apiError struct {
+	Status int
+	Code   string
+	Err    error
+	// Stderr is the tail of the wkhtmltopdf/wkhtmltoimage stderr, if any.
+	Stderr string
+	// FailedResources lists the resources the page failed to load, if any.
+	FailedResources []string
+	// RetryAfter, when set, is sent as the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func newAPIError(status int, code string, err error) *apiError {
+	return &apiError{Status: status, Code: code, Err: err}
+}
+
+func (e *apiError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// errorResponse is the JSON envelope written for clients that accept JSON.
+type errorResponse struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	TraceID string        `json:"trace_id,omitempty"`
+	Stderr  string        `json:"stderr,omitempty"`
+	Fields  []optionError `json:"fields,omitempty"`
+}
+
+func asAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return newAPIError(http.StatusInternalServerError, codeInternal, err)
+}
+
+// acceptsJSON reports whether the Accept header lists application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeErrorResponse(ctx context.Context, w http.ResponseWriter, apiErr *apiError) {
+	w.Header().Set("X-Error-Code", apiErr.Code)
+	setFailedResourcesHeader(w, apiErr.FailedResources)
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+	}
+
+	if !wantsJSONFromContext(ctx) {
+		http.Error(w, apiErr.Error(), apiErr.Status)
+		return
+	}
+
+	resp := errorResponse{
+		Code:    apiErr.Code,
+		Message: apiErr.Error(),
+		TraceID: traceIDFromContext(ctx),
+		Stderr:  apiErr.Stderr,
+	}
+	var optErr *optionValidationError
+	if errors.As(apiErr, &optErr) {
+		resp.Fields = optErr.Errors
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPDFHandler_errorEnvelope(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/pdf", strings.NewReader("--x--\r\n"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+	req.Header.Set("X-Trace-ID", "trace-123")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d want 400 body %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type %q want application/json", ct)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, rec.Body.String())
+	}
+	if body.Code != codeMissingIndexHTML || body.TraceID != "trace-123" || body.Message == "" {
+		t.Fatalf("unexpected envelope: %+v", body)
+	}
+}
+
+func TestPDFHandler_errorPlainText(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/pdf", strings.NewReader("--x--\r\n"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d want 400", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Content-Type %q want text/plain", ct)
+	}
+	if got := rec.Header().Get("X-Error-Code"); got != codeMissingIndexHTML {
+		t.Fatalf("X-Error-Code %q want %q", got, codeMissingIndexHTML)
+	}
+	if !strings.Contains(rec.Body.String(), "index.html file is required") {
+		t.Fatalf("body: %s", rec.Body.String())
+	}
+}
+
+func TestPDFHandler_methodNotAllowedJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/pdf", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status %d want 405", rec.Code)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != codeMethodNotAllowed {
+		t.Fatalf("unexpected body %s (%v)", rec.Body.String(), err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// binaryCheckInterval is how long a `--version` check result is reused,
+	// so that frequent probes do not fork a process each time.
+	binaryCheckInterval = 30 * time.Second
+	binaryCheckTimeout  = 5 * time.Second
+)
+
+// checkResult is the outcome of one readiness check.
+type checkResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// cachedCheck reuses the result of an expensive check for ttl.
+type cachedCheck struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	at       time.Time
+	result   checkResult
+	rendered bool // a canary render has an outcome
+}
+
+func (c *cachedCheck) get(run func() checkResult) checkResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.at.IsZero() || time.Since(c.at) > c.ttl {
+		c.result = run()
+		c.at = time.Now()
+	}
+	return c.result
+}
+
+var (
+	wkhtmltopdfCheck   = &cachedCheck{ttl: binaryCheckInterval}
+	wkhtmltoimageCheck = &cachedCheck{ttl: binaryCheckInterval}
+)
+
+// binaryVersion runs `bin --version` and returns its output.
+func binaryVersion(ctx context.Context, bin string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, binaryCheckTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, bin, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", bin, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func binaryCheck(bin string) func() checkResult {
+	return func() checkResult {
+		version, err := binaryVersion(context.Background(), bin)
+		if err != nil {
+			return checkResult{Message: err.Error()}
+		}
+		return checkResult{OK: true, Message: version}
+	}
+}
+
+func tempDirCheck() checkResult {
+	dir := config.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return checkResult{Message: err.Error()}
+	}
+	msg := fmt.Sprintf("%d bytes free in %s", free, dir)
+	return checkResult{OK: free >= uint64(config.MinFreeSpace), Message: msg}
+}
+
+func queueCheck() checkResult {
+	threshold := config.ReadyQueueThreshold
+	if threshold <= 0 {
+		threshold = config.MaxQueue
+	}
+	depth := renderSlots.QueueDepth()
+	msg := fmt.Sprintf("%d requests waiting, threshold %d", depth, threshold)
+	return checkResult{OK: threshold == 0 || depth < threshold, Message: msg}
+}
+
+// canary periodically renders a small document to check that wkhtmltopdf
+// actually works, not only that it starts.
+type canary struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	at     time.Time
+	result checkResult
+	// rendered is set once a canary render has an outcome.
+	rendered bool
+}
+
+var pdfCanary *canary
+
+const canaryHTML = "<!DOCTYPE html><html><body><p>kwkhtmltopdf canary</p></body></html>"
+
+func startCanary(interval time.Duration) *canary {
+	c := &canary{interval: interval, result: checkResult{Message: "pending"}}
+	go func() {
+		for {
+			c.run()
+			time.Sleep(interval)
+		}
+	}()
+	return c
+}
+
+// run renders the canary in a free render slot. When every slot is busy the
+// canary does not compete with client renders: it keeps its last outcome and
+// reports "busy". Busy before any outcome counts as ready, so that a pod
+// loaded from the start is not taken out of service.
+func (c *canary) run() {
+	release, ok := renderSlots.TryAcquire()
+	if !ok {
+		c.mu.Lock()
+		c.at = time.Now()
+		c.result = checkResult{OK: !c.rendered || c.result.OK, Message: "busy"}
+		c.mu.Unlock()
+		return
+	}
+	defer release()
+
+	result := checkResult{OK: true, Message: "rendered"}
+	if err := renderCanary(); err != nil {
+		loggerFromContext(context.Background()).Errorf("Canary render failed: %v", err)
+		result = checkResult{Message: err.Error()}
+	}
+
+	c.mu.Lock()
+	c.at = time.Now()
+	c.result = result
+	c.rendered = true
+	c.mu.Unlock()
+}
+
+func renderCanary() error {
+	tmpdir, cleanup, err := activeRenders.tempDir("kwkcanary")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	indexPath := filepath.Join(tmpdir, "index.html")
+	if err := os.WriteFile(indexPath, []byte(canaryHTML), 0o600); err != nil {
+		return err
+	}
+
+	ctx, cancel := withRenderTimeout(context.Background(), config.RenderTimeout)
+	defer cancel()
+	_, err = runWkhtmltopdf(ctx, []string{indexPath}, tmpdir, renderNetwork)
+	return err
+}
+
+func (c *canary) check() checkResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.at.IsZero() && time.Since(c.at) > 3*c.interval {
+		return checkResult{Message: fmt.Sprintf("last canary render at %s is stale", c.at.Format(time.RFC3339))}
+	}
+	return c.result
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(r.Context(), w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(r.Context(), w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+
+	checks := map[string]checkResult{
+		"shutdown":      {OK: !shuttingDown.Load()},
+		"wkhtmltopdf":   wkhtmltopdfCheck.get(binaryCheck(wkhtmltopdfBin())),
+		"wkhtmltoimage": wkhtmltoimageCheck.get(binaryCheck(wkhtmltoimageBin())),
+		"temp_dir":      tempDirCheck(),
+		"queue":         queueCheck(),
+	}
+	if pdfCanary != nil {
+		checks["canary"] = pdfCanary.check()
+	}
+
+	resp := readinessResponse{Status: "ready", Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
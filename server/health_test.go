@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeVersionScript installs a fake binary answering --version.
+func writeVersionScript(t *testing.T, name, version string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	script := "#!/bin/sh\necho '" + version + "'\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func resetReadinessChecks(t *testing.T) {
+	t.Helper()
+	wkhtmltopdfCheck = &cachedCheck{ttl: binaryCheckInterval}
+	wkhtmltoimageCheck = &cachedCheck{ttl: binaryCheckInterval}
+	t.Cleanup(func() {
+		wkhtmltopdfCheck = &cachedCheck{ttl: binaryCheckInterval}
+		wkhtmltoimageCheck = &cachedCheck{ttl: binaryCheckInterval}
+	})
+}
+
+func getReadyz(t *testing.T) (int, readinessResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body readinessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, rec.Body.String())
+	}
+	return rec.Code, body
+}
+
+func TestReadyz_ready(t *testing.T) {
+	resetReadinessChecks(t)
+	setTestConfig(t, func(c *Config) {
+		c.WkhtmltopdfBin = writeVersionScript(t, "wkhtmltopdf", "wkhtmltopdf 0.12.6.1 (with patched qt)")
+		c.WkhtmltoimageBin = writeVersionScript(t, "wkhtmltoimage", "wkhtmltoimage 0.12.6.1 (with patched qt)")
+		c.MinFreeSpace = 0
+	})
+
+	code, body := getReadyz(t)
+	if code != http.StatusOK || body.Status != "ready" {
+		t.Fatalf("status %d %+v", code, body)
+	}
+	if got := body.Checks["wkhtmltopdf"].Message; got != "wkhtmltopdf 0.12.6.1 (with patched qt)" {
+		t.Fatalf("wkhtmltopdf version %q", got)
+	}
+}
+
+func TestReadyz_notReady(t *testing.T) {
+	resetReadinessChecks(t)
+	setTestConfig(t, func(c *Config) {
+		c.WkhtmltopdfBin = filepath.Join(t.TempDir(), "missing")
+		c.WkhtmltoimageBin = writeVersionScript(t, "wkhtmltoimage", "wkhtmltoimage 0.12.6.1")
+		c.MinFreeSpace = 1 << 62
+	})
+
+	code, body := getReadyz(t)
+	if code != http.StatusServiceUnavailable || body.Status != "not_ready" {
+		t.Fatalf("status %d %+v", code, body)
+	}
+	for _, name := range []string{"wkhtmltopdf", "temp_dir"} {
+		if body.Checks[name].OK {
+			t.Errorf("check %s passed: %+v", name, body.Checks[name])
+		}
+	}
+	if !body.Checks["wkhtmltoimage"].OK || !body.Checks["queue"].OK {
+		t.Errorf("unexpected failures: %+v", body.Checks)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { c.TempDir = t.TempDir() })
+
+	c := &canary{interval: time.Minute, result: checkResult{Message: "pending"}}
+	if c.check().OK {
+		t.Fatal("canary ready before its first render")
+	}
+	c.run()
+	if result := c.check(); !result.OK {
+		t.Fatalf("canary failed: %+v", result)
+	}
+
+	c.at = time.Now().Add(-time.Hour)
+	if c.check().OK {
+		t.Fatal("stale canary reported as ok")
+	}
+
+	// With every render slot busy the canary keeps its last outcome.
+	saved := renderSlots
+	renderSlots = newRenderLimiter(1, 0, time.Second)
+	defer func() { renderSlots = saved }()
+	release, err := renderSlots.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	c.run()
+	if result := c.check(); !result.OK || result.Message != "busy" {
+		t.Fatalf("busy canary: %+v", result)
+	}
+
+	// Busy before the first render counts as ready, busy after a failed
+	// one does not.
+	c = &canary{interval: time.Minute, result: checkResult{Message: "pending"}}
+	c.run()
+	if result := c.check(); !result.OK || result.Message != "busy" {
+		t.Fatalf("busy canary before its first render: %+v", result)
+	}
+	c = &canary{interval: time.Minute, result: checkResult{Message: "boom"}, rendered: true}
+	c.run()
+	if result := c.check(); result.OK {
+		t.Fatalf("busy canary after a failure: %+v", result)
+	}
+}
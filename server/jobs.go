@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+const (
+	// webhookAttempts bounds the deliveries of one completion callback.
+	webhookAttempts = 3
+	// webhookRetryDelay is multiplied by the attempt number between retries.
+	webhookRetryDelay = 2 * time.Second
+	// jobExpiryInterval is how often expired jobs are deleted.
+	jobExpiryInterval = time.Minute
+)
+
+var (
+	// renderJobs stores the jobs; main replaces it according to job-store.
+	renderJobs jobStore = newMemoryJobStore()
+	// webhookSecret signs completion callbacks when set.
+	webhookSecret []byte
+	// jobWorkers tracks the background renders and callbacks, so that
+	// shutdown can wait for them.
+	jobWorkers sync.WaitGroup
+)
+
+// job is an asynchronous render submitted to /jobs/pdf or /jobs/image.
+type job struct {
+	ID              string         `json:"id"`
+	Kind            string         `json:"kind"`
+	Status          string         `json:"status"`
+	TraceID         string         `json:"trace_id,omitempty"`
+	ClientID        string         `json:"client_id,omitempty"` // the authenticated client that submitted the job
+	CreatedAt       time.Time      `json:"created_at"`
+	StartedAt       *time.Time     `json:"started_at,omitempty"`
+	FinishedAt      *time.Time     `json:"finished_at,omitempty"`
+	ExpiresAt       *time.Time     `json:"expires_at,omitempty"`
+	ContentType     string         `json:"content_type,omitempty"`
+	Size            int64          `json:"size,omitempty"`
+	FailedResources []string       `json:"failed_resources,omitempty"`
+	Error           *errorResponse `json:"error,omitempty"`
+	CallbackURL     string         `json:"callback_url,omitempty"`
+}
+
+func (j *job) finished() bool {
+	return j.Status == jobSucceeded || j.Status == jobFailed
+}
+
+func (j *job) finish(status string) {
+	now := time.Now()
+	expires := now.Add(config.JobTTL)
+	j.Status = status
+	j.FinishedAt = &now
+	j.ExpiresAt = &expires
+}
+
+func (j *job) succeed(result *renderResult) {
+	j.ContentType = result.ContentType
+	j.Size = result.Size
+	j.FailedResources = result.FailedResources
+	j.finish(jobSucceeded)
+}
+
+func (j *job) fail(err error) {
+	apiErr := asAPIError(err)
+	j.Error = &errorResponse{
+		Code:    apiErr.Code,
+		Message: apiErr.Error(),
+		Stderr:  apiErr.Stderr,
+	}
+	j.FailedResources = apiErr.FailedResources
+	j.finish(jobFailed)
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// loadWebhookSecret reads the webhook-secret-file setting, if any.
+func loadWebhookSecret(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// startJobExpiry deletes expired jobs every jobExpiryInterval.
+func startJobExpiry(store jobStore, logger *Logger) {
+	go func() {
+		ticker := time.NewTicker(jobExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireJobs(store, time.Now(), logger)
+		}
+	}()
+}
+
+// waitJobs waits for the background renders and callbacks until ctx is done.
+func waitJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jobWorkers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseCallbackURL validates the X-Callback-URL header. Its host must pass
+// the URL mode checks, see urlGuard.checkCallbackURL.
+func parseCallbackURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidCallbackURL, fmt.Errorf("invalid X-Callback-URL %q: must be an absolute http or https URL", raw))
+	}
+	if err := remoteURLs.checkCallbackURL(u.String()); err != nil {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidCallbackURL, fmt.Errorf("invalid X-Callback-URL: %w", err))
+	}
+	return u.String(), nil
+}
+
+// jobSubmitHandler returns the handler of POST /jobs/{kind}. The request is
+// parsed like the synchronous endpoint, then rendered in the background.
+func jobSubmitHandler(kind string, prepare func(ctx context.Context, r *http.Request, tmpdir string) (*preparedRender, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := loggerFromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+			return
+		}
+
+		callbackURL, err := parseCallbackURL(r.Header.Get("X-Callback-URL"))
+		if err != nil {
+			httpError(ctx, w, err)
+			return
+		}
+
+		tmpdir, cleanup, err := activeRenders.tempDir("kwkjob")
+		if err != nil {
+			httpError(ctx, w, newAPIError(http.StatusInternalServerError, codeTempDirFailed, err))
+			return
+		}
+
+		prepared, err := prepare(ctx, r, tmpdir)
+		if err != nil {
+			cleanup()
+			httpError(ctx, w, err)
+			return
+		}
+		// The job is accepted: it waits for a render slot however long the
+		// queue.
+		prepared.accepted = true
+
+		id, err := newJobID()
+		if err != nil {
+			cleanup()
+			httpError(ctx, w, err)
+			return
+		}
+		j := &job{
+			ID:          id,
+			Kind:        kind,
+			Status:      jobQueued,
+			TraceID:     traceIDFromContext(ctx),
+			ClientID:    clientIDFromContext(ctx),
+			CreatedAt:   time.Now(),
+			CallbackURL: callbackURL,
+		}
+		if err := renderJobs.Put(j); err != nil {
+			cleanup()
+			httpError(ctx, w, err)
+			return
+		}
+		logger.Infof("Job %s queued", id)
+		jobsSubmitted.WithLabelValues(kind).Inc()
+
+		// The job outlives the request: keep the request values, such as
+		// the logger, but not its cancellation.
+		jobCtx := context.WithValue(context.WithoutCancel(ctx), LoggerContextKey, &Logger{Entry: logger.WithField("job-id", id)})
+		queued := *j
+		jobWorkers.Add(1)
+		go func() {
+			defer jobWorkers.Done()
+			runJob(jobCtx, renderJobs, j, prepared, cleanup)
+		}()
+
+		w.Header().Set("Location", "/jobs/"+id)
+		writeJob(w, http.StatusAccepted, &queued)
+	}
+}
+
+// runJob renders the job once a render slot is free, however long the wait,
+// unless the render cache has its result, stores the outcome and sends the
+// completion callback.
+func runJob(ctx context.Context, store jobStore, j *job, prepared *preparedRender, cleanup func()) {
+	logger := loggerFromContext(ctx)
+
+	err := func() error {
+		defer cleanup()
+
+		start := func() error {
+			now := time.Now()
+			j.Status = jobRunning
+			j.StartedAt = &now
+			return store.Put(j)
+		}
+		result, err := prepared.execute(ctx, start)
+		if err != nil {
+			return err
+		}
+		if err := store.PutResult(j.ID, result.Path); err != nil {
+			return err
+		}
+		j.succeed(result)
+		return nil
+	}()
+	if err != nil {
+		logger.Errorf("Job %s failed: %v", j.ID, err)
+		j.fail(err)
+	} else {
+		logger.Infof("Job %s succeeded", j.ID)
+	}
+	jobsCompleted.WithLabelValues(j.Kind, j.Status).Inc()
+
+	if err := store.Put(j); err != nil {
+		logger.Errorf("Failed to save job %s: %v", j.ID, err)
+	}
+
+	if j.CallbackURL != "" {
+		sendWebhook(ctx, j)
+	}
+}
+
+// sendWebhook POSTs the finished job to its callback URL, retrying on
+// failure. With a webhook secret, the body is signed with HMAC-SHA256 over
+// "<X-Webhook-Timestamp>.<body>".
+func sendWebhook(ctx context.Context, j *job) {
+	logger := loggerFromContext(ctx)
+
+	body, err := json.Marshal(j)
+	if err != nil {
+		logger.Errorf("Failed to encode job %s: %v", j.ID, err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * webhookRetryDelay)
+		}
+		err := postWebhook(ctx, j, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues("success").Inc()
+			logger.Infof("Job %s callback delivered", j.ID)
+			return
+		}
+		logger.Warnf("Job %s callback attempt %d failed: %v", j.ID, attempt, err)
+	}
+	webhookDeliveries.WithLabelValues("failure").Inc()
+	logger.Errorf("Giving up on job %s callback after %d attempts", j.ID, webhookAttempts)
+}
+
+func postWebhook(ctx context.Context, j *job, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, config.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-ID", j.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if j.TraceID != "" {
+		req.Header.Set("X-Trace-ID", j.TraceID)
+	}
+	if len(webhookSecret) > 0 {
+		req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(webhookSecret, timestamp, body))
+	}
+
+	resp, err := remoteURLs.webhooks.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func writeJob(w http.ResponseWriter, status int, j *job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(j)
+}
+
+// getJob loads the job named in the request path. The jobs of other
+// clients are reported as not found.
+func getJob(r *http.Request) (*job, error) {
+	j, err := renderJobs.Get(r.PathValue("id"))
+	if err == nil && j.ClientID != clientIDFromContext(r.Context()) {
+		err = errJobNotFound
+	}
+	if errors.Is(err, errJobNotFound) {
+		return nil, newAPIError(http.StatusNotFound, codeJobNotFound, errJobNotFound)
+	}
+	return j, err
+}
+
+// jobStatusHandler serves GET /jobs/{id}.
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet {
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+
+	j, err := getJob(r)
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+	writeJob(w, http.StatusOK, j)
+}
+
+// jobResultHandler serves GET /jobs/{id}/result, the output of a succeeded
+// job.
+func jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet {
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+
+	j, err := getJob(r)
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+	switch j.Status {
+	case jobSucceeded:
+	case jobFailed:
+		httpError(ctx, w, newAPIError(http.StatusConflict, codeJobFailed, fmt.Errorf("job failed: %s: %s", j.Error.Code, j.Error.Message)))
+		return
+	default:
+		w.Header().Set("Retry-After", "1")
+		httpError(ctx, w, newAPIError(http.StatusConflict, codeJobNotFinished, fmt.Errorf("job is %s", j.Status)))
+		return
+	}
+
+	f, err := renderJobs.OpenResult(j.ID)
+	if errors.Is(err, errJobNotFound) {
+		httpError(ctx, w, newAPIError(http.StatusNotFound, codeJobNotFound, err))
+		return
+	}
+	if err != nil {
+		httpError(ctx, w, newAPIError(http.StatusInternalServerError, codeReadOutputFailed, err))
+		return
+	}
+	defer f.Close()
+
+	setFailedResourcesHeader(w, j.FailedResources)
+	w.Header().Set("Content-Type", j.ContentType)
+	http.ServeContent(w, r, "", *j.FinishedAt, f)
+}
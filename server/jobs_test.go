@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// submitJob posts req to the jobs endpoint at path and waits for the job to
+// finish.
+func submitJob(t *testing.T, router http.Handler, path string, req *http.Request) job {
+	t.Helper()
+	req.URL.Path = path
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+	var queued job
+	if err := json.NewDecoder(rec.Body).Decode(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued.Status != jobQueued || rec.Header().Get("Location") != "/jobs/"+queued.ID {
+		t.Fatalf("job %+v Location %q", queued, rec.Header().Get("Location"))
+	}
+	jobWorkers.Wait()
+	return queued
+}
+
+func useMemoryJobStore(t *testing.T) {
+	t.Helper()
+	saved := renderJobs
+	renderJobs = newMemoryJobStore()
+	t.Cleanup(func() { renderJobs = saved })
+}
+
+func TestJobs_pdf(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	useMemoryJobStore(t)
+	router := newRouter()
+
+	queued := submitJob(t, router, "/jobs/pdf", newPDFRequest(t, nil))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+queued.ID, nil))
+	var status job
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != jobSucceeded || status.Size != int64(len(fakePDF)) || status.ExpiresAt == nil {
+		t.Fatalf("job %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+queued.ID+"/result", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("result status %d body %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+}
+
+func TestJobs_failed(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "failing-wkhtmltopdf.sh")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\necho 'Error: boom' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", bin)
+	useMemoryJobStore(t)
+	router := newRouter()
+
+	queued := submitJob(t, router, "/jobs/pdf", newPDFRequest(t, nil))
+
+	j, err := renderJobs.Get(queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobFailed || j.Error == nil || j.Error.Code != codeProcessFailed || j.Error.Stderr != "Error: boom" {
+		t.Fatalf("job %+v error %+v", j, j.Error)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+queued.ID+"/result", nil))
+	if rec.Code != http.StatusConflict || rec.Header().Get("X-Error-Code") != codeJobFailed {
+		t.Fatalf("result status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestJobs_notFound(t *testing.T) {
+	useMemoryJobStore(t)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/0123456789abcdef0123456789abcdef", nil))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-Error-Code") != codeJobNotFound {
+		t.Fatalf("status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestJobs_waitForSlot(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	useMemoryJobStore(t)
+	saved := renderSlots
+	renderSlots = newRenderLimiter(1, 0, 10*time.Millisecond)
+	defer func() { renderSlots = saved }()
+	release, err := renderSlots.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	router := newRouter()
+
+	req := newPDFRequest(t, nil)
+	req.URL.Path = "/jobs/pdf"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var queued job
+	if err := json.NewDecoder(rec.Body).Decode(&queued); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+
+	// Synchronous requests are still bounded, the accepted job waits on.
+	if rec := serve(newPDFRequest(t, nil)); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("/pdf: status %d", rec.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if j, _ := renderJobs.Get(queued.ID); j.Status != jobQueued {
+		t.Fatalf("job %+v", j)
+	}
+
+	release()
+	jobWorkers.Wait()
+	if j, _ := renderJobs.Get(queued.ID); j.Status != jobSucceeded {
+		t.Fatalf("job %+v error %+v", j, j.Error)
+	}
+}
+
+func TestJobs_owner(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	useMemoryJobStore(t)
+	useAuth(t, func(c *Config) {
+		c.Auth = []string{authAPIKey}
+		c.AuthAPIKeysFile = writeAuthFile(t, "keys", "acme k-acme\nglobex k-globex\n")
+	})
+	router := newRouter()
+
+	req := newPDFRequest(t, nil)
+	req.Header.Set("X-API-Key", "k-acme")
+	queued := submitJob(t, router, "/jobs/pdf", req)
+	if queued.ClientID != "acme" {
+		t.Fatalf("job %+v", queued)
+	}
+
+	// Only the client that submitted the job can see it.
+	for _, path := range []string{"/jobs/" + queued.ID, "/jobs/" + queued.ID + "/result"} {
+		for key, status := range map[string]int{"k-acme": http.StatusOK, "k-globex": http.StatusNotFound} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("X-API-Key", key)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != status {
+				t.Fatalf("%s with %s: status %d, want %d", path, key, rec.Code, status)
+			}
+			if status == http.StatusNotFound && rec.Header().Get("X-Error-Code") != codeJobNotFound {
+				t.Fatalf("%s with %s: code %q", path, key, rec.Header().Get("X-Error-Code"))
+			}
+		}
+	}
+}
+
+func TestJobs_webhook(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	useMemoryJobStore(t)
+	webhookSecret = []byte("s3cret")
+	saved := remoteURLs
+	remoteURLs = testURLGuard(t, func(c *Config) { c.URLAllowPrivate = true })
+	t.Cleanup(func() { webhookSecret, remoteURLs = nil, saved })
+
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header, body}
+	}))
+	defer callback.Close()
+
+	req := newPDFRequest(t, nil)
+	req.Header.Set("X-Callback-URL", callback.URL+"/done")
+	queued := submitJob(t, newRouter(), "/jobs/pdf", req)
+
+	var d delivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback")
+	}
+	want := "sha256=" + signWebhook(webhookSecret, d.header.Get("X-Webhook-Timestamp"), d.body)
+	if got := d.header.Get("X-Webhook-Signature"); got != want {
+		t.Fatalf("signature %q want %q", got, want)
+	}
+	var j job
+	if err := json.Unmarshal(d.body, &j); err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != queued.ID || j.Status != jobSucceeded {
+		t.Fatalf("callback job %+v", j)
+	}
+}
+
+func TestJobs_invalidCallbackURL(t *testing.T) {
+	saved := remoteURLs
+	remoteURLs = testURLGuard(t, func(c *Config) { c.URLDenyHosts = []string{"*.internal.example.com"} })
+	t.Cleanup(func() { remoteURLs = saved })
+
+	for _, callbackURL := range []string{
+		"file:///etc/passwd",
+		"http://169.254.169.254/latest/meta-data",
+		"http://127.0.0.1:8080/done",
+		"http://[::1]/done",
+		"https://billing.internal.example.com/done",
+	} {
+		req := newPDFRequest(t, nil)
+		req.URL.Path = "/jobs/pdf"
+		req.Header.Set("X-Callback-URL", callbackURL)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidCallbackURL {
+			t.Errorf("%s: status %d code %q", callbackURL, rec.Code, rec.Header().Get("X-Error-Code"))
+		}
+	}
+}
+
+func TestWebhookClient_private(t *testing.T) {
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected callback to %s", r.URL)
+	}))
+	defer callback.Close()
+
+	// A name that resolves to a private address is refused when dialing.
+	guard := testURLGuard(t, func(c *Config) {})
+	resp, err := guard.webhooks.Post(strings.Replace(callback.URL, "127.0.0.1", "localhost", 1), "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("callback to localhost was sent")
+	}
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("err %v", err)
+	}
+}
+
+func TestDiskJobStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := &job{ID: "0123456789abcdef0123456789abcdef", Kind: "pdf", Status: jobQueued}
+	running := &job{ID: "fedcba9876543210fedcba9876543210", Kind: "pdf", Status: jobRunning}
+	for _, j := range []*job{done, running} {
+		if err := store.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := filepath.Join(t.TempDir(), "output.pdf")
+	if err := os.WriteFile(output, []byte(fakePDF), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutResult(done.ID, output); err != nil {
+		t.Fatal(err)
+	}
+	done.succeed(&renderResult{ContentType: "application/pdf", Size: int64(len(fakePDF))})
+	if err := store.Put(done); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening marks the job interrupted by the restart as failed.
+	store, err = newDiskJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := store.Get(running.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobFailed || j.Error.Code != codeJobInterrupted {
+		t.Fatalf("job %+v", j)
+	}
+
+	f, err := store.OpenResult(done.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != fakePDF {
+		t.Fatalf("result %q", data)
+	}
+
+	if _, err := store.Get("../../etc/passwd"); err != errJobNotFound {
+		t.Fatalf("Get with a path: %v", err)
+	}
+
+	expireJobs(store, time.Now().Add(2*config.JobTTL), newLogger())
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("%d jobs left after expiry", len(jobs))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("files left after expiry: %v", entries)
+	}
+}
+
+func TestMemoryJobStore_spoolsResults(t *testing.T) {
+	tmp := t.TempDir()
+	setTestConfig(t, func(c *Config) { c.TempDir = tmp })
+	store := newMemoryJobStore()
+
+	id := "0123456789abcdef0123456789abcdef"
+	output := filepath.Join(t.TempDir(), "output.pdf")
+	if err := os.WriteFile(output, []byte(fakePDF), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutResult(id, output); err != nil {
+		t.Fatal(err)
+	}
+	spooled, _ := filepath.Glob(filepath.Join(tmp, "kwkjobs*", id+".result"))
+	if len(spooled) != 1 {
+		t.Fatalf("spooled results %v", spooled)
+	}
+
+	f, err := store.OpenResult(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != fakePDF {
+		t.Fatalf("result %q", data)
+	}
+
+	if err := store.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(spooled[0]); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("result left after delete: %v", err)
+	}
+	if _, err := store.OpenResult(id); err != errJobNotFound {
+		t.Fatalf("OpenResult after delete: %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobStoreMemory = "memory"
+	jobStoreDisk   = "disk"
+)
+
+var errJobNotFound = errors.New("job not found")
+
+// jobStore persists jobs and their results. Implementations must be safe for
+// concurrent use.
+type jobStore interface {
+	// Put creates or replaces the job.
+	Put(j *job) error
+	// Get returns a copy of the job, or errJobNotFound.
+	Get(id string) (*job, error)
+	// PutResult stores the render output found at path as the job result.
+	// The file at path may be moved.
+	PutResult(id, path string) error
+	// OpenResult opens the job result.
+	OpenResult(id string) (io.ReadSeekCloser, error)
+	// Delete removes the job and its result.
+	Delete(id string) error
+	// List returns a copy of every job.
+	List() ([]*job, error)
+}
+
+// newJobStore opens the store selected by the job-store setting.
+func newJobStore(cfg *Config) (jobStore, error) {
+	switch cfg.JobStore {
+	case jobStoreMemory:
+		return newMemoryJobStore(), nil
+	case jobStoreDisk:
+		return newDiskJobStore(cfg.JobStoreDir)
+	}
+	return nil, fmt.Errorf("unknown job store %q", cfg.JobStore)
+}
+
+// memoryJobStore keeps jobs in memory; they are lost on restart. Results
+// are spooled to a directory under the temp-dir setting, created on first
+// use and removed on shutdown, so that they do not hold on to memory.
+type memoryJobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]job
+	dir     string
+	results map[string]string // job ID -> result path
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		jobs:    map[string]job{},
+		results: map[string]string{},
+	}
+}
+
+func (s *memoryJobStore) Put(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = *j
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return &j, nil
+}
+
+func (s *memoryJobStore) PutResult(id, path string) error {
+	if !jobIDPattern.MatchString(id) {
+		return errJobNotFound
+	}
+	dir, err := s.resultDir()
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, id+".result")
+	if err := moveFile(path, dst); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = dst
+	return nil
+}
+
+// resultDir returns the spool directory, creating it on first use.
+func (s *memoryJobStore) resultDir() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		dir, _, err := activeRenders.tempDir("kwkjobs")
+		if err != nil {
+			return "", err
+		}
+		s.dir = dir
+	}
+	return s.dir, nil
+}
+
+func (s *memoryJobStore) OpenResult(id string) (io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	path, ok := s.results[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errJobNotFound
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errJobNotFound
+	}
+	return f, err
+}
+
+func (s *memoryJobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	if path, ok := s.results[id]; ok {
+		delete(s.results, id)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryJobStore) List() ([]*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, &j)
+	}
+	return jobs, nil
+}
+
+// jobIDPattern matches the IDs generated by newJobID. The disk store checks
+// it so that an ID cannot name a path outside its directory.
+var jobIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// diskJobStore keeps each job as <id>.json next to its result <id>.result,
+// so that finished jobs survive a restart.
+type diskJobStore struct {
+	dir string
+	mu  sync.Mutex // serialises metadata writes
+}
+
+// newDiskJobStore opens the store in dir, creating it if needed. Jobs that
+// were still queued or running when the server stopped are marked failed.
+func newDiskJobStore(dir string) (*diskJobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &diskJobStore{dir: dir}
+
+	jobs, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		if j.finished() {
+			continue
+		}
+		j.fail(newAPIError(http.StatusServiceUnavailable, codeJobInterrupted, errors.New("job interrupted by a server restart")))
+		if err := s.Put(j); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *diskJobStore) path(id, ext string) (string, error) {
+	if !jobIDPattern.MatchString(id) {
+		return "", errJobNotFound
+	}
+	return filepath.Join(s.dir, id+ext), nil
+}
+
+func (s *diskJobStore) Put(j *job) error {
+	path, err := s.path(j.ID, ".json")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(path, data)
+}
+
+func (s *diskJobStore) Get(id string) (*job, error) {
+	path, err := s.path(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("job %s: %w", id, err)
+	}
+	return &j, nil
+}
+
+func (s *diskJobStore) PutResult(id, path string) error {
+	dst, err := s.path(id, ".result")
+	if err != nil {
+		return err
+	}
+	// The render tmpdir may be on another filesystem.
+	return moveFile(path, dst)
+}
+
+func (s *diskJobStore) OpenResult(id string) (io.ReadSeekCloser, error) {
+	path, err := s.path(id, ".result")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errJobNotFound
+	}
+	return f, err
+}
+
+func (s *diskJobStore) Delete(id string) error {
+	var errs []error
+	for _, ext := range []string{".result", ".json"} {
+		path, err := s.path(id, ext)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *diskJobStore) List() ([]*job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*job
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !jobIDPattern.MatchString(id) {
+			continue
+		}
+		j, err := s.Get(id)
+		if errors.Is(err, errJobNotFound) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// expireJobs deletes the jobs whose results are past their TTL.
+func expireJobs(store jobStore, now time.Time, logger *Logger) {
+	jobs, err := store.List()
+	if err != nil {
+		logger.Errorf("Failed to list jobs: %v", err)
+		return
+	}
+	for _, j := range jobs {
+		if j.ExpiresAt == nil || now.Before(*j.ExpiresAt) {
+			continue
+		}
+		if err := store.Delete(j.ID); err != nil {
+			logger.Errorf("Failed to delete expired job %s: %v", j.ID, err)
+		}
+	}
+}
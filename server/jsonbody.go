@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+)
+
+// pairOptions take two values, e.g. --custom-header <name> <value>. In a JSON
+// body they are given as an object or as an array of two-element arrays.
+var pairOptions = map[string]bool{
+	"cookie":        true,
+	"custom-header": true,
+	"post":          true,
+	"post-file":     true,
+	"replace":       true,
+}
+
+// jsonRenderRequest is the application/json alternative to the multipart
+// form of /pdf and /image.
+type jsonRenderRequest struct {
+	Options    map[string]any    `json:"options"`
+	Index      *string           `json:"index"`
+	Header     *string           `json:"header"`
+	Footer     *string           `json:"footer"`
+	Assets     map[string]string `json:"assets"`
+	Bundle     *string           `json:"bundle"` // base64 zip, tar or tar.gz
+	Entrypoint string            `json:"entrypoint"`
+	Data       json.RawMessage   `json:"data"` // template mode, see applyTemplates
+	URL        string            `json:"url"`
+	HeaderURL  string            `json:"header-url"`
+	FooterURL  string            `json:"footer-url"`
+	Cover      *string           `json:"cover"`
+	TOC        bool              `json:"toc"`
+	Pages      []pageSpec        `json:"pages"`
+}
+
+// isJSONRequest reports whether the request body is application/json.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// parseJSONBody decodes a JSON render request, writes its documents and
+// assets to tmpdir and turns its options into command line arguments, in
+// option name order.
+func parseJSONBody(ctx context.Context, body io.Reader, tmpdir string, schema optionSchema) (*renderForm, error) {
+	logger := loggerFromContext(ctx)
+
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	var req jsonRenderRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidJSON, fmt.Errorf("invalid JSON body: %w", err))
+	}
+	if dec.More() {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidJSON, errors.New("invalid JSON body: unexpected data after the request object"))
+	}
+
+	form := &renderForm{
+		url:        req.URL,
+		headerURL:  req.HeaderURL,
+		footerURL:  req.FooterURL,
+		toc:        req.TOC,
+		pages:      req.Pages,
+		entrypoint: req.Entrypoint,
+	}
+	if len(req.Data) > 0 && string(req.Data) != "null" {
+		form.data = req.Data
+	}
+	var fieldErrs []optionError
+
+	names := make([]string, 0, len(req.Assets))
+	for name := range req.Assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := map[string][]byte{}
+	for _, name := range names {
+		clean, err := cleanUploadName(name)
+		if err != nil {
+			fieldErrs = append(fieldErrs, optionError{Field: "assets", Value: name, Reason: err.Error()})
+			continue
+		}
+		if _, ok := files[clean]; ok {
+			fieldErrs = append(fieldErrs, optionError{Field: "assets", Value: name, Reason: errUploadExists.Error()})
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(req.Assets[name])
+		if err != nil {
+			fieldErrs = append(fieldErrs, optionError{Field: "assets", Value: name, Reason: "invalid base64 content"})
+			continue
+		}
+		files[clean] = data
+	}
+	for name, html := range map[string]*string{"index.html": req.Index, "header.html": req.Header, "footer.html": req.Footer, "cover.html": req.Cover} {
+		if html == nil {
+			continue
+		}
+		if _, ok := files[name]; ok {
+			fieldErrs = append(fieldErrs, optionError{Field: "assets", Value: name, Reason: "also given inline"})
+			continue
+		}
+		files[name] = []byte(*html)
+	}
+	if len(fieldErrs) > 0 {
+		return nil, &optionValidationError{Errors: fieldErrs}
+	}
+
+	if req.Bundle != nil {
+		data, err := base64.StdEncoding.DecodeString(*req.Bundle)
+		if err != nil {
+			return nil, &optionValidationError{Errors: []optionError{{Field: "bundle", Reason: "invalid base64 content"}}}
+		}
+		if err := extractBundle(bytes.NewReader(data), tmpdir, form.addFile); err != nil {
+			logger.Errorln(err)
+			return nil, err
+		}
+	}
+	names = names[:0]
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path, err := writeUpload(tmpdir, name, files[name])
+		if err != nil {
+			logger.Errorln(err)
+			return nil, uploadError("assets", name, err)
+		}
+		form.addFile(name, path)
+	}
+
+	args, err := jsonOptionArgs(logger, req.Options, schema, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	form.args = args
+	if err := form.useEntrypoint(tmpdir); err != nil {
+		return nil, err
+	}
+	return form, nil
+}
+
+// optionArgs accumulates the arguments built from a JSON options object.
+type optionArgs struct {
+	args    []string
+	checker *optionChecker
+}
+
+// jsonOptionArgs converts the options object to arguments. Values that
+// cannot be expressed as arguments are always rejected; the others are
+// checked against schema like multipart fields.
+func jsonOptionArgs(logger *Logger, options map[string]any, schema optionSchema, tmpdir string) ([]string, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := &optionArgs{checker: newOptionChecker(schema, tmpdir)}
+	var fieldErrs []optionError
+	for _, name := range names {
+		if err := out.add(name, options[name]); err != nil {
+			fieldErrs = append(fieldErrs, optionError{Field: name, Reason: err.Error()})
+		}
+	}
+	if len(fieldErrs) > 0 {
+		return nil, &optionValidationError{Errors: fieldErrs}
+	}
+	if err := out.checker.err(logger); err != nil {
+		return nil, err
+	}
+	return out.args, nil
+}
+
+func (o *optionArgs) add(name string, value any) error {
+	flag := "--" + name
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case bool:
+		if !v {
+			return nil
+		}
+		o.checker.check(name, "")
+		o.args = append(o.args, flag)
+		return nil
+	case map[string]any:
+		if !pairOptions[name] {
+			return errors.New("objects are only accepted for name/value options")
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s, ok := jsonScalar(v[k])
+			if !ok {
+				return fmt.Errorf("value of %q must be a string or a number", k)
+			}
+			s = o.checker.checkPair(name, k, s)
+			o.args = append(o.args, flag, k, s)
+		}
+		return nil
+	case []any:
+		for _, item := range v {
+			if pairOptions[name] {
+				pair, ok := item.([]any)
+				if !ok || len(pair) != 2 {
+					return errors.New("each item must be a [name, value] array")
+				}
+				k, ok1 := jsonScalar(pair[0])
+				s, ok2 := jsonScalar(pair[1])
+				if !ok1 || !ok2 {
+					return errors.New("names and values must be strings or numbers")
+				}
+				s = o.checker.checkPair(name, k, s)
+				o.args = append(o.args, flag, k, s)
+				continue
+			}
+			s, ok := jsonScalar(item)
+			if !ok {
+				return errors.New("array items must be strings or numbers")
+			}
+			s = o.checker.check(name, s)
+			o.args = append(o.args, flag, s)
+		}
+		return nil
+	}
+
+	s, ok := jsonScalar(value)
+	if !ok {
+		return errors.New("unsupported value type")
+	}
+	if pairOptions[name] {
+		return errors.New("must be an object or an array of [name, value] arrays")
+	}
+	s = o.checker.check(name, s)
+	if s == "" {
+		o.args = append(o.args, flag)
+	} else {
+		o.args = append(o.args, flag, s)
+	}
+	return nil
+}
+
+func jsonScalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newJSONRequest(t *testing.T, path, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func TestParseJSONBody(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.LocalFileAccess = localFileAccessAny })
+	tmpdir := t.TempDir()
+	body := `{
+		"options": {
+			"page-size": "A4",
+			"margin-top": 10,
+			"grayscale": true,
+			"no-outline": false,
+			"custom-header": {"X-B": "2", "X-A": "1"},
+			"cookie": [["session", "abc"]],
+			"allow": ["/a", "/b"]
+		},
+		"index": "<html>index</html>",
+		"footer": "<html>footer</html>",
+		"assets": {"logo.png": "iVBORw0K", "css/style.css": "Ym9keSB7fQ=="}
+	}`
+
+	form, err := parseJSONBody(context.Background(), strings.NewReader(body), tmpdir, pdfOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"--allow", "/a", "--allow", "/b",
+		"--cookie", "session", "abc",
+		"--custom-header", "X-A", "1", "--custom-header", "X-B", "2",
+		"--grayscale",
+		"--margin-top", "10",
+		"--page-size", "A4",
+	}
+	if !reflect.DeepEqual(form.args, want) {
+		t.Fatalf("args %q\nwant %q", form.args, want)
+	}
+	if form.indexPath != filepath.Join(tmpdir, "index.html") || form.footerPath != filepath.Join(tmpdir, "footer.html") || form.headerPath != "" {
+		t.Fatalf("form %+v", form)
+	}
+	if data, err := os.ReadFile(filepath.Join(tmpdir, "css", "style.css")); err != nil || string(data) != "body {}" {
+		t.Fatalf("style.css %q %v", data, err)
+	}
+}
+
+func TestParseJSONBody_invalid(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		fields []string
+	}{
+		"object for a plain option": {`{"options": {"page-size": {"a": "b"}}}`, []string{"page-size"}},
+		"pair option as a string":   {`{"options": {"custom-header": "X-A 1"}}`, []string{"custom-header"}},
+		"bad base64":                {`{"assets": {"a.png": "%%%"}}`, []string{"assets"}},
+		"index given twice":         {`{"index": "x", "assets": {"index.html": "eA=="}}`, []string{"assets"}},
+		"asset outside tmpdir":      {`{"assets": {"../a.png": "eA==", "/etc/b.png": "eA=="}}`, []string{"assets", "assets"}},
+		"asset given twice":         {`{"assets": {"img/a.png": "eA==", "img/./a.png": "eA=="}}`, []string{"assets"}},
+		"schema":                    {`{"options": {"page-size": "A11", "margin-tpo": 1}}`, []string{"margin-tpo", "page-size"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseJSONBody(context.Background(), strings.NewReader(tc.body), t.TempDir(), pdfOptions)
+			optErr, ok := err.(*optionValidationError)
+			if !ok {
+				t.Fatalf("error %v, want *optionValidationError", err)
+			}
+			var fields []string
+			for _, fe := range optErr.Errors {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Fatalf("fields %v want %v", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestPDFHandler_json(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"options": {"page-size": "A4"}, "index": "<html></html>"}`))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPDFHandler_jsonErrors(t *testing.T) {
+	cases := map[string]struct {
+		body   string
+		status int
+		code   string
+	}{
+		"syntax":         {`{"index": `, http.StatusBadRequest, codeInvalidJSON},
+		"unknown field":  {`{"html": "x"}`, http.StatusBadRequest, codeInvalidJSON},
+		"trailing data":  {`{"index": "x"} {}`, http.StatusBadRequest, codeInvalidJSON},
+		"missing index":  {`{"options": {}}`, http.StatusBadRequest, codeMissingIndexHTML},
+		"invalid option": {`{"index": "x", "options": {"dpi": "high"}}`, http.StatusBadRequest, codeInvalidOption},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", tc.body))
+			var resp errorResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if rec.Code != tc.status || resp.Code != tc.code {
+				t.Fatalf("status %d code %q (%s), want %d %q", rec.Code, resp.Code, resp.Message, tc.status, tc.code)
+			}
+		})
+	}
+}
+
+func TestImageHandler_jsonHeaderRejected(t *testing.T) {
+	rec := httptest.NewRecorder()
+	withTraceID(imageHandler)(rec, newJSONRequest(t, "/image", `{"index": "x", "header": "y"}`))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+		t.Fatalf("status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
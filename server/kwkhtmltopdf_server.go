@@ -3,14 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -27,6 +31,9 @@ func (sr *statusRecorder) WriteHeader(code int) {
 }
 
 func wkhtmltopdfBin() string {
+	if config.WkhtmltopdfBin != "" {
+		return config.WkhtmltopdfBin
+	}
 	bin := os.Getenv("KWKHTMLTOPDF_BIN")
 	if bin != "" {
 		return bin
@@ -34,49 +41,34 @@ func wkhtmltopdfBin() string {
 	return "wkhtmltopdf"
 }
 
-func httpError(ctx context.Context, w http.ResponseWriter, err error, code int) {
+// httpError reports err to the client. Errors that are not an *apiError are
+// reported as internal errors.
+func httpError(ctx context.Context, w http.ResponseWriter, err error) {
 	logger := loggerFromContext(ctx)
 
 	logger.Errorf("HTTP error: %v", err)
 
+	apiErr := asAPIError(err)
 	if sr, ok := w.(*statusRecorder); ok {
-		sr.statusCode = code
+		sr.statusCode = apiErr.Status
 	}
 
-	http.Error(w, err.Error(), code)
+	writeErrorResponse(ctx, w, apiErr)
 }
 
-func httpAbort(ctx context.Context, w http.ResponseWriter, err error) {
-	logger := loggerFromContext(ctx)
-
-	logger.Errorf("HTTP abort: %v", err)
-
-	if sr, ok := w.(*statusRecorder); ok {
-		sr.statusCode = http.StatusInternalServerError
-	}
-
-	wh, ok := w.(http.Hijacker)
-	if !ok {
-		errorTotal.WithLabelValues("hijack_unsupported", err.Error()).Inc()
-		logger.Errorln("cannot abort connection, error not reported to client: http.Hijacker not supported")
-		return
-	}
-	c, _, err := wh.Hijack()
-	if err != nil {
-		errorTotal.WithLabelValues("hijack_failed", err.Error()).Inc()
-		logger.Errorln("cannot abort connection, error not reported to client: ", err)
-		return
-	}
-	c.Close()
-}
 func pdfHandler(w http.ResponseWriter, r *http.Request) {
+	servePDF(w, r, preparePDF)
+}
+
+// servePDF renders a PDF request prepared by prepare and serves the result.
+func servePDF(w http.ResponseWriter, r *http.Request, prepare func(ctx context.Context, r *http.Request, tmpdir string) (*preparedRender, error)) {
 	ctx := r.Context()
 
 	logger := loggerFromContext(ctx)
 
 	if r.Method != http.MethodPost {
 		errorTotal.WithLabelValues("method_not_allowed", r.Method).Inc()
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
 		return
 	}
 
@@ -87,50 +79,155 @@ func pdfHandler(w http.ResponseWriter, r *http.Request) {
 	rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
 	defer func() {
 		duration := time.Since(start).Seconds()
-		requestDuration.WithLabelValues(r.URL.Path).Observe(duration)
-		requestsTotal.WithLabelValues(r.URL.Path, fmt.Sprintf("%d", rec.statusCode)).Inc()
+		client := clientIDFromContext(ctx)
+		requestDuration.WithLabelValues(r.URL.Path, client).Observe(duration)
+		requestsTotal.WithLabelValues(r.URL.Path, fmt.Sprintf("%d", rec.statusCode), client).Inc()
 	}()
 
-	tmpdir, err := os.MkdirTemp("", "kwk")
+	tmpdir, cleanup, err := activeRenders.tempDir("kwk")
 	if err != nil {
 		errorTotal.WithLabelValues("tempdir_creation_failed", err.Error()).Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
+		httpError(ctx, rec, newAPIError(http.StatusInternalServerError, codeTempDirFailed, err))
 		return
 	}
-	defer os.RemoveAll(tmpdir)
+	defer cleanup()
 
 	logger.Infof("Temporary directory created: %s", tmpdir)
 
-	reader, err := r.MultipartReader()
+	prepared, err := prepare(ctx, r, tmpdir)
 	if err != nil {
-		errorTotal.WithLabelValues("multipart_reader_creation_failed", err.Error()).Inc()
-		logger.Errorf("Failed to create multipart reader: %v", err)
-		httpError(ctx, w, err, http.StatusBadRequest)
+		httpError(ctx, rec, err)
 		return
 	}
 
-	args, endArgs, indexPath, err := parseMultipartForm(ctx, reader, tmpdir)
+	result, err := prepared.execute(ctx, nil)
 	if err != nil {
-		errorTotal.WithLabelValues("parse_multipart_form_failed", err.Error()).Inc()
-		logger.Errorf("Failed to parse multipart form: %v", err)
-		httpError(ctx, w, err, http.StatusBadRequest)
+		httpError(ctx, rec, err)
 		return
 	}
 
-	if indexPath == "" {
+	serveRenderResult(ctx, rec, r, result)
+
+	// Log and track the size of the generated PDF
+	logger.Infof("Generated PDF size: %d bytes", result.Size)
+	pdfSize.Observe(float64(result.Size))
+}
+
+// preparePDF parses a /pdf request, saving its files to tmpdir, and returns
+// the render to run.
+func preparePDF(ctx context.Context, r *http.Request, tmpdir string) (*preparedRender, error) {
+	logger := loggerFromContext(ctx)
+
+	timeout, err := renderTimeout(r)
+	if err != nil {
+		errorTotal.WithLabelValues("invalid_render_timeout", err.Error()).Inc()
+		return nil, err
+	}
+
+	var form *renderForm
+	if isJSONRequest(r) {
+		form, err = parseJSONBody(ctx, r.Body, tmpdir, pdfOptions)
+		if err != nil {
+			errorTotal.WithLabelValues("parse_json_body_failed", err.Error()).Inc()
+			logger.Errorf("Failed to parse JSON body: %v", err)
+			return nil, parseFormError(err)
+		}
+	} else {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			errorTotal.WithLabelValues("multipart_reader_creation_failed", err.Error()).Inc()
+			logger.Errorf("Failed to create multipart reader: %v", err)
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidMultipart, err)
+		}
+
+		form, err = parseMultipartForm(ctx, reader, tmpdir)
+		if err != nil {
+			errorTotal.WithLabelValues("parse_multipart_form_failed", err.Error()).Inc()
+			logger.Errorf("Failed to parse multipart form: %v", err)
+			return nil, parseFormError(err)
+		}
+	}
+
+	return preparePDFForm(ctx, form, tmpdir, timeout)
+}
+
+// preparePDFForm resolves and checks the documents of a parsed /pdf request
+// and returns its render.
+func preparePDFForm(ctx context.Context, form *renderForm, tmpdir string, timeout time.Duration) (*preparedRender, error) {
+	logger := loggerFromContext(ctx)
+
+	if err := remoteURLs.resolveForm(ctx, form); err != nil {
+		errorTotal.WithLabelValues("url_rejected", err.Error()).Inc()
+		logger.Errorf("Rejected input URL: %v", err)
+		return nil, parseFormError(err)
+	}
+
+	data, err := parseTemplateData(form)
+	if err != nil {
+		errorTotal.WithLabelValues("template_error", err.Error()).Inc()
+		logger.Errorf("Invalid template data: %v", err)
+		return nil, parseFormError(err)
+	}
+
+	objects, err := pdfObjects(ctx, form, tmpdir)
+	if err != nil {
+		errorTotal.WithLabelValues("invalid_pages", err.Error()).Inc()
+		logger.Errorf("Invalid pages: %v", err)
+		return nil, parseFormError(err)
+	}
+	if objects == nil {
 		errorTotal.WithLabelValues("index_html_file_not_found", "").Inc()
 		logger.Errorln("index.html file is required but not found")
-		httpError(ctx, w, errors.New("index.html file is required"), http.StatusBadRequest)
-		return
+		return nil, newAPIError(http.StatusBadRequest, codeMissingIndexHTML, errors.New("index.html file is required"))
 	}
 
-	endArgs = append(endArgs, indexPath)
-	args = append(args, endArgs...)
+	var inputs []string
+	if header := form.header(); header != "" {
+		inputs = append(inputs, "--header-html", header)
+	}
+	if footer := form.footer(); footer != "" {
+		inputs = append(inputs, "--footer-html", footer)
+	}
+	inputs = append(inputs, objects...)
+	args := append(slices.Clip(form.args), inputs...)
+	network := form.network()
+
+	return &preparedRender{
+		render: func(ctx context.Context) (*renderResult, error) {
+			renderCtx, cancel := withRenderTimeout(ctx, timeout)
+			defer cancel()
+			if err := applyTemplates(renderCtx, form, data); err != nil {
+				errorTotal.WithLabelValues("template_error", err.Error()).Inc()
+				loggerFromContext(ctx).Errorf("Failed to render templates: %v", err)
+				return nil, err
+			}
+			return runWkhtmltopdf(renderCtx, args, tmpdir, network)
+		},
+		tmpdir: tmpdir,
+		key:    renderKey(ctx, wkhtmltopdfBin(), tmpdir, form.args, inputs, form.data),
+		errors: errorTotal,
+	}, nil
+}
 
-	runWkhtmltopdf(ctx, rec, args)
+// parseFormError maps an error returned by the multipart or JSON body
+// parsers to the error reported to the client.
+func parseFormError(err error) error {
+	var optErr *optionValidationError
+	if errors.As(err, &optErr) {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption, err)
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, err)
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidMultipart, err)
 }
 
-func parseMultipartForm(ctx context.Context, reader *multipart.Reader, tmpdir string) (args []string, endArgs []string, indexPath string, err error) {
+func parseMultipartForm(ctx context.Context, reader *multipart.Reader, tmpdir string) (form *renderForm, err error) {
 	logger := loggerFromContext(ctx)
 
 	defer func() {
@@ -140,6 +237,9 @@ func parseMultipartForm(ctx context.Context, reader *multipart.Reader, tmpdir st
 		}
 	}()
 
+	form = &renderForm{}
+	checker := newOptionChecker(pdfOptions, tmpdir)
+	bundled := false
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
@@ -147,146 +247,220 @@ func parseMultipartForm(ctx context.Context, reader *multipart.Reader, tmpdir st
 		}
 		if err != nil {
 			logger.Errorln(err)
-			return nil, nil, "", err
+			return nil, err
 		}
 
-		if part.FormName() == "file" {
-			path := filepath.Join(tmpdir, filepath.Base(part.FileName()))
-			file, err := os.Create(path)
+		if part.FormName() == "bundle" {
+			if bundled {
+				return nil, bundleError("only one bundle part is allowed")
+			}
+			bundled = true
+			if err := extractBundle(part, tmpdir, form.addFile); err != nil {
+				logger.Errorln(err)
+				return nil, err
+			}
+		} else if part.FormName() == "file" {
+			name, err := cleanUploadName(uploadName(part))
+			if err != nil {
+				return nil, uploadError("file", uploadName(part), err)
+			}
+			file, path, err := createUpload(tmpdir, name)
 			if err != nil {
 				logger.Errorln(err)
-				return nil, nil, "", err
+				return nil, uploadError("file", name, err)
 			}
 			_, err = io.Copy(file, part)
 			file.Close()
 			if err != nil {
 				logger.Errorln(err)
-				return nil, nil, "", err
+				return nil, err
 			}
 
-			switch part.FileName() {
-			case "header.html":
-				endArgs = append(endArgs, "--header-html", path)
-			case "footer.html":
-				endArgs = append(endArgs, "--footer-html", path)
-			case "index.html":
-				indexPath = path
-			}
+			form.addFile(name, path)
 		} else {
 			buf := new(bytes.Buffer)
 			buf.ReadFrom(part)
 			arg := buf.String()
+			if reserved, err := form.setField(part.FormName(), arg); reserved {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			arg = checker.check(part.FormName(), arg)
 			if arg == "" {
-				args = append(args, fmt.Sprintf("--%s", part.FormName()))
+				form.args = append(form.args, fmt.Sprintf("--%s", part.FormName()))
 			} else {
-				args = append(args, fmt.Sprintf("--%s", part.FormName()), arg)
+				form.args = append(form.args, fmt.Sprintf("--%s", part.FormName()), arg)
 			}
 		}
 	}
 
-	return args, endArgs, indexPath, nil
-}
-
-func runWkhtmltopdf(ctx context.Context, w http.ResponseWriter, args []string) {
-	logger := loggerFromContext(ctx)
-
-	args = append(args, "--enable-local-file-access") // https://github.com/wkhtmltopdf/wkhtmltopdf/issues/4460#issuecomment-661345113
-	args = append(args, "-")
-	logger.Infoln("Args", args)
-
-	logger.Infoln("Starting wkhtmltopdf process")
-	cmd := exec.Command(wkhtmltopdfBin(), args...)
-	cmdStdout, err := cmd.StdoutPipe()
-	if err != nil {
-		errorTotal.WithLabelValues("stdout_pipe_failed", err.Error()).Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
-		return
+	if err := checker.err(logger); err != nil {
+		return nil, err
 	}
-	cmd.Stderr = os.Stderr
-	done := make(chan error, 1)
-
-	err = cmd.Start()
-	if err != nil {
-		errorTotal.WithLabelValues("process_start_failed", err.Error()).Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
-		return
+	if err := form.useEntrypoint(tmpdir); err != nil {
+		return nil, err
 	}
 
-	logger.Infoln("wkhtmltopdf process started")
-
-	// Buffer the output
-	var pdfBuffer bytes.Buffer
+	return form, nil
+}
 
-	go func() {
-		_, err := io.Copy(&pdfBuffer, cmdStdout)
-		if err != nil {
-			errorTotal.WithLabelValues("copy_output_failed", err.Error()).Inc()
-			logger.Errorf("Error copying command output: %v", err)
-			done <- err
-			return
-		}
-		done <- cmd.Wait()
-	}()
+func runWkhtmltopdf(ctx context.Context, args []string, tmpdir string, network *networkPolicy) (*renderResult, error) {
+	outPath := filepath.Join(tmpdir, "output.pdf")
+
+	// Before the objects, so that it applies to every page.
+	args = append(localFileAccessArgs(tmpdir), args...)
+	args = append(args, outPath)
+
+	process := &renderProcess{
+		name:        "wkhtmltopdf",
+		bin:         wkhtmltopdfBin(),
+		args:        args,
+		tmpdir:      tmpdir,
+		outPath:     outPath,
+		contentType: "application/pdf",
+		network:     network,
+		errors:      errorTotal,
+	}
+	return process.run(ctx)
+}
 
-	select {
-	case <-ctx.Done():
-		if ctx.Err() != nil {
-			errorTotal.WithLabelValues("context_cancelled", ctx.Err().Error()).Inc()
-		}
-		logger.Errorln("Context cancelled, killing wkhtmltopdf process")
-		if err := cmd.Process.Kill(); err != nil {
-			logger.Errorf("Failed to kill process: %v", err)
-		}
-		httpError(ctx, w, ctx.Err(), http.StatusRequestTimeout)
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(r.Context(), w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
 		return
-	case err := <-done:
-		if err != nil {
-			logger.Errorf("wkhtmltopdf process failed: %v", err)
-			errorTotal.WithLabelValues("process_failed", err.Error()).Inc()
-			httpError(ctx, w, err, http.StatusInternalServerError)
-			return
-		}
 	}
 
-	// Only set the content type header when the process is successful
-	w.Header().Set("Content-Type", "application/pdf")
-	// Write the PDF to the client
-	_, err = w.Write(pdfBuffer.Bytes())
-	if err != nil {
-		logger.Errorf("Failed to write PDF to response: %v", err)
-		httpAbort(ctx, w, err)
+	if shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	// Log and track the size of the generated PDF
-	logger.Infof("Generated PDF size: %d bytes", pdfBuffer.Len())
-	pdfSize.Observe(float64(pdfBuffer.Len()))
-	logger.Infoln("wkhtmltopdf process completed successfully")
+	w.WriteHeader(http.StatusOK)
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		return
+// withMaxBodySize limits the size of request bodies to the max-body-size
+// setting.
+func withMaxBodySize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.MaxBodySize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodySize)
+		}
+		next.ServeHTTP(w, r)
 	}
-
-	w.WriteHeader(http.StatusOK)
 }
 
-func main() {
-	log := NewProductionLogger()
+// newRouter registers the HTTP endpoints. The probes and /metrics are served
+// without authentication.
+func newRouter() *http.ServeMux {
 	router := http.NewServeMux()
 	router.HandleFunc("/status", withTraceID(statusHandler))
-	router.HandleFunc("/pdf", withTraceID(pdfHandler))
-	router.HandleFunc("/image", withTraceID(imageHandler))
+	router.HandleFunc("/healthz", withTraceID(healthzHandler))
+	router.HandleFunc("/readyz", withTraceID(readyzHandler))
+	router.HandleFunc("/pdf", withTraceID(withAuth(withMaxBodySize(pdfHandler))))
+	router.HandleFunc("/image", withTraceID(withAuth(withMaxBodySize(imageHandler))))
+	router.HandleFunc("/batch/pdf", withTraceID(withAuth(withMaxBodySize(batchPDFHandler))))
+	router.HandleFunc("/jobs/pdf", withTraceID(withAuth(withMaxBodySize(jobSubmitHandler("pdf", preparePDF)))))
+	router.HandleFunc("/jobs/image", withTraceID(withAuth(withMaxBodySize(jobSubmitHandler("image", prepareImage)))))
+	router.HandleFunc("/jobs/{id}", withTraceID(withAuth(jobStatusHandler)))
+	router.HandleFunc("/jobs/{id}/result", withTraceID(withAuth(jobResultHandler)))
+	router.HandleFunc("/templates", withTraceID(withAuth(templatesHandler)))
+	router.HandleFunc("/templates/{name}", withTraceID(withAuth(withMaxBodySize(templateHandler))))
+	router.HandleFunc("/templates/{name}/versions/{version}", withTraceID(withAuth(templateVersionHandler)))
+	router.HandleFunc("/render/{name}", withTraceID(withAuth(withMaxBodySize(renderTemplateHandler))))
 	router.Handle("/metrics", promhttp.Handler())
+	return router
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxCommand {
+		os.Exit(runSandbox(os.Args[2:]))
+	}
+	log := NewProductionLogger()
 
-	log.Println("kwkhtmltopdf server listening on port 8080")
+	cfg, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	config = cfg
+	renderSlots = newRenderLimiter(config.MaxConcurrency, config.MaxQueue, config.QueueTimeout)
+	remoteURLs = newURLGuard(config)
+	renderNetwork = newNetworkPolicy(config)
+	requestAuth, err = newAuthenticator(config)
+	if err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
+	renderSandbox, err = newSandbox(config, log)
+	if err != nil {
+		log.Fatalf("Failed to set up the render sandbox: %v", err)
+	}
+	if config.CanaryInterval > 0 {
+		pdfCanary = startCanary(config.CanaryInterval)
+	}
+	renderJobs, err = newJobStore(config)
+	if err != nil {
+		log.Fatalf("Failed to open job store: %v", err)
+	}
+	templateRegistry, err = newTemplateStore(config)
+	if err != nil {
+		log.Fatalf("Failed to open template registry: %v", err)
+	}
+	renderCache, err = newResultCache(config)
+	if err != nil {
+		log.Fatalf("Failed to open render cache: %v", err)
+	}
+	webhookSecret, err = loadWebhookSecret(config.WebhookSecretFile)
+	if err != nil {
+		log.Fatalf("Failed to load webhook secret: %v", err)
+	}
+	startJobExpiry(renderJobs, log)
 
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:              config.ListenAddr,
+		Handler:           newRouter(),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	if config.TLSCertFile != "" {
+		certs, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		go certs.watch(config.TLSReloadInterval, log)
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+
+		log.Printf("kwkhtmltopdf server listening on %s (TLS)", config.ListenAddr)
+		go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+	} else {
+		log.Printf("kwkhtmltopdf server listening on %s", config.ListenAddr)
+		go func() { serveErr <- server.ListenAndServe() }()
 	}
-	log.Fatal(server.ListenAndServe())
 
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-signals.Done():
+		stop()
+		gracefulShutdown(server, log)
+	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryAfter is the delay suggested to clients when no render slot is available.
+const retryAfter = 5 * time.Second
+
+var (
+	errQueueFull    = errors.New("render queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a render slot")
+)
+
+// renderLimiter bounds the number of concurrent wkhtmltopdf/wkhtmltoimage
+// processes. Requests that find every slot busy wait in a bounded queue for at
+// most maxWait.
+type renderLimiter struct {
+	slots    chan struct{}
+	maxQueue int
+	maxWait  time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+// renderSlots is shared by /pdf and /image.
+var renderSlots = newRenderLimiter(config.MaxConcurrency, config.MaxQueue, config.QueueTimeout)
+
+func newRenderLimiter(concurrency, maxQueue int, maxWait time.Duration) *renderLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &renderLimiter{
+		slots:    make(chan struct{}, concurrency),
+		maxQueue: maxQueue,
+		maxWait:  maxWait,
+	}
+}
+
+// Acquire blocks until a render slot is free and returns the function that
+// releases it.
+func (l *renderLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(start), nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, errQueueFull
+	}
+	l.queued++
+	renderQueueDepth.Set(float64(l.queued))
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		renderQueueDepth.Set(float64(l.queued))
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(start), nil
+	case <-timer.C:
+		renderQueueWait.Observe(time.Since(start).Seconds())
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		renderQueueWait.Observe(time.Since(start).Seconds())
+		return nil, ctx.Err()
+	}
+}
+
+// Wait blocks until a render slot is free, without the queue bounds of
+// Acquire: it is for renders already accepted, such as jobs, which must not
+// fail for want of a slot. Its waiters are not counted in QueueDepth.
+func (l *renderLimiter) Wait(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(start), nil
+	case <-ctx.Done():
+		renderQueueWait.Observe(time.Since(start).Seconds())
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquire takes a render slot if one is free, without queueing.
+func (l *renderLimiter) TryAcquire() (release func(), ok bool) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(time.Now()), true
+	default:
+		return nil, false
+	}
+}
+
+func (l *renderLimiter) acquired(start time.Time) func() {
+	renderQueueWait.Observe(time.Since(start).Seconds())
+	renderActiveProcesses.Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			renderActiveProcesses.Dec()
+			<-l.slots
+		})
+	}
+}
+
+// QueueDepth returns the number of requests waiting for a slot.
+func (l *renderLimiter) QueueDepth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
+
+// renderSlotError maps an Acquire error to the error reported to the client.
+func renderSlotError(err error) error {
+	var apiErr *apiError
+	switch {
+	case errors.Is(err, errQueueFull):
+		apiErr = newAPIError(http.StatusTooManyRequests, codeQueueFull, err)
+	case errors.Is(err, errQueueTimeout):
+		apiErr = newAPIError(http.StatusServiceUnavailable, codeQueueTimeout, err)
+	default:
+		return newAPIError(http.StatusRequestTimeout, codeTimeout, err)
+	}
+	apiErr.RetryAfter = retryAfter
+	return apiErr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenderLimiter_queueTimeout(t *testing.T) {
+	l := newRenderLimiter(1, 1, 20*time.Millisecond)
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("got %v want errQueueTimeout", err)
+	}
+
+	release()
+	release() // releasing twice is harmless
+	release2, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("slot not released: %v", err)
+	}
+	release2()
+}
+
+func TestRenderLimiter_queueFull(t *testing.T) {
+	l := newRenderLimiter(1, 1, time.Second)
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	waiting := make(chan error, 1)
+	go func() {
+		r, err := l.Acquire(context.Background())
+		if err == nil {
+			r()
+		}
+		waiting <- err
+	}()
+	for l.QueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, errQueueFull) {
+		t.Fatalf("got %v want errQueueFull", err)
+	}
+
+	release()
+	if err := <-waiting; err != nil {
+		t.Fatalf("queued request failed: %v", err)
+	}
+}
+
+func TestRenderLimiter_contextCancelled(t *testing.T) {
+	l := newRenderLimiter(1, 1, time.Second)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v want context.Canceled", err)
+	}
+	if l.QueueDepth() != 0 {
+		t.Fatalf("queue depth %d after cancel", l.QueueDepth())
+	}
+}
+
+func TestPDFHandler_queueFull(t *testing.T) {
+	saved := renderSlots
+	renderSlots = newRenderLimiter(1, 0, time.Second)
+	defer func() { renderSlots = saved }()
+
+	release, err := renderSlots.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, nil))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d want 429 body %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+}
@@ -19,7 +19,12 @@ var (
 // Define a custom type for the context key
 type contextKey string
 
-const LoggerContextKey = contextKey("logger")
+const (
+	LoggerContextKey    = contextKey("logger")
+	TraceIDContextKey   = contextKey("trace-id")
+	WantsJSONContextKey = contextKey("wants-json")
+	ClientIDContextKey  = contextKey("client-id")
+)
 
 func NewProductionLogger() *Logger {
 	Log := logrus.New()
@@ -49,6 +54,25 @@ func loggerFromContext(ctx context.Context) *Logger {
 	return newLogger()
 }
 
+// Helper to get the request trace ID from context
+func traceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(TraceIDContextKey).(string)
+	return traceID
+}
+
+// Helper to get the authenticated client ID from context, empty when
+// authentication is off
+func clientIDFromContext(ctx context.Context) string {
+	clientID, _ := ctx.Value(ClientIDContextKey).(string)
+	return clientID
+}
+
+// Helper to know whether error responses should be written as JSON
+func wantsJSONFromContext(ctx context.Context) bool {
+	wantsJSON, _ := ctx.Value(WantsJSONContextKey).(bool)
+	return wantsJSON
+}
+
 func (logger *Logger) WithTraceID(traceID string) *Logger {
 	logger.Entry = logger.WithField("trace-id", traceID)
 	return logger
@@ -70,6 +94,8 @@ func withTraceID(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		ctx := context.WithValue(r.Context(), LoggerContextKey, log)
+		ctx = context.WithValue(ctx, TraceIDContextKey, traceID)
+		ctx = context.WithValue(ctx, WantsJSONContextKey, acceptsJSON(r))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
@@ -12,7 +12,7 @@ var (
 			Name: "pdf_requests_total",
 			Help: "Total number of PDF generation requests",
 		},
-		[]string{"path", "status"},
+		[]string{"path", "status", "client"},
 	)
 
 	// Histogram for request duration
@@ -22,7 +22,7 @@ var (
 			Help:    "Time taken to process PDF generation requests",
 			Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 20, 30},
 		},
-		[]string{"path"},
+		[]string{"path", "client"},
 	)
 
 	// Gauge for current active requests
@@ -56,7 +56,7 @@ var (
 			Name: "image_requests_total",
 			Help: "Total number of image generation requests",
 		},
-		[]string{"path", "status"},
+		[]string{"path", "status", "client"},
 	)
 
 	imageRequestDuration = promauto.NewHistogramVec(
@@ -65,7 +65,7 @@ var (
 			Help:    "Time taken to process image generation requests",
 			Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 20, 30},
 		},
-		[]string{"path"},
+		[]string{"path", "client"},
 	)
 
 	imageActiveRequests = promauto.NewGauge(
@@ -90,4 +90,98 @@ var (
 			Buckets: prometheus.ExponentialBuckets(1024, 2, 12),
 		},
 	)
+
+	// Render processes shared by /pdf and /image
+	renderActiveProcesses = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "render_active_processes",
+			Help: "Number of running wkhtmltopdf and wkhtmltoimage processes",
+		},
+	)
+
+	renderQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "render_queue_depth",
+			Help: "Number of requests waiting for a render slot",
+		},
+	)
+
+	renderQueueWait = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "render_queue_wait_seconds",
+			Help:    "Time spent waiting for a render slot",
+			Buckets: []float64{.01, .1, .5, 1, 2.5, 5, 10, 20, 30},
+		},
+	)
+
+	// Asynchronous jobs
+	jobsSubmitted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "render_jobs_submitted_total",
+			Help: "Total number of render jobs submitted",
+		},
+		[]string{"kind"},
+	)
+
+	jobsCompleted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "render_jobs_completed_total",
+			Help: "Total number of render jobs completed, by final status",
+		},
+		[]string{"kind", "status"},
+	)
+
+	webhookDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "render_job_webhooks_total",
+			Help: "Total number of job completion callbacks, by result",
+		},
+		[]string{"result"},
+	)
+
+	templateRenders = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_renders_total",
+			Help: "Total number of registered template renders, by template version and status",
+		},
+		[]string{"template", "version", "status"},
+	)
+
+	// Render cache
+	cacheHits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "render_cache_hits_total",
+			Help: "Total number of renders served from the render cache",
+		},
+	)
+
+	cacheMisses = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "render_cache_misses_total",
+			Help: "Total number of cacheable renders not found in the render cache",
+		},
+	)
+
+	batchItems = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "render_batch_items_total",
+			Help: "Total number of batch items rendered, by status",
+		},
+		[]string{"status"},
+	)
+
+	renderFetches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "render_fetches_total",
+			Help: "Total number of fetches of rendered documents through the network policy proxy, by host and result",
+		},
+		[]string{"host", "result"},
+	)
+
+	coalescedRenders = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "render_coalesced_total",
+			Help: "Total number of requests that shared an identical render in progress",
+		},
+	)
 )
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Network policies, selected with the network-policy setting.
+const (
+	networkOpen    = "open"
+	networkOffline = "offline"
+	networkProxy   = "proxy"
+)
+
+// Results of a fetch in the render_fetches_total metric.
+const (
+	fetchAllowed = "allowed"
+	fetchBlocked = "blocked"
+)
+
+// networkOptions would let a render bypass the fetch proxy.
+var networkOptions = map[string]bool{
+	"proxy":                 true,
+	"bypass-proxy-for":      true,
+	"proxy-hostname-lookup": true,
+}
+
+// renderNetwork is the network policy of renders; main rebuilds it from the
+// effective config.
+var renderNetwork = newNetworkPolicy(config)
+
+// networkPolicy decides what the documents being rendered may fetch. Unless
+// it is open, every render gets a forward proxy of its own, so that each
+// fetch is checked and logged with the trace ID of the request.
+type networkPolicy struct {
+	mode       string
+	allowHosts []string
+	timeout    time.Duration
+	urlGuard   *urlGuard // URL mode renders, see urlMode
+}
+
+func newNetworkPolicy(cfg *Config) *networkPolicy {
+	return &networkPolicy{
+		mode:       cfg.NetworkPolicy,
+		allowHosts: cfg.NetworkAllowHosts,
+		timeout:    cfg.URLTimeout,
+	}
+}
+
+// urlMode returns the policy of the renders of remote documents: whatever
+// the mode, their fetches, iframes and redirects included, go through the
+// fetch proxy and are checked against the URL mode host lists, with private
+// addresses refused unless url-allow-private is set.
+func (n *networkPolicy) urlMode(g *urlGuard) *networkPolicy {
+	p := *n
+	p.urlGuard = g
+	return &p
+}
+
+// checkHost reports why a render may not fetch from host, or nil if it may.
+// Private addresses are refused again once host is resolved.
+func (n *networkPolicy) checkHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if n.mode == networkOffline {
+		return errors.New("the network policy is offline")
+	}
+	if n.urlGuard != nil {
+		if err := n.urlGuard.checkHost(host); err != nil {
+			return err
+		}
+	}
+	switch {
+	case n.mode == networkOpen:
+		return nil
+	case len(n.allowHosts) > 0 && !matchesAny(n.allowHosts, host):
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && isPrivateAddr(ip) {
+		return fmt.Errorf("%s: %w", ip, errPrivateAddress)
+	}
+	return nil
+}
+
+// allowPrivate reports whether fetches may connect to private addresses.
+func (n *networkPolicy) allowPrivate() bool {
+	return n.mode == networkOpen && (n.urlGuard == nil || n.urlGuard.allowPrivate)
+}
+
+// start starts the fetch proxy of one render and returns the arguments
+// pointing the render to it, and a function stopping it.
+func (n *networkPolicy) start(ctx context.Context) ([]string, func(), error) {
+	if n.mode == networkOpen && n.urlGuard == nil {
+		return nil, func() {}, nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &fetchProxy{
+		policy:  n,
+		tunnels: map[net.Conn]bool{},
+		dialer:  &net.Dialer{Timeout: n.timeout, Control: checkPublicDial},
+	}
+	if n.allowPrivate() {
+		p.dialer.Control = nil
+	}
+	p.transport = &http.Transport{
+		DialContext:           p.dialer.DialContext,
+		ResponseHeaderTimeout: n.timeout,
+	}
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: n.timeout,
+		BaseContext:       func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
+	}
+	go p.server.Serve(listener)
+	return []string{"--proxy", "http://" + listener.Addr().String()}, p.stop, nil
+}
+
+// fetchProxy is the forward proxy of one render. Plain HTTP requests are
+// forwarded, HTTPS goes through CONNECT tunnels.
+type fetchProxy struct {
+	policy    *networkPolicy
+	server    *http.Server
+	transport *http.Transport
+	dialer    *net.Dialer
+
+	mu      sync.Mutex
+	tunnels map[net.Conn]bool // hijacked connections, not closed by server
+	stopped bool
+}
+
+func (p *fetchProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if r.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(r.Host)
+	} else if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "only proxy requests are supported", http.StatusBadRequest)
+		return
+	}
+	logger := &Logger{Entry: loggerFromContext(r.Context()).WithField("fetch-host", host)}
+
+	if err := p.policy.checkHost(host); err != nil {
+		p.block(w, logger, r, host, err)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, logger, r, host)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "Keep-Alive", "Te", "Trailer", "Upgrade"} {
+		out.Header.Del(h)
+	}
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.fail(w, logger, r, host, err)
+		return
+	}
+	defer resp.Body.Close()
+	p.allow(logger, r, host, resp.Status)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects the render to the address of a CONNECT request.
+func (p *fetchProxy) tunnel(w http.ResponseWriter, logger *Logger, r *http.Request, host string) {
+	upstream, err := p.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.fail(w, logger, r, host, err)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		logger.Errorf("Failed to open the tunnel to %s: %v", r.Host, err)
+		return
+	}
+	if !p.track(conn, upstream) {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	defer p.untrack(conn, upstream)
+	p.allow(logger, r, host, "tunnel open")
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err != nil || rw.Flush() != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, rw); done <- struct{}{} }()
+	go func() { io.Copy(conn, upstream); done <- struct{}{} }()
+	<-done
+}
+
+// block refuses a fetch denied by the policy.
+func (p *fetchProxy) block(w http.ResponseWriter, logger *Logger, r *http.Request, host string, err error) {
+	renderFetches.WithLabelValues(host, fetchBlocked).Inc()
+	logger.Warnf("Blocked fetch %s %s: %v", r.Method, fetchTarget(r), err)
+	http.Error(w, "blocked by the network policy", http.StatusForbidden)
+}
+
+// fail answers a fetch that could not be made, refused private addresses
+// included.
+func (p *fetchProxy) fail(w http.ResponseWriter, logger *Logger, r *http.Request, host string, err error) {
+	if errors.Is(err, errPrivateAddress) {
+		p.block(w, logger, r, host, err)
+		return
+	}
+	renderFetches.WithLabelValues(host, fetchAllowed).Inc()
+	logger.Warnf("Fetch %s %s failed: %v", r.Method, fetchTarget(r), err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// allow records a fetch let through by the policy.
+func (p *fetchProxy) allow(logger *Logger, r *http.Request, host, status string) {
+	renderFetches.WithLabelValues(host, fetchAllowed).Inc()
+	logger.Infof("Fetch %s %s: %s", r.Method, fetchTarget(r), status)
+}
+
+// fetchTarget is the fetched URL for logs, or the address of a tunnel.
+func fetchTarget(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return r.Host
+	}
+	return r.URL.Redacted()
+}
+
+func (p *fetchProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	for _, c := range conns {
+		p.tunnels[c] = true
+	}
+	return true
+}
+
+func (p *fetchProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+		delete(p.tunnels, c)
+	}
+}
+
+// stop closes the proxy and every connection of the render.
+func (p *fetchProxy) stop() {
+	p.server.Close()
+	p.transport.CloseIdleConnections()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	for c := range p.tunnels {
+		c.Close()
+	}
+}
+
+// checkPublicDial refuses connections to private addresses.
+func checkPublicDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if isPrivateAddr(ip) {
+		return fmt.Errorf("%s: %w", ip, errPrivateAddress)
+	}
+	return nil
+}
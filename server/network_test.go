@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNetworkPolicy_checkHost(t *testing.T) {
+	tests := []struct {
+		mode  string
+		allow []string
+		host  string
+		ok    bool
+	}{
+		{networkOpen, nil, "127.0.0.1", true},
+		{networkOffline, nil, "fonts.example.com", false},
+		{networkProxy, nil, "fonts.example.com", true},
+		{networkProxy, []string{"*.example.com"}, "fonts.example.com", true},
+		{networkProxy, []string{"*.example.com"}, "Fonts.Example.com.", true},
+		{networkProxy, []string{"*.example.com"}, "tracker.example.net", false},
+		{networkProxy, nil, "169.254.169.254", false},
+		{networkProxy, nil, "fd00:ec2::254", false},
+	}
+	for _, tt := range tests {
+		policy := &networkPolicy{mode: tt.mode, allowHosts: tt.allow}
+		if err := policy.checkHost(tt.host); (err == nil) != tt.ok {
+			t.Errorf("%s %q: checkHost(%s) = %v, want ok=%v", tt.mode, tt.allow, tt.host, err, tt.ok)
+		}
+	}
+
+	// URL mode renders also apply the URL mode checks, even when open.
+	open := &networkPolicy{mode: networkOpen}
+	guarded := open.urlMode(testURLGuard(t, func(c *Config) { c.URLDenyHosts = []string{"*.internal.example.com"} }))
+	private := open.urlMode(testURLGuard(t, func(c *Config) { c.URLAllowPrivate = true }))
+	for _, tt := range []struct {
+		policy *networkPolicy
+		host   string
+		ok     bool
+	}{
+		{guarded, "fonts.example.com", true},
+		{guarded, "billing.internal.example.com", false},
+		{guarded, "169.254.169.254", false},
+		{private, "10.0.0.1", true},
+	} {
+		if err := tt.policy.checkHost(tt.host); (err == nil) != tt.ok {
+			t.Errorf("URL mode: checkHost(%s) = %v, want ok=%v", tt.host, err, tt.ok)
+		}
+	}
+	if guarded.allowPrivate() || !private.allowPrivate() || (&networkPolicy{mode: networkProxy}).urlMode(private.urlGuard).allowPrivate() {
+		t.Error("private addresses must only be reachable with url-allow-private and an open policy")
+	}
+}
+
+// proxyClient returns a client fetching through the proxy at proxyURL.
+func proxyClient(t *testing.T, proxyURL string) *http.Client {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func TestFetchProxy_forward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "font")
+	}))
+	defer upstream.Close()
+	upstreamTLS := httptest.NewTLSServer(upstream.Config.Handler)
+	defer upstreamTLS.Close()
+
+	// The upstreams are on loopback: only allowed with a permissive dialer.
+	p := &fetchProxy{
+		policy:    &networkPolicy{mode: networkProxy, allowHosts: []string{"localhost"}},
+		tunnels:   map[net.Conn]bool{},
+		dialer:    &net.Dialer{},
+		transport: &http.Transport{},
+	}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+	defer p.transport.CloseIdleConnections()
+	client := proxyClient(t, proxy.URL)
+
+	for _, srv := range []*httptest.Server{upstream, upstreamTLS} {
+		u := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("%s: %v", u, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "font" {
+			t.Fatalf("%s: status %d body %q", u, resp.StatusCode, body)
+		}
+	}
+	if resp, err := client.Get("http://tracker.example.net/pixel.gif"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("host not in allowlist: %v %v", resp, err)
+	}
+}
+
+func TestFetchProxy_blocked(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("fetched %s", r.URL)
+	}))
+	defer upstream.Close()
+	port := upstream.URL[strings.LastIndex(upstream.URL, ":"):]
+
+	urlMode := (&networkPolicy{mode: networkOpen}).urlMode(testURLGuard(t, func(c *Config) {}))
+	for _, policy := range []*networkPolicy{{mode: networkOffline}, {mode: networkProxy}, urlMode} {
+		mode := policy.mode
+		args, stop, err := policy.start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(args) != 2 || args[0] != "--proxy" {
+			t.Fatalf("%s: args %q", mode, args)
+		}
+		client := proxyClient(t, args[1])
+		for _, u := range []string{
+			upstream.URL,                      // private IP literal
+			"http://localhost" + port,         // resolves to a private IP
+			"http://169.254.169.254/metadata", // cloud metadata
+		} {
+			resp, err := client.Get(u)
+			if err != nil || resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s: %v %v", mode, u, resp, err)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+		// A refused CONNECT fails the request.
+		if _, err := client.Get("https://localhost" + port); err == nil {
+			t.Errorf("%s: tunnel to a private IP", mode)
+		}
+		stop()
+	}
+
+	if args, _, _ := (&networkPolicy{mode: networkOpen}).start(context.Background()); args != nil {
+		t.Fatalf("open: args %q", args)
+	}
+}
+
+func TestPDFHandler_networkPolicy(t *testing.T) {
+	argsFile := writeArgsWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { c.NetworkPolicy = networkOffline })
+	saved := renderNetwork
+	renderNetwork = newNetworkPolicy(config)
+	t.Cleanup(func() { renderNetwork = saved })
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+	if args, _ := os.ReadFile(argsFile); !strings.HasPrefix(string(args), "--proxy http://127.0.0.1:") {
+		t.Fatalf("args %q", args)
+	}
+
+	// Clients cannot point the render elsewhere.
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"proxy": "http://attacker.example.com:3128"}))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+		t.Fatalf("proxy option: status %d body %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Option validation modes, selected with the option-validation setting.
+const (
+	validationStrict = "strict"
+	validationWarn   = "warn"
+	validationOff    = "off"
+)
+
+type optionType int
+
+const (
+	optFlag   optionType = iota // no value
+	optString                   // any non-empty value
+	optInt                      // integer, optionally bounded by min/max
+	optFloat                    // decimal number, optionally bounded by min/max
+	optLength                   // number with an optional unit, e.g. 10mm
+	optEnum                     // one of values (case-insensitive)
+)
+
+type optionSpec struct {
+	typ      optionType
+	min, max float64
+	values   []string
+}
+
+type optionSchema map[string]optionSpec
+
+var lengthPattern = regexp.MustCompile(`^\d+(\.\d+)?(mm|cm|in|px|pt|pc|em|ex)?$`)
+
+var (
+	flagOpt   = optionSpec{typ: optFlag}
+	stringOpt = optionSpec{typ: optString}
+	lengthOpt = optionSpec{typ: optLength}
+)
+
+func intRange(min, max float64) optionSpec {
+	return optionSpec{typ: optInt, min: min, max: max}
+}
+
+func floatRange(min, max float64) optionSpec {
+	return optionSpec{typ: optFloat, min: min, max: max}
+}
+
+func enum(values ...string) optionSpec {
+	return optionSpec{typ: optEnum, values: values}
+}
+
+var loadErrorHandling = enum("abort", "ignore", "skip")
+
+var pageSizes = []string{
+	"A0", "A1", "A2", "A3", "A4", "A5", "A6", "A7", "A8", "A9",
+	"B0", "B1", "B2", "B3", "B4", "B5", "B6", "B7", "B8", "B9", "B10",
+	"C5E", "Comm10E", "DLE", "Executive", "Folio", "Ledger", "Legal", "Letter", "Tabloid",
+}
+
+// Options understood by both wkhtmltopdf (as page options) and wkhtmltoimage.
+var commonOptions = optionSchema{
+	"allow":                        stringOpt,
+	"bypass-proxy-for":             stringOpt,
+	"cache-dir":                    stringOpt,
+	"checkbox-checked-svg":         stringOpt,
+	"checkbox-svg":                 stringOpt,
+	"cookie":                       stringOpt,
+	"cookie-jar":                   stringOpt,
+	"custom-header":                stringOpt,
+	"custom-header-propagation":    flagOpt,
+	"no-custom-header-propagation": flagOpt,
+	"debug-javascript":             flagOpt,
+	"no-debug-javascript":          flagOpt,
+	"encoding":                     stringOpt,
+	"images":                       flagOpt,
+	"no-images":                    flagOpt,
+	"disable-javascript":           flagOpt,
+	"enable-javascript":            flagOpt,
+	"javascript-delay":             intRange(0, 600000),
+	"load-error-handling":          loadErrorHandling,
+	"load-media-error-handling":    loadErrorHandling,
+	"disable-local-file-access":    flagOpt,
+	"enable-local-file-access":     flagOpt,
+	"log-level":                    enum("none", "error", "warn", "info"),
+	"minimum-font-size":            intRange(0, 1000),
+	"password":                     stringOpt,
+	"post":                         stringOpt,
+	"post-file":                    stringOpt,
+	"disable-plugins":              flagOpt,
+	"enable-plugins":               flagOpt,
+	"proxy":                        stringOpt,
+	"proxy-hostname-lookup":        flagOpt,
+	"quiet":                        flagOpt,
+	"radiobutton-checked-svg":      stringOpt,
+	"radiobutton-svg":              stringOpt,
+	"run-script":                   stringOpt,
+	"ssl-crt-path":                 stringOpt,
+	"ssl-key-password":             stringOpt,
+	"ssl-key-path":                 stringOpt,
+	"stop-slow-scripts":            flagOpt,
+	"no-stop-slow-scripts":         flagOpt,
+	"user-style-sheet":             stringOpt,
+	"username":                     stringOpt,
+	"window-status":                stringOpt,
+	"zoom":                         floatRange(0.01, 100),
+}
+
+var pdfGlobalOptions = optionSchema{
+	"collate":            flagOpt,
+	"no-collate":         flagOpt,
+	"copies":             intRange(1, 1000),
+	"dpi":                intRange(1, 2400),
+	"grayscale":          flagOpt,
+	"image-dpi":          intRange(1, 2400),
+	"image-quality":      intRange(0, 100),
+	"lowquality":         flagOpt,
+	"margin-bottom":      lengthOpt,
+	"margin-left":        lengthOpt,
+	"margin-right":       lengthOpt,
+	"margin-top":         lengthOpt,
+	"orientation":        enum("Landscape", "Portrait"),
+	"page-height":        lengthOpt,
+	"page-size":          enum(pageSizes...),
+	"page-width":         lengthOpt,
+	"no-pdf-compression": flagOpt,
+	"title":              stringOpt,
+	"use-xserver":        flagOpt,
+	"outline":            flagOpt,
+	"no-outline":         flagOpt,
+	"outline-depth":      intRange(0, 100),
+	"dump-outline":       stringOpt,
+}
+
+// Options of a wkhtmltopdf page or cover object, next to commonOptions.
+var pdfPageOptions = optionSchema{
+	"background":              flagOpt,
+	"no-background":           flagOpt,
+	"default-header":          flagOpt,
+	"disable-external-links":  flagOpt,
+	"enable-external-links":   flagOpt,
+	"disable-forms":           flagOpt,
+	"enable-forms":            flagOpt,
+	"disable-internal-links":  flagOpt,
+	"enable-internal-links":   flagOpt,
+	"disable-smart-shrinking": flagOpt,
+	"enable-smart-shrinking":  flagOpt,
+	"disable-toc-back-links":  flagOpt,
+	"enable-toc-back-links":   flagOpt,
+	"exclude-from-outline":    flagOpt,
+	"include-in-outline":      flagOpt,
+	"keep-relative-links":     flagOpt,
+	"resolve-relative-links":  flagOpt,
+	"page-offset":             intRange(-100000, 100000),
+	"print-media-type":        flagOpt,
+	"no-print-media-type":     flagOpt,
+	"viewport-size":           stringOpt,
+
+	// header and footer options
+	"footer-center":    stringOpt,
+	"footer-font-name": stringOpt,
+	"footer-font-size": intRange(1, 1000),
+	"footer-html":      stringOpt,
+	"footer-left":      stringOpt,
+	"footer-line":      flagOpt,
+	"no-footer-line":   flagOpt,
+	"footer-right":     stringOpt,
+	"footer-spacing":   floatRange(-1000, 1000),
+	"header-center":    stringOpt,
+	"header-font-name": stringOpt,
+	"header-font-size": intRange(1, 1000),
+	"header-html":      stringOpt,
+	"header-left":      stringOpt,
+	"header-line":      flagOpt,
+	"no-header-line":   flagOpt,
+	"header-right":     stringOpt,
+	"header-spacing":   floatRange(-1000, 1000),
+	"replace":          stringOpt,
+}
+
+var tocOptions = optionSchema{
+	"disable-dotted-lines":  flagOpt,
+	"disable-toc-links":     flagOpt,
+	"toc-header-text":       stringOpt,
+	"toc-level-indentation": lengthOpt,
+	"toc-text-size-shrink":  floatRange(0, 100),
+	"xsl-style-sheet":       stringOpt,
+}
+
+var imageOnlyOptions = optionSchema{
+	"crop-h":              intRange(0, 100000),
+	"crop-w":              intRange(0, 100000),
+	"crop-x":              intRange(0, 100000),
+	"crop-y":              intRange(0, 100000),
+	"format":              enum("png", "jpg", "jpeg", "bmp", "svg"),
+	"height":              intRange(0, 100000),
+	"width":               intRange(0, 100000),
+	"quality":             intRange(0, 100),
+	"disable-smart-width": flagOpt,
+	"enable-smart-width":  flagOpt,
+	"transparent":         flagOpt,
+}
+
+var (
+	pdfOptions   = mergeSchemas(commonOptions, pdfGlobalOptions, pdfPageOptions, tocOptions)
+	imageOptions = mergeSchemas(commonOptions, imageOnlyOptions)
+
+	// Options accepted after a page, cover or toc object.
+	pageObjectOptions = mergeSchemas(commonOptions, pdfPageOptions)
+	tocObjectOptions  = mergeSchemas(commonOptions, pdfPageOptions, tocOptions)
+)
+
+func mergeSchemas(schemas ...optionSchema) optionSchema {
+	out := optionSchema{}
+	for _, schema := range schemas {
+		for name, spec := range schema {
+			out[name] = spec
+		}
+	}
+	return out
+}
+
+// optionError describes a single rejected form field.
+type optionError struct {
+	Field  string `json:"field"`
+	Value  string `json:"value,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// optionValidationError is returned by the multipart parsers in strict mode
+// when one or more fields do not match the option schema.
+type optionValidationError struct {
+	Errors []optionError `json:"errors"`
+}
+
+func (e *optionValidationError) Error() string {
+	fields := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		fields = append(fields, fmt.Sprintf("%s: %s", fe.Field, fe.Reason))
+	}
+	return "invalid options: " + strings.Join(fields, "; ")
+}
+
+func (schema optionSchema) validate(name, value string) error {
+	spec, ok := schema[name]
+	if !ok {
+		return fmt.Errorf("unknown option")
+	}
+
+	if spec.typ == optFlag {
+		if value != "" {
+			return fmt.Errorf("option takes no value")
+		}
+		return nil
+	}
+	if value == "" {
+		return fmt.Errorf("option requires a value")
+	}
+
+	switch spec.typ {
+	case optInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		return checkRange(spec, float64(n))
+	case optFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		return checkRange(spec, f)
+	case optLength:
+		if !lengthPattern.MatchString(value) {
+			return fmt.Errorf("must be a length such as 10mm")
+		}
+	case optEnum:
+		for _, v := range spec.values {
+			if strings.EqualFold(v, value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(spec.values, ", "))
+	}
+	return nil
+}
+
+func checkRange(spec optionSpec, f float64) error {
+	if spec.min == 0 && spec.max == 0 {
+		return nil
+	}
+	if f < spec.min || f > spec.max {
+		return fmt.Errorf("must be between %g and %g", spec.min, spec.max)
+	}
+	return nil
+}
+
+// localFileAccessOptions would widen the local files a render can read.
+// They are set by the server, so clients may not give them unless
+// local-file-access is any.
+var localFileAccessOptions = map[string]bool{
+	"allow":                     true,
+	"enable-local-file-access":  true,
+	"disable-local-file-access": true,
+}
+
+// commandOptions make wkhtmltopdf do something else than rendering the
+// request.
+var commandOptions = map[string]bool{
+	"read-args-from-stdin": true,
+	"dump-default-toc-xsl": true,
+	"extended-help":        true,
+	"help":                 true,
+	"htmldoc":              true,
+	"license":              true,
+	"manpage":              true,
+	"readme":               true,
+	"version":              true,
+}
+
+// pathOptions take the name of a file, read or written by the render. It
+// must be a file of the request, and is passed as its path in the request
+// directory.
+var pathOptions = map[string]bool{
+	"cache-dir":               true,
+	"checkbox-checked-svg":    true,
+	"checkbox-svg":            true,
+	"cookie-jar":              true,
+	"dump-outline":            true,
+	"footer-html":             true,
+	"header-html":             true,
+	"radiobutton-checked-svg": true,
+	"radiobutton-svg":         true,
+	"ssl-crt-path":            true,
+	"ssl-key-path":            true,
+	"user-style-sheet":        true,
+	"xsl-style-sheet":         true,
+}
+
+// pathPairOptions are the pairOptions whose value is a file name.
+var pathPairOptions = map[string]bool{
+	"post-file": true,
+}
+
+// defaultDeniedOptions are rejected unless option-allow names them:
+// run-script runs client JavaScript in every page, and the proxy options
+// route the render fetches around the server.
+var defaultDeniedOptions = map[string]bool{
+	"run-script":            true,
+	"proxy":                 true,
+	"bypass-proxy-for":      true,
+	"proxy-hostname-lookup": true,
+}
+
+var optionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// serverOptionReason reports why clients may not give the option name, or
+// "" if they may: the server sets it, it is denied by default, or
+// option-allow or option-deny exclude it.
+func serverOptionReason(name string) string {
+	switch {
+	case !optionNamePattern.MatchString(name):
+		return "not an option name"
+	case commandOptions[name]:
+		return "not a render option"
+	case localFileAccessOptions[name] && config.LocalFileAccess != localFileAccessAny:
+		return "set by the server: local file access is limited to the request files"
+	case networkOptions[name] && config.NetworkPolicy != networkOpen:
+		return "set by the server: fetches follow the network policy"
+	case defaultDeniedOptions[name] && !slices.Contains(config.OptionAllow, name):
+		return "denied by default: add it to option-allow to accept it"
+	case len(config.OptionAllow) > 0 && !slices.Contains(config.OptionAllow, name):
+		return "not allowed by the server"
+	case slices.Contains(config.OptionDeny, name):
+		return "denied by the server"
+	}
+	return ""
+}
+
+// valueReason reports why value may not be passed with the option name, or
+// "" if it may. Whatever the validation mode, a value given to a flag, or
+// one that wkhtmltopdf would read as another option, would let a client pass
+// options the server denies.
+func valueReason(schema optionSchema, name, value string) string {
+	if spec, ok := schema[name]; ok && spec.typ == optFlag && value != "" {
+		return "option takes no value"
+	}
+	if strings.HasPrefix(value, "-") {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "value may not start with -"
+		}
+	}
+	return ""
+}
+
+// optionChecker collects the bad fields of one request, whose files are in
+// root.
+type optionChecker struct {
+	schema optionSchema
+	mode   string
+	root   string // "" to check file names without resolving them
+	errors []optionError
+	denied []optionError // rejected whatever the mode
+}
+
+func newOptionChecker(schema optionSchema, root string) *optionChecker {
+	return &optionChecker{schema: schema, mode: config.OptionValidation, root: root}
+}
+
+// check checks the option name given value, and returns the value to pass to
+// the render.
+func (c *optionChecker) check(name, value string) string {
+	if reason := serverOptionReason(name); reason != "" {
+		c.deny(name, value, reason)
+		return value
+	}
+	if pairOptions[name] {
+		// As a single field, the next argument would be taken as the
+		// second value.
+		c.deny(name, value, "name/value options are only accepted in a JSON body")
+		return value
+	}
+	if reason := valueReason(c.schema, name, value); reason != "" {
+		c.deny(name, value, reason)
+		return value
+	}
+	if pathOptions[name] {
+		value = c.path(name, value)
+	}
+	if c.mode == validationOff {
+		return value
+	}
+	if err := c.schema.validate(name, value); err != nil {
+		c.errors = append(c.errors, optionError{Field: name, Value: value, Reason: err.Error()})
+	}
+	return value
+}
+
+// checkPair checks the name/value option name given key and value, and
+// returns the value to pass to the render.
+func (c *optionChecker) checkPair(name, key, value string) string {
+	if reason := serverOptionReason(name); reason != "" {
+		c.deny(name, key, reason)
+		return value
+	}
+	for _, v := range []string{key, value} {
+		if reason := valueReason(c.schema, name, v); reason != "" {
+			c.deny(name, v, reason)
+			return value
+		}
+	}
+	if pathPairOptions[name] {
+		value = c.path(name, value)
+	}
+	if c.mode == validationOff {
+		return value
+	}
+	if err := c.schema.validate(name, key); err != nil {
+		c.errors = append(c.errors, optionError{Field: name, Value: key, Reason: err.Error()})
+	}
+	return value
+}
+
+// path returns the path of the request file name, the value of the option
+// field.
+func (c *optionChecker) path(field, name string) string {
+	clean, err := cleanUploadName(name)
+	if err != nil || strings.Contains(name, "://") {
+		c.deny(field, name, "must be the name of a file of the request")
+		return name
+	}
+	if c.root == "" {
+		return clean
+	}
+	return filepath.Join(c.root, filepath.FromSlash(clean))
+}
+
+func (c *optionChecker) deny(field, value, reason string) {
+	c.denied = append(c.denied, optionError{Field: field, Value: value, Reason: reason})
+}
+
+// err reports the collected errors. In warn mode they are only logged,
+// except for the denied options.
+func (c *optionChecker) err(logger *Logger) error {
+	errs := c.denied
+	if len(c.errors) > 0 {
+		if c.mode == validationWarn {
+			logger.Warnf("Ignoring option validation errors: %v", &optionValidationError{Errors: c.errors})
+		} else {
+			errs = append(errs, c.errors...)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &optionValidationError{Errors: errs}
+}
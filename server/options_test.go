@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptionSchema_validate(t *testing.T) {
+	tests := []struct {
+		name, value string
+		ok          bool
+	}{
+		{"margin-top", "20", true},
+		{"margin-top", "10mm", true},
+		{"margin-top", "1.5in", true},
+		{"margin-top", "ten", false},
+		{"margin-tpo", "20", false},
+		{"page-size", "A4", true},
+		{"page-size", "a4", true},
+		{"page-size", "A11", false},
+		{"orientation", "Landscape", true},
+		{"orientation", "sideways", false},
+		{"grayscale", "", true},
+		{"grayscale", "yes", false},
+		{"title", "", false},
+		{"javascript-delay", "500", true},
+		{"javascript-delay", "-1", false},
+		{"zoom", "1.25", true},
+		{"zoom", "x", false},
+	}
+	for _, tt := range tests {
+		err := pdfOptions.validate(tt.name, tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("validate(%q, %q) = %v, want ok=%v", tt.name, tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestOptionSchema_pdfAndImageDiffer(t *testing.T) {
+	if err := imageOptions.validate("margin-top", "10"); err == nil {
+		t.Error("margin-top accepted for wkhtmltoimage")
+	}
+	if err := pdfOptions.validate("crop-w", "10"); err == nil {
+		t.Error("crop-w accepted for wkhtmltopdf")
+	}
+	if err := imageOptions.validate("quality", "40"); err != nil {
+		t.Errorf("quality rejected for wkhtmltoimage: %v", err)
+	}
+}
+
+func newPDFRequest(t *testing.T, fields map[string]string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("<html><body>x</body></html>")); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/pdf", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestPDFHandler_invalidOptions(t *testing.T) {
+	req := newPDFRequest(t, map[string]string{"margin-tpo": "20", "page-size": "A11", "margin-top": "20"})
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d want 400 body %s", rec.Code, rec.Body.String())
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, rec.Body.String())
+	}
+	if body.Code != codeInvalidOption {
+		t.Fatalf("code %q want %q", body.Code, codeInvalidOption)
+	}
+	fields := map[string]bool{}
+	for _, fe := range body.Fields {
+		fields[fe.Field] = true
+	}
+	if len(fields) != 2 || !fields["margin-tpo"] || !fields["page-size"] {
+		t.Fatalf("unexpected errors: %+v", body.Fields)
+	}
+}
+
+func TestPDFHandler_invalidOptionsOff(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.OptionValidation = validationOff })
+	t.Setenv("KWKHTMLTOPDF_BIN", "/bin/true")
+
+	req := newPDFRequest(t, map[string]string{"margin-tpo": "20"})
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code == http.StatusBadRequest {
+		t.Fatalf("option rejected with validation off: %s", rec.Body.String())
+	}
+}
+
+func TestImageHandler_invalidOption(t *testing.T) {
+	t.Setenv("KWKHTMLTOIMAGE_BIN", writeFakeWkhtmltoimage(t))
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("<html></html>")); err != nil {
+		t.Fatal(err)
+	}
+	_ = mw.WriteField("quality", "101")
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/image", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	withTraceID(imageHandler)(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d want 400 body %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPDFHandler_localFileAccessOptions(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	for _, mode := range []string{validationStrict, validationWarn, validationOff} {
+		t.Run(mode, func(t *testing.T) {
+			setTestConfig(t, func(c *Config) { c.OptionValidation = mode })
+
+			req := newPDFRequest(t, map[string]string{"allow": "/", "enable-local-file-access": ""})
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, req)
+
+			var body errorResponse
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if rec.Code != http.StatusBadRequest || body.Code != codeInvalidOption || len(body.Fields) != 2 {
+				t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	setTestConfig(t, func(c *Config) { c.LocalFileAccess = localFileAccessAny })
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"allow": "/"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("local-file-access any: status %d body %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPDFHandler_optionValueInjection(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	for _, mode := range []string{validationStrict, validationWarn, validationOff} {
+		t.Run(mode, func(t *testing.T) {
+			setTestConfig(t, func(c *Config) { c.OptionValidation = mode })
+
+			for name, req := range map[string]*http.Request{
+				"flag value":  newPDFRequest(t, map[string]string{"grayscale": "--enable-local-file-access"}),
+				"dash value":  newPDFRequest(t, map[string]string{"title": "--enable-local-file-access"}),
+				"json flag":   newJSONRequest(t, "/pdf", `{"options": {"grayscale": "--enable-local-file-access"}, "index": "<p>"}`),
+				"json list":   newJSONRequest(t, "/pdf", `{"options": {"title": ["-q"]}, "index": "<p>"}`),
+				"json header": newJSONRequest(t, "/pdf", `{"options": {"custom-header": {"X-A": "--allow"}}, "index": "<p>"}`),
+			} {
+				rec := httptest.NewRecorder()
+				withTraceID(pdfHandler)(rec, req)
+				if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+					t.Errorf("%s: status %d body %s", name, rec.Code, rec.Body.String())
+				}
+			}
+
+			// Negative numbers are values, not options.
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-offset": "-1"}))
+			if rec.Code != http.StatusOK {
+				t.Errorf("negative number: status %d body %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestOptionChecker_paths(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.OptionValidation = validationOff })
+	root := t.TempDir()
+	c := newOptionChecker(pdfOptions, root)
+
+	if got := c.check("user-style-sheet", "css/print.css"); got != filepath.Join(root, "css", "print.css") {
+		t.Errorf("user-style-sheet: %q", got)
+	}
+	if got := c.checkPair("post-file", "statement", "data/statement.csv"); got != filepath.Join(root, "data", "statement.csv") {
+		t.Errorf("post-file: %q", got)
+	}
+	if err := c.err(GlobalLogger); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"/etc/passwd", "../other/cookies.txt", "https://example.com/style.css"} {
+		c.check("cookie-jar", value)
+	}
+	c.checkPair("post-file", "key", "/root/.ssh/id_rsa")
+	var verr *optionValidationError
+	if err := c.err(GlobalLogger); !errors.As(err, &verr) || len(verr.Errors) != 4 {
+		t.Fatalf("paths outside the request: %v", err)
+	}
+}
+
+func TestPDFHandler_defaultDeniedOptions(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) { *c = *defaultConfig() })
+
+	for _, option := range []string{"run-script", "proxy", "bypass-proxy-for", "proxy-hostname-lookup"} {
+		rec := httptest.NewRecorder()
+		withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{option: "x"}))
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+			t.Errorf("%s: status %d code %q", option, rec.Code, rec.Header().Get("X-Error-Code"))
+		}
+	}
+
+	// option-allow opts in.
+	setTestConfig(t, func(c *Config) { c.OptionAllow = []string{"run-script"} })
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"run-script": "window.status = 'ready'"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("allowed run-script: status %d body %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPDFHandler_deniedOptions(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	setTestConfig(t, func(c *Config) {
+		c.OptionValidation = validationOff
+		c.OptionDeny = []string{"run-script"}
+	})
+
+	req := newPDFRequest(t, map[string]string{
+		"run-script":           "alert(1)",
+		"read-args-from-stdin": "",
+		"custom-header":        "X-A",
+		"page-size":            "A4",
+	})
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+	var body errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	fields := map[string]bool{}
+	for _, fe := range body.Fields {
+		fields[fe.Field] = true
+	}
+	if rec.Code != http.StatusBadRequest || len(fields) != 3 || !fields["run-script"] || !fields["read-args-from-stdin"] || !fields["custom-header"] {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+
+	setTestConfig(t, func(c *Config) { c.OptionAllow = []string{"page-size"} })
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A4"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("allowed option: status %d body %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"grayscale": ""}))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("option not in option-allow: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// wkhtmltopdf object types.
+const (
+	pageObject  = "page"
+	coverObject = "cover"
+	tocObject   = "toc"
+)
+
+// maxPages bounds the entries of a pages manifest.
+const maxPages = 1000
+
+// pageSpec is one entry of the pages manifest: a page or cover given as an
+// uploaded file, inline HTML or a URL, or a table of contents, each with its
+// own page options.
+type pageSpec struct {
+	Type    string         `json:"type,omitempty"` // page (default), cover or toc
+	File    string         `json:"file,omitempty"`
+	HTML    *string        `json:"html,omitempty"`
+	URL     string         `json:"url,omitempty"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// pdfObjects returns the wkhtmltopdf objects of a /pdf request, or nil when
+// the request has no page.
+//
+// With a pages manifest, the manifest lists every object in order. Otherwise
+// the objects are the cover.html upload, a table of contents when toc is set
+// or toc.xsl uploaded, then index.html (or url) and the page-N.html uploads
+// in N order.
+func pdfObjects(ctx context.Context, form *renderForm, tmpdir string) ([]string, error) {
+	if len(form.pages) > 0 {
+		return manifestObjects(ctx, form, tmpdir)
+	}
+
+	var objects, pages []string
+	if form.coverPath != "" {
+		objects = append(objects, coverObject, form.coverPath)
+	}
+	if form.toc || form.tocXSLPath != "" {
+		objects = append(objects, tocObject)
+		if form.tocXSLPath != "" {
+			objects = append(objects, "--xsl-style-sheet", form.tocXSLPath)
+		}
+	}
+	if index := form.index(); index != "" {
+		pages = append(pages, index)
+	}
+	numbers := make([]int, 0, len(form.pagePaths))
+	for n := range form.pagePaths {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		pages = append(pages, form.pagePaths[n])
+	}
+
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	return append(objects, pages...), nil
+}
+
+func manifestObjects(ctx context.Context, form *renderForm, tmpdir string) ([]string, error) {
+	logger := loggerFromContext(ctx)
+
+	if len(form.pages) > maxPages {
+		return nil, &optionValidationError{Errors: []optionError{{Field: "pages", Reason: fmt.Sprintf("at most %d entries", maxPages)}}}
+	}
+	var fieldErrs []optionError
+	if form.url != "" {
+		fieldErrs = append(fieldErrs, optionError{Field: "url", Reason: "use a url entry in pages"})
+	}
+	if form.toc {
+		fieldErrs = append(fieldErrs, optionError{Field: "toc", Reason: "use a toc entry in pages"})
+	}
+
+	var objects []string
+	hasPage := false
+	for i, p := range form.pages {
+		field := fmt.Sprintf("pages[%d]", i)
+		typ := cmp.Or(p.Type, pageObject)
+
+		sources := 0
+		for _, set := range []bool{p.File != "", p.HTML != nil, p.URL != ""} {
+			if set {
+				sources++
+			}
+		}
+
+		var input string
+		var schema optionSchema
+		switch typ {
+		case tocObject:
+			if sources > 0 {
+				fieldErrs = append(fieldErrs, optionError{Field: field, Reason: "toc takes no file, html or url"})
+				continue
+			}
+			schema = tocObjectOptions
+		case pageObject, coverObject:
+			if sources != 1 {
+				fieldErrs = append(fieldErrs, optionError{Field: field, Reason: "needs exactly one of file, html or url"})
+				continue
+			}
+			schema = pageObjectOptions
+			switch {
+			case p.File != "":
+				path, err := uploadedFile(tmpdir, p.File)
+				if err != nil {
+					fieldErrs = append(fieldErrs, optionError{Field: field + ".file", Value: p.File, Reason: err.Error()})
+					continue
+				}
+				input = path
+			case p.HTML != nil:
+				// The name is reserved: never overwrite an uploaded file.
+				name := fmt.Sprintf(".page-%d.html", i)
+				input = filepath.Join(tmpdir, name)
+				err := writeNewFile(input, []byte(*p.HTML))
+				if errors.Is(err, os.ErrExist) {
+					fieldErrs = append(fieldErrs, optionError{Field: field + ".html", Reason: name + " is reserved for inline pages and cannot be uploaded"})
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+			default:
+				u, err := remoteURLs.resolve(ctx, p.URL)
+				if err != nil {
+					return nil, err
+				}
+				input = u.String()
+			}
+			hasPage = hasPage || typ == pageObject
+		default:
+			fieldErrs = append(fieldErrs, optionError{Field: field + ".type", Value: p.Type, Reason: "must be page, cover or toc"})
+			continue
+		}
+
+		args, err := jsonOptionArgs(logger, p.Options, schema, tmpdir)
+		if err != nil {
+			var optErr *optionValidationError
+			if !errors.As(err, &optErr) {
+				return nil, err
+			}
+			for _, fe := range optErr.Errors {
+				fe.Field = field + ".options." + fe.Field
+				fieldErrs = append(fieldErrs, fe)
+			}
+			continue
+		}
+		if _, ok := p.Options["xsl-style-sheet"]; typ == tocObject && !ok && form.tocXSLPath != "" {
+			args = append(args, "--xsl-style-sheet", form.tocXSLPath)
+		}
+
+		objects = append(objects, typ)
+		if input != "" {
+			objects = append(objects, input)
+		}
+		objects = append(objects, args...)
+	}
+
+	if len(fieldErrs) > 0 {
+		return nil, &optionValidationError{Errors: fieldErrs}
+	}
+	if !hasPage {
+		return nil, nil
+	}
+	return objects, nil
+}
+
+// writeNewFile writes data to path, failing with os.ErrExist if it exists.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
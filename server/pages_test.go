@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// parsePDFForm parses a multipart /pdf body made of files and fields.
+func parsePDFForm(t *testing.T, files []string, fields map[string]string) (*renderForm, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("<html>" + name + "</html>"))
+	}
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+
+	tmpdir := t.TempDir()
+	form, err := parseMultipartForm(context.Background(), multipart.NewReader(&buf, mw.Boundary()), tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form, tmpdir
+}
+
+func TestPDFObjects_files(t *testing.T) {
+	form, tmpdir := parsePDFForm(t,
+		[]string{"page-10.html", "index.html", "page-2.html", "cover.html", "toc.xsl", "page-01.html"},
+		map[string]string{"toc": ""})
+
+	objects, err := pdfObjects(context.Background(), form, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(tmpdir, name) }
+	want := []string{
+		"cover", path("cover.html"),
+		"toc", "--xsl-style-sheet", path("toc.xsl"),
+		path("index.html"), path("page-2.html"), path("page-10.html"),
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Fatalf("objects %q\nwant %q", objects, want)
+	}
+}
+
+func TestPDFObjects_manifest(t *testing.T) {
+	manifest := `[
+		{"type": "cover", "file": "front.html"},
+		{"type": "toc", "options": {"toc-header-text": "Contents"}},
+		{"file": "agreement.html", "options": {"zoom": 1.2, "print-media-type": true}},
+		{"html": "<html>annex</html>"}
+	]`
+	form, tmpdir := parsePDFForm(t, []string{"front.html", "agreement.html", "toc.xsl"}, map[string]string{"pages": manifest})
+
+	objects, err := pdfObjects(context.Background(), form, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(tmpdir, name) }
+	want := []string{
+		"cover", path("front.html"),
+		"toc", "--toc-header-text", "Contents", "--xsl-style-sheet", path("toc.xsl"),
+		"page", path("agreement.html"), "--print-media-type", "--zoom", "1.2",
+		"page", path(".page-3.html"),
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Fatalf("objects %q\nwant %q", objects, want)
+	}
+}
+
+func TestPDFObjects_manifestErrors(t *testing.T) {
+	manifest := `[
+		{"file": "missing.html"},
+		{"type": "appendix", "file": "a.html"},
+		{"type": "toc", "file": "a.html"},
+		{"file": "a.html", "html": "<p>"},
+		{"file": "a.html", "options": {"page-size": "A4"}},
+		{"html": "<html>annex</html>"}
+	]`
+	form, tmpdir := parsePDFForm(t, []string{"a.html", ".page-5.html"}, map[string]string{"pages": manifest})
+
+	_, err := pdfObjects(context.Background(), form, tmpdir)
+	optErr, ok := err.(*optionValidationError)
+	if !ok {
+		t.Fatalf("error %v, want *optionValidationError", err)
+	}
+	var fields []string
+	for _, fe := range optErr.Errors {
+		fields = append(fields, fe.Field)
+	}
+	want := []string{"pages[0].file", "pages[1].type", "pages[2]", "pages[3]", "pages[4].options.page-size", "pages[5].html"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("fields %q\nwant %q", fields, want)
+	}
+	// The upload named like the inline page is left alone.
+	if data, _ := os.ReadFile(filepath.Join(tmpdir, ".page-5.html")); string(data) != "<html>.page-5.html</html>" {
+		t.Fatalf(".page-5.html %q", data)
+	}
+}
+
+func TestPDFHandler_pagesOnly(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range []string{"page-1.html", "page-2.html"} {
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte("<html></html>"))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/pdf", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+}
+
+// TestPDFHandler_pagesURLProxied checks that manifest url pages are fetched
+// through the fetch proxy: a page that redirects to a denied host once it
+// passed the resolve check does not reach it.
+func TestPDFHandler_pagesURLProxied(t *testing.T) {
+	curl, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl not found")
+	}
+	secret := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the render fetched %s", r.URL)
+	}))
+	defer secret.Close()
+	var fetches atomic.Int32
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			http.Redirect(w, r, strings.Replace(secret.URL, "127.0.0.1", "localhost", 1)+"/latest/meta-data", http.StatusFound)
+			return
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	defer page.Close()
+
+	// A fake wkhtmltopdf fetching the last URL argument with its --proxy.
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fake-wkhtmltopdf.sh")
+	script := "#!/bin/sh\n" +
+		"prev=; for a in \"$@\"; do\n" +
+		"  [ \"$prev\" = --proxy ] && PROXY=$a\n" +
+		"  case \"$prev $a\" in --proxy*) ;; *\\ http://*) URL=$a ;; esac\n" +
+		"  prev=$a; OUT=$a\n" +
+		"done\n" +
+		"env -u NO_PROXY -u no_proxy " + curl + " -s -L ${PROXY:+--proxy $PROXY} \"$URL\" > /dev/null\n" +
+		"printf '%s' '" + fakePDF + "' > \"$OUT\"\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", bin)
+
+	saved := remoteURLs
+	remoteURLs = testURLGuard(t, func(c *Config) {
+		c.URLAllowPrivate = true
+		c.URLDenyHosts = []string{"localhost"}
+	})
+	t.Cleanup(func() { remoteURLs = saved })
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"pages": [{"url": "`+page.URL+`/annex"}]}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+	if fetches.Load() < 2 {
+		t.Fatal("the render did not fetch the page")
+	}
+}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPDFHandler_renderTimeoutKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	bin := filepath.Join(dir, "fake-wkhtmltopdf.sh")
+	// The fake forks a child, like wkhtmltopdf does, and hangs.
+	script := "#!/bin/sh\nsleep 30 &\necho $! > " + pidFile + "\nwait\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", bin)
+
+	req := newPDFRequest(t, nil)
+	req.Header.Set("X-Render-Timeout", "0.3")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	withTraceID(pdfHandler)(rec, req)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("render not stopped after %v", elapsed)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d want 504 body %s", rec.Code, rec.Body.String())
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != codeRenderTimeout {
+		t.Fatalf("unexpected body %s (%v)", rec.Body.String(), err)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The child is reaped by init once killed; give it a moment.
+	deadline := time.Now().Add(2 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %d still running", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
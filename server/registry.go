@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// templateRegistry stores the named templates, nil unless template-store-dir
+// is set. main opens it from the effective config.
+var templateRegistry templateStore
+
+// newTemplateStore opens the registry selected by the config, or returns nil
+// when the registry is disabled.
+func newTemplateStore(cfg *Config) (templateStore, error) {
+	if cfg.TemplateStoreDir == "" {
+		return nil, nil
+	}
+	return newDiskTemplateStore(cfg.TemplateStoreDir)
+}
+
+// templateError maps a registry error to the error reported to the client.
+func templateError(err error) error {
+	if errors.Is(err, errTemplateNotFound) {
+		return newAPIError(http.StatusNotFound, codeTemplateNotFound, err)
+	}
+	return err
+}
+
+// ownTemplate returns errTemplateNotFound unless tv was registered by the
+// client of ctx, so that other clients cannot tell it exists.
+func ownTemplate(ctx context.Context, tv *templateVersion) error {
+	if tv.ClientID != clientIDFromContext(ctx) {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+// registry returns the template registry, or an error if it is disabled.
+func registry() (templateStore, error) {
+	if templateRegistry == nil {
+		return nil, newAPIError(http.StatusNotFound, codeTemplateNotFound, errors.New("the template registry is disabled"))
+	}
+	return templateRegistry, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// templatesHandler serves GET /templates, the latest version of every
+// template.
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet {
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+	store, err := registry()
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+
+	names, err := store.Names()
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+	templates := []*templateVersion{}
+	for _, name := range names {
+		tv, err := store.Get(name, 0)
+		if err == nil {
+			err = ownTemplate(ctx, tv)
+		}
+		if errors.Is(err, errTemplateNotFound) {
+			continue // deleted meanwhile, or another client's
+		}
+		if err != nil {
+			httpError(ctx, w, err)
+			return
+		}
+		templates = append(templates, tv)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"templates": templates})
+}
+
+// templateHandler serves /templates/{name}: PUT registers a new version, GET
+// lists the versions and DELETE removes them all.
+func templateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	store, err := registry()
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodPut:
+		tv, err := putTemplate(ctx, store, name, r)
+		if err != nil {
+			httpError(ctx, w, err)
+			return
+		}
+		loggerFromContext(ctx).Infof("Registered template %s version %d (sha256 %s)", tv.Name, tv.Version, tv.SHA256)
+		w.Header().Set("Location", fmt.Sprintf("/templates/%s/versions/%d", tv.Name, tv.Version))
+		writeJSON(w, http.StatusCreated, tv)
+	case http.MethodGet:
+		versions, err := store.Versions(name)
+		if err == nil {
+			err = ownTemplate(ctx, versions[len(versions)-1])
+		}
+		if err != nil {
+			httpError(ctx, w, templateError(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"name": name, "versions": versions})
+	case http.MethodDelete:
+		tv, err := store.Get(name, 0)
+		if err == nil {
+			err = ownTemplate(ctx, tv)
+		}
+		if err == nil {
+			err = store.Delete(name, 0)
+		}
+		if err != nil {
+			httpError(ctx, w, templateError(err))
+			return
+		}
+		loggerFromContext(ctx).Infof("Deleted template %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+	}
+}
+
+// templateVersionHandler serves GET and DELETE
+// /templates/{name}/versions/{version}.
+func templateVersionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	store, err := registry()
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+	name := r.PathValue("name")
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version < 1 {
+		httpError(ctx, w, newAPIError(http.StatusNotFound, codeTemplateNotFound, errTemplateNotFound))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tv, err := store.Get(name, version)
+		if err == nil {
+			err = ownTemplate(ctx, tv)
+		}
+		if err != nil {
+			httpError(ctx, w, templateError(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, tv)
+	case http.MethodDelete:
+		tv, err := store.Get(name, version)
+		if err == nil {
+			err = ownTemplate(ctx, tv)
+		}
+		if err == nil {
+			err = store.Delete(name, version)
+		}
+		if err != nil {
+			httpError(ctx, w, templateError(err))
+			return
+		}
+		loggerFromContext(ctx).Infof("Deleted template %s version %d", name, version)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+	}
+}
+
+// putTemplate reads a template registration, a multipart form with a bundle
+// part and optional entrypoint and options (JSON object) fields, checks it
+// and stores it as a new version.
+func putTemplate(ctx context.Context, store templateStore, name string, r *http.Request) (*templateVersion, error) {
+	logger := loggerFromContext(ctx)
+
+	if !templateNamePattern.MatchString(name) {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidTemplate, fmt.Errorf("invalid template name %q: use lowercase letters, digits, '.', '_' and '-'", name))
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidMultipart, err)
+	}
+	tmpdir, cleanup, err := activeRenders.tempDir("kwktpl")
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeTempDirFailed, err)
+	}
+	defer cleanup()
+
+	tv := &templateVersion{Name: name, CreatedAt: time.Now().UTC(), ClientID: clientIDFromContext(ctx)}
+	bundlePath := filepath.Join(tmpdir, "template.bundle")
+	bundled := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, parseFormError(err)
+		}
+		switch part.FormName() {
+		case "bundle":
+			if bundled {
+				return nil, bundleError("only one bundle part is allowed")
+			}
+			bundled = true
+			if tv.Size, tv.SHA256, err = saveBundle(part, bundlePath); err != nil {
+				return nil, parseFormError(err)
+			}
+		case "entrypoint":
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return nil, parseFormError(err)
+			}
+			tv.Entrypoint = string(value)
+		case "options":
+			dec := json.NewDecoder(part)
+			dec.UseNumber()
+			if err := dec.Decode(&tv.Options); err != nil {
+				return nil, newAPIError(http.StatusBadRequest, codeInvalidJSON, fmt.Errorf("invalid options: %w", err))
+			}
+		default:
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidTemplate, fmt.Errorf("unknown field %q: want bundle, entrypoint or options", part.FormName()))
+		}
+	}
+	if !bundled {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidTemplate, errors.New("a bundle part is required"))
+	}
+
+	// Check the template as a render would use it.
+	if _, err := jsonOptionArgs(logger, tv.Options, pdfOptions, ""); err != nil {
+		return nil, parseFormError(err)
+	}
+	checkDir := filepath.Join(tmpdir, "check")
+	if err := os.Mkdir(checkDir, 0o700); err != nil {
+		return nil, err
+	}
+	bundle, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	form := &renderForm{entrypoint: tv.Entrypoint}
+	err = loadTemplateBundle(bundle, checkDir, form)
+	bundle.Close()
+	if err == nil {
+		err = checkTemplates(form)
+	}
+	if err != nil {
+		return nil, parseFormError(err)
+	}
+
+	if err := store.Put(tv, bundlePath); err != nil {
+		return nil, templateError(err)
+	}
+	return tv, nil
+}
+
+// saveBundle copies a bundle to path and returns its size and SHA-256.
+func saveBundle(r io.Reader, path string) (int64, string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// loadTemplateBundle extracts a template bundle to tmpdir into form, which
+// must then have a main document.
+func loadTemplateBundle(bundle io.Reader, tmpdir string, form *renderForm) error {
+	if err := extractBundle(bundle, tmpdir, form.addFile); err != nil {
+		return err
+	}
+	if err := form.useEntrypoint(tmpdir); err != nil {
+		return err
+	}
+	if form.indexPath == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidTemplate, errors.New("the bundle has no index.html; set entrypoint"))
+	}
+	return nil
+}
+
+// templateRenderRequest is the JSON body of POST /render/{name}.
+type templateRenderRequest struct {
+	Version int             `json:"version"` // 0 for the latest
+	Data    json.RawMessage `json:"data"`
+	Options map[string]any  `json:"options"` // override the template options
+}
+
+// renderTemplateHandler serves POST /render/{name}: it renders a registered
+// template as a PDF against the data of the request. The template version is
+// logged with every line of the render, counted in the metrics and returned
+// in X-Template-Version.
+func renderTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := loggerFromContext(ctx)
+
+	if r.Method != http.MethodPost {
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
+		return
+	}
+	store, err := registry()
+	if err != nil {
+		httpError(ctx, w, err)
+		return
+	}
+
+	var req templateRenderRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		httpError(ctx, w, newAPIError(http.StatusBadRequest, codeInvalidJSON, fmt.Errorf("invalid JSON body: %w", err)))
+		return
+	}
+	tv, err := store.Get(r.PathValue("name"), req.Version)
+	if err == nil {
+		err = ownTemplate(ctx, tv)
+	}
+	if err != nil {
+		httpError(ctx, w, templateError(err))
+		return
+	}
+
+	logger = &Logger{Entry: logger.WithField("template", tv.Name).WithField("template-version", tv.Version)}
+	ctx = context.WithValue(ctx, LoggerContextKey, logger)
+	logger.Infof("Rendering template %s version %d (sha256 %s)", tv.Name, tv.Version, tv.SHA256)
+
+	w.Header().Set("X-Template-Version", strconv.Itoa(tv.Version))
+	rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	servePDF(rec, r.WithContext(ctx), func(ctx context.Context, r *http.Request, tmpdir string) (*preparedRender, error) {
+		return prepareTemplate(ctx, r, tmpdir, store, tv, &req)
+	})
+	templateRenders.WithLabelValues(tv.Name, strconv.Itoa(tv.Version), strconv.Itoa(rec.statusCode)).Inc()
+}
+
+// prepareTemplate extracts a registered template to tmpdir and prepares its
+// render with the options and data of req.
+func prepareTemplate(ctx context.Context, r *http.Request, tmpdir string, store templateStore, tv *templateVersion, req *templateRenderRequest) (*preparedRender, error) {
+	logger := loggerFromContext(ctx)
+
+	timeout, err := renderTimeout(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := store.OpenBundle(tv.Name, tv.Version)
+	if err != nil {
+		return nil, templateError(err)
+	}
+	defer bundle.Close()
+	form := &renderForm{entrypoint: tv.Entrypoint}
+	if err := loadTemplateBundle(bundle, tmpdir, form); err != nil {
+		return nil, parseFormError(err)
+	}
+
+	options := maps.Clone(tv.Options)
+	if options == nil {
+		options = map[string]any{}
+	}
+	maps.Copy(options, req.Options)
+	if form.args, err = jsonOptionArgs(logger, options, pdfOptions, tmpdir); err != nil {
+		return nil, parseFormError(err)
+	}
+	// Registered templates are always executed, so that a request without
+	// data fails on the missing keys instead of rendering the raw source.
+	form.data = []byte("{}")
+	if len(req.Data) > 0 && string(req.Data) != "null" {
+		form.data = req.Data
+	}
+	return preparePDFForm(ctx, form, tmpdir, timeout)
+}
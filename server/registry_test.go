@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func useTemplateRegistry(t *testing.T) *diskTemplateStore {
+	t.Helper()
+	store, err := newDiskTemplateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := templateRegistry
+	templateRegistry = store
+	t.Cleanup(func() { templateRegistry = saved })
+	return store
+}
+
+func newTemplateRequest(t *testing.T, name string, bundle []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if bundle != nil {
+		fw, _ := mw.CreateFormFile("bundle", "template.zip")
+		fw.Write(bundle)
+	}
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPut, "/templates/"+name, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+var invoiceBundle = []bundleEntry{
+	{name: "invoice.html", body: "<p>{{.customer}} {{inr .total}}</p>"},
+	{name: "footer.html", body: "<p>{{.number}}</p>"},
+}
+
+func TestTemplateRegistry(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	useTemplateRegistry(t)
+
+	// Register two versions.
+	for v := 1; v <= 2; v++ {
+		rec := serve(newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), map[string]string{
+			"entrypoint": "invoice.html",
+			"options":    `{"page-size": "A4", "margin-top": 10}`,
+		}))
+		var tv templateVersion
+		json.NewDecoder(rec.Body).Decode(&tv)
+		if rec.Code != http.StatusCreated || tv.Version != v || tv.SHA256 == "" || tv.Entrypoint != "invoice.html" {
+			t.Fatalf("PUT: status %d %+v", rec.Code, tv)
+		}
+		if loc := rec.Header().Get("Location"); loc != "/templates/invoice/versions/"+string(rune('0'+v)) {
+			t.Fatalf("Location %q", loc)
+		}
+	}
+
+	// Render the latest and a pinned version.
+	for body, version := range map[string]string{
+		`{"data": {"customer": "A", "total": 10, "number": "INV-1"}}`:                            "2",
+		`{"version": 1, "data": {"customer": "A", "total": 10, "number": "INV-1"}}`:              "1",
+		`{"data": {"customer": "A", "total": 10, "number": "1"}, "options": {"margin-top": 20}}`: "2",
+	} {
+		req := newJSONRequest(t, "/render/invoice", body)
+		rec := serve(req)
+		if rec.Code != http.StatusOK || rec.Body.String() != fakePDF || rec.Header().Get("X-Template-Version") != version {
+			t.Fatalf("render %s: status %d version %q body %q", body, rec.Code, rec.Header().Get("X-Template-Version"), rec.Body.String())
+		}
+	}
+
+	// A missing data key fails the render.
+	rec := serve(newJSONRequest(t, "/render/invoice", `{"data": {"customer": "A"}}`))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeTemplateError {
+		t.Fatalf("missing key: status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+	// So does a request without data.
+	for _, body := range []string{`{}`, `{"data": null}`} {
+		rec = serve(newJSONRequest(t, "/render/invoice", body))
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeTemplateError {
+			t.Fatalf("%s: status %d code %q", body, rec.Code, rec.Header().Get("X-Error-Code"))
+		}
+	}
+
+	// Delete version 2: version 1 becomes the latest, and numbers are not reused.
+	rec = serve(httptest.NewRequest(http.MethodDelete, "/templates/invoice/versions/2", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE version: status %d", rec.Code)
+	}
+	rec = serve(httptest.NewRequest(http.MethodGet, "/templates", nil))
+	var list struct{ Templates []templateVersion }
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Templates) != 1 || list.Templates[0].Version != 1 {
+		t.Fatalf("list %+v", list)
+	}
+	rec = serve(newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), map[string]string{"entrypoint": "invoice.html"}))
+	rec = serve(httptest.NewRequest(http.MethodGet, "/templates/invoice", nil))
+	var versions struct{ Versions []templateVersion }
+	json.NewDecoder(rec.Body).Decode(&versions)
+	var numbers []int
+	for _, tv := range versions.Versions {
+		numbers = append(numbers, tv.Version)
+	}
+	if !reflect.DeepEqual(numbers, []int{1, 3}) {
+		t.Fatalf("versions %v", numbers)
+	}
+
+	// Delete the template.
+	rec = serve(httptest.NewRequest(http.MethodDelete, "/templates/invoice", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", rec.Code)
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/templates/invoice", nil),
+		httptest.NewRequest(http.MethodGet, "/templates/invoice/versions/1", nil),
+		newJSONRequest(t, "/render/invoice", `{}`),
+	} {
+		if rec := serve(req); rec.Code != http.StatusNotFound || rec.Header().Get("X-Error-Code") != codeTemplateNotFound {
+			t.Fatalf("%s %s: status %d", req.Method, req.URL, rec.Code)
+		}
+	}
+}
+
+func TestTemplateRegistry_owner(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+	useTemplateRegistry(t)
+	useAuth(t, func(c *Config) {
+		c.Auth = []string{authAPIKey}
+		c.AuthAPIKeysFile = writeAuthFile(t, "keys", "acme k-acme\nglobex k-globex\n")
+	})
+	as := func(key string, req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("X-API-Key", key)
+		return serve(req)
+	}
+
+	rec := as("k-acme", newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), map[string]string{"entrypoint": "invoice.html"}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT: status %d body %s", rec.Code, rec.Body.String())
+	}
+
+	// Another client cannot see, render, extend or delete the template.
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/templates/invoice", nil),
+		httptest.NewRequest(http.MethodGet, "/templates/invoice/versions/1", nil),
+		newJSONRequest(t, "/render/invoice", `{"data": {"customer": "A", "total": 10, "number": "1"}}`),
+		newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), map[string]string{"entrypoint": "invoice.html"}),
+		httptest.NewRequest(http.MethodDelete, "/templates/invoice/versions/1", nil),
+		httptest.NewRequest(http.MethodDelete, "/templates/invoice", nil),
+	} {
+		if rec := as("k-globex", req); rec.Code != http.StatusNotFound || rec.Header().Get("X-Error-Code") != codeTemplateNotFound {
+			t.Fatalf("%s %s: status %d code %q", req.Method, req.URL, rec.Code, rec.Header().Get("X-Error-Code"))
+		}
+	}
+	var list struct{ Templates []templateVersion }
+	json.NewDecoder(as("k-globex", httptest.NewRequest(http.MethodGet, "/templates", nil)).Body).Decode(&list)
+	if len(list.Templates) != 0 {
+		t.Fatalf("globex lists %+v", list.Templates)
+	}
+
+	// The owner still can.
+	json.NewDecoder(as("k-acme", httptest.NewRequest(http.MethodGet, "/templates", nil)).Body).Decode(&list)
+	if len(list.Templates) != 1 || list.Templates[0].Version != 1 || list.Templates[0].ClientID != "acme" {
+		t.Fatalf("acme lists %+v", list.Templates)
+	}
+	rec = as("k-acme", newJSONRequest(t, "/render/invoice", `{"data": {"customer": "A", "total": 10, "number": "1"}}`))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("render: status %d body %q", rec.Code, rec.Body.String())
+	}
+	if rec := as("k-acme", httptest.NewRequest(http.MethodDelete, "/templates/invoice", nil)); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", rec.Code)
+	}
+}
+
+func TestTemplateRegistry_invalid(t *testing.T) {
+	useTemplateRegistry(t)
+
+	cases := map[string]struct {
+		req  *http.Request
+		code string
+	}{
+		"bad name":       {newTemplateRequest(t, "Invoice", zipBundle(t, invoiceBundle...), nil), codeInvalidTemplate},
+		"no bundle":      {newTemplateRequest(t, "invoice", nil, map[string]string{"entrypoint": "invoice.html"}), codeInvalidTemplate},
+		"no index":       {newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), nil), codeInvalidTemplate},
+		"bad entrypoint": {newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), map[string]string{"entrypoint": "x.html"}), codeInvalidOption},
+		"bad option":     {newTemplateRequest(t, "invoice", zipBundle(t, invoiceBundle...), map[string]string{"entrypoint": "invoice.html", "options": `{"page-size": "A11"}`}), codeInvalidOption},
+		"syntax error":   {newTemplateRequest(t, "invoice", zipBundle(t, bundleEntry{name: "index.html", body: "{{if .a}}"}), nil), codeTemplateError},
+		"bad bundle":     {newTemplateRequest(t, "invoice", []byte("not a zip"), nil), codeInvalidBundle},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rec := serve(tc.req)
+			var resp errorResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Code != tc.code {
+				t.Fatalf("status %d code %q (%s), want %s", rec.Code, resp.Code, resp.Message, tc.code)
+			}
+		})
+	}
+
+	names, err := templateRegistry.Names()
+	if err != nil || len(names) != 0 {
+		t.Fatalf("names %q %v", names, err)
+	}
+}
+
+func TestTemplateRegistry_disabled(t *testing.T) {
+	saved := templateRegistry
+	templateRegistry = nil
+	t.Cleanup(func() { templateRegistry = saved })
+
+	rec := serve(httptest.NewRequest(http.MethodGet, "/templates", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "disabled") {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTemplateNotFound = errors.New("template not found")
+
+// templateNamePattern restricts template names to safe path elements.
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// templateVersion describes one registered version of a named template.
+type templateVersion struct {
+	Name       string         `json:"name"`
+	Version    int            `json:"version"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Entrypoint string         `json:"entrypoint,omitempty"`
+	Options    map[string]any `json:"options,omitempty"`   // default options, in the JSON body syntax
+	Size       int64          `json:"size"`                // bundle size in bytes
+	SHA256     string         `json:"sha256"`              // bundle digest
+	ClientID   string         `json:"client_id,omitempty"` // the authenticated client that registered the template
+}
+
+// templateStore persists the template registry. Versions are numbered from 1
+// per name and never reused, even once deleted. Implementations must be safe
+// for concurrent use.
+type templateStore interface {
+	// Put stores the bundle at path as a new version of tv.Name, setting
+	// tv.Version. The file at path may be moved. It returns
+	// errTemplateNotFound if the template belongs to another client than
+	// tv.ClientID.
+	Put(tv *templateVersion, path string) error
+	// Get returns the version, or the latest one when version is 0, or
+	// errTemplateNotFound.
+	Get(name string, version int) (*templateVersion, error)
+	// Versions returns the versions of a template in order, or
+	// errTemplateNotFound if there is none.
+	Versions(name string) ([]*templateVersion, error)
+	// OpenBundle opens the bundle of a version.
+	OpenBundle(name string, version int) (io.ReadCloser, error)
+	// Names returns the names of the templates that have a version.
+	Names() ([]string, error)
+	// Delete removes a version, or every version when version is 0.
+	Delete(name string, version int) error
+}
+
+// diskTemplateStore keeps each version as <name>/<version>.json and
+// <name>/<version>.bundle under dir. <name>/last holds the last version
+// number handed out.
+type diskTemplateStore struct {
+	dir string
+	mu  sync.Mutex // serializes version allocation and deletion
+}
+
+func newDiskTemplateStore(dir string) (*diskTemplateStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskTemplateStore{dir: dir}, nil
+}
+
+func (s *diskTemplateStore) path(name string, version int, ext string) (string, error) {
+	if !templateNamePattern.MatchString(name) || version < 0 {
+		return "", errTemplateNotFound
+	}
+	if version == 0 {
+		return filepath.Join(s.dir, name, ext), nil
+	}
+	return filepath.Join(s.dir, name, strconv.Itoa(version)+ext), nil
+}
+
+func (s *diskTemplateStore) Put(tv *templateVersion, path string) error {
+	if !templateNamePattern.MatchString(tv.Name) {
+		return fmt.Errorf("invalid template name %q", tv.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if versions, err := s.Versions(tv.Name); err == nil && versions[len(versions)-1].ClientID != tv.ClientID {
+		return errTemplateNotFound
+	} else if err != nil && !errors.Is(err, errTemplateNotFound) {
+		return err
+	}
+	lastPath, _ := s.path(tv.Name, 0, "last")
+	if err := os.MkdirAll(filepath.Dir(lastPath), 0o700); err != nil {
+		return err
+	}
+	last := 0
+	if data, err := os.ReadFile(lastPath); err == nil {
+		last, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	tv.Version = last + 1
+
+	bundlePath, _ := s.path(tv.Name, tv.Version, ".bundle")
+	if err := moveFile(path, bundlePath); err != nil {
+		return err
+	}
+	data, err := json.Marshal(tv)
+	if err != nil {
+		return err
+	}
+	// The metadata is written last: a version exists once it is readable.
+	metaPath, _ := s.path(tv.Name, tv.Version, ".json")
+	if err := writeFileAtomic(metaPath, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(lastPath, []byte(strconv.Itoa(tv.Version)))
+}
+
+func (s *diskTemplateStore) Get(name string, version int) (*templateVersion, error) {
+	if version == 0 {
+		versions, err := s.Versions(name)
+		if err != nil {
+			return nil, err
+		}
+		return versions[len(versions)-1], nil
+	}
+	path, err := s.path(name, version, ".json")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Options keep their JSON numbers, as in a request.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tv templateVersion
+	if err := dec.Decode(&tv); err != nil {
+		return nil, fmt.Errorf("template %s version %d: %w", name, version, err)
+	}
+	return &tv, nil
+}
+
+func (s *diskTemplateStore) Versions(name string) ([]*templateVersion, error) {
+	if !templateNamePattern.MatchString(name) {
+		return nil, errTemplateNotFound
+	}
+	entries, err := os.ReadDir(filepath.Join(s.dir, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var numbers []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json")); err == nil && strings.HasSuffix(e.Name(), ".json") && n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, errTemplateNotFound
+	}
+	sort.Ints(numbers)
+
+	versions := make([]*templateVersion, 0, len(numbers))
+	for _, n := range numbers {
+		tv, err := s.Get(name, n)
+		if errors.Is(err, errTemplateNotFound) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, tv)
+	}
+	if len(versions) == 0 {
+		return nil, errTemplateNotFound
+	}
+	return versions, nil
+}
+
+func (s *diskTemplateStore) OpenBundle(name string, version int) (io.ReadCloser, error) {
+	path, err := s.path(name, version, ".bundle")
+	if err != nil || version == 0 {
+		return nil, errTemplateNotFound
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errTemplateNotFound
+	}
+	return f, err
+}
+
+func (s *diskTemplateStore) Names() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() || !templateNamePattern.MatchString(e.Name()) {
+			continue
+		}
+		if _, err := s.Versions(e.Name()); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *diskTemplateStore) Delete(name string, version int) error {
+	versions, err := s.Versions(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	var errs []error
+	for _, tv := range versions {
+		if version != 0 && tv.Version != version {
+			continue
+		}
+		found = true
+		// The metadata goes first, so that a version is never listed
+		// without its bundle.
+		for _, ext := range []string{".json", ".bundle"} {
+			path, _ := s.path(name, tv.Version, ext)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if !found {
+		return errTemplateNotFound
+	}
+	return errors.Join(errs...)
+}
+
+// writeFileAtomic writes and renames data to path, so that readers never see
+// a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// moveFile renames src to dst, copying it when they are on different
+// filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// renderResult is the output of a successful render, spooled to a file in the
+// request tmpdir so that memory use does not grow with the document size.
+type renderResult struct {
+	Path            string
+	ContentType     string
+	Size            int64
+	FailedResources []string
+
+	CacheKey string // render cache key, "" when the cache is off
+	Cached   bool   // served from the render cache
+}
+
+// renderForm is a parsed /pdf or /image request body, multipart or JSON.
+type renderForm struct {
+	args []string // option arguments
+
+	// Documents uploaded to the request tmpdir.
+	indexPath, headerPath, footerPath string
+	entrypoint                        string // main document, instead of index.html
+	data                              []byte // template data, see applyTemplates
+	// Remote documents, in URL mode.
+	url, headerURL, footerURL string
+
+	// Multi-document /pdf requests, see pdfObjects.
+	coverPath  string
+	tocXSLPath string
+	pagePaths  map[int]string // page-N.html uploads by N
+	toc        bool
+	pages      []pageSpec // pages manifest
+}
+
+// setField records the reserved form fields that are not wkhtmltopdf
+// options and reports whether name was one of them.
+func (f *renderForm) setField(name, value string) (bool, error) {
+	switch name {
+	case "url":
+		f.url = value
+	case "header-url":
+		f.headerURL = value
+	case "footer-url":
+		f.footerURL = value
+	case "entrypoint":
+		f.entrypoint = value
+	case "data":
+		f.data = []byte(value)
+	case "toc":
+		toc, err := strconv.ParseBool(cmp.Or(value, "true"))
+		if err != nil {
+			return true, &optionValidationError{Errors: []optionError{{Field: name, Value: value, Reason: "must be empty or a boolean"}}}
+		}
+		f.toc = toc
+	case "pages":
+		dec := json.NewDecoder(strings.NewReader(value))
+		dec.DisallowUnknownFields()
+		dec.UseNumber()
+		if err := dec.Decode(&f.pages); err != nil {
+			return true, &optionValidationError{Errors: []optionError{{Field: name, Reason: "invalid manifest: " + err.Error()}}}
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+var pageFilePattern = regexp.MustCompile(`^page-([1-9][0-9]{0,5})\.html$`)
+
+// addFile records the role of an uploaded file, given its name.
+func (f *renderForm) addFile(name, path string) {
+	switch name {
+	case "index.html":
+		f.indexPath = path
+	case "header.html":
+		f.headerPath = path
+	case "footer.html":
+		f.footerPath = path
+	case "cover.html":
+		f.coverPath = path
+	case "toc.xsl":
+		f.tocXSLPath = path
+	default:
+		if m := pageFilePattern.FindStringSubmatch(name); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			if f.pagePaths == nil {
+				f.pagePaths = map[int]string{}
+			}
+			f.pagePaths[n] = path
+		}
+	}
+}
+
+// useEntrypoint makes the upload named by the entrypoint field the main
+// document. It must be called once every file is written.
+func (f *renderForm) useEntrypoint(tmpdir string) error {
+	if f.entrypoint == "" {
+		return nil
+	}
+	path, err := uploadedFile(tmpdir, f.entrypoint)
+	if err != nil {
+		return &optionValidationError{Errors: []optionError{{Field: "entrypoint", Value: f.entrypoint, Reason: err.Error()}}}
+	}
+	f.indexPath = path
+	return nil
+}
+
+// index, header and footer return the wkhtmltopdf input for each document,
+// the URL if one was given, or "".
+func (f *renderForm) index() string  { return cmp.Or(f.url, f.indexPath) }
+func (f *renderForm) header() string { return cmp.Or(f.headerURL, f.headerPath) }
+func (f *renderForm) footer() string { return cmp.Or(f.footerURL, f.footerPath) }
+
+// remote reports whether the render has remote documents: URL mode
+// documents or url entries of the pages manifest.
+func (f *renderForm) remote() bool {
+	if f.url != "" || f.headerURL != "" || f.footerURL != "" {
+		return true
+	}
+	return slices.ContainsFunc(f.pages, func(p pageSpec) bool { return p.URL != "" })
+}
+
+// network returns the network policy of the render. Remote documents are
+// always fetched through the fetch proxy, see networkPolicy.urlMode.
+func (f *renderForm) network() *networkPolicy {
+	if !f.remote() {
+		return renderNetwork
+	}
+	return renderNetwork.urlMode(remoteURLs)
+}
+
+// renderFunc runs a prepared render. The caller must hold a render slot, see
+// preparedRender.execute.
+type renderFunc func(ctx context.Context) (*renderResult, error)
+
+// preparedRender is a parsed request ready to render.
+type preparedRender struct {
+	render renderFunc
+	tmpdir string
+	key    string // see renderKey, "" when neither cached nor coalesced
+	errors *prometheus.CounterVec
+	// accepted renders, such as jobs, wait for a slot without the queue
+	// bounds, see renderLimiter.Wait.
+	accepted bool
+}
+
+// execute returns the result of the render: from the render cache when it
+// holds one, shared with an identical render in progress when coalescing is
+// on, otherwise by running the render once a render slot is free. started,
+// if not nil, is called once the slot is acquired or the request joins a
+// render in progress.
+func (p *preparedRender) execute(ctx context.Context, started func() error) (*renderResult, error) {
+	logger := loggerFromContext(ctx)
+
+	if p.key != "" && renderCache != nil {
+		result, err := renderCache.Get(p.key, filepath.Join(p.tmpdir, "output.cached"))
+		if err != nil {
+			logger.Warnf("Failed to read the render cache: %v", err)
+		}
+		if result != nil {
+			logger.Infof("Render cache hit %s", p.key)
+			cacheHits.Inc()
+			return result, nil
+		}
+		cacheMisses.Inc()
+	}
+
+	if p.key != "" && config.Coalesce {
+		return renderFlights.do(ctx, p, started)
+	}
+	return p.run(ctx, started)
+}
+
+// run runs the render once a render slot is free and stores its result in
+// the render cache.
+func (p *preparedRender) run(ctx context.Context, started func() error) (*renderResult, error) {
+	logger := loggerFromContext(ctx)
+
+	acquire := renderSlots.Acquire
+	if p.accepted {
+		acquire = renderSlots.Wait
+	}
+	release, err := acquire(ctx)
+	if err != nil {
+		p.errors.WithLabelValues("render_slot_unavailable", err.Error()).Inc()
+		return nil, renderSlotError(err)
+	}
+	defer release()
+
+	if started != nil {
+		if err := started(); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := p.render(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.key != "" && renderCache != nil {
+		result.CacheKey = p.key
+		if err := renderCache.Put(p.key, result); err != nil {
+			logger.Warnf("Failed to store the render in the cache: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// Local file access modes, selected with the local-file-access setting.
+const (
+	localFileAccessTmpdir = "tmpdir"
+	localFileAccessAny    = "any"
+)
+
+// localFileAccessArgs returns the arguments that let a render read local
+// files: only those under the request tmpdir, unless local-file-access is
+// any. Since 0.12.6 wkhtmltopdf reads none by default, see
+// https://github.com/wkhtmltopdf/wkhtmltopdf/issues/4460#issuecomment-661345113
+func localFileAccessArgs(tmpdir string) []string {
+	if config.LocalFileAccess == localFileAccessAny {
+		return []string{"--enable-local-file-access"}
+	}
+	// wkhtmltopdf compares --allow with absolute file paths.
+	if abs, err := filepath.Abs(tmpdir); err == nil {
+		tmpdir = abs
+	}
+	return []string{"--disable-local-file-access", "--allow", tmpdir}
+}
+
+// renderProcess describes one wkhtmltopdf or wkhtmltoimage invocation.
+type renderProcess struct {
+	name        string // wkhtmltopdf or wkhtmltoimage, for logs
+	bin         string
+	args        []string
+	tmpdir      string
+	outPath     string
+	contentType string
+	network     *networkPolicy
+	errors      *prometheus.CounterVec
+}
+
+// run starts the process, waits for it and returns the spooled output. The
+// whole process group is killed when ctx is done.
+func (p *renderProcess) run(ctx context.Context) (*renderResult, error) {
+	logger := loggerFromContext(ctx)
+
+	// Before the objects, so that it applies to every page.
+	proxyArgs, stopProxy, err := p.network.start(ctx)
+	if err != nil {
+		p.errors.WithLabelValues("proxy_start_failed", err.Error()).Inc()
+		return nil, newAPIError(http.StatusInternalServerError, codeProcessStartFailed, err)
+	}
+	defer stopProxy()
+	args := append(proxyArgs, p.args...)
+
+	logger.Infoln("Args", args)
+
+	logger.Infof("Starting %s process", p.name)
+	cmd, err := renderSandbox.command(p.bin, args, p.tmpdir)
+	if err != nil {
+		p.errors.WithLabelValues("process_start_failed", err.Error()).Inc()
+		return nil, newAPIError(http.StatusInternalServerError, codeProcessStartFailed, err)
+	}
+	stderr := newStderrCapture(logger, p.tmpdir)
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	done := make(chan error, 1)
+
+	err = cmd.Start()
+	if err != nil {
+		p.errors.WithLabelValues("process_start_failed", err.Error()).Inc()
+		return nil, newAPIError(http.StatusInternalServerError, codeProcessStartFailed, err)
+	}
+
+	logger.Infof("%s process started", p.name)
+	defer activeRenders.trackProcess(cmd)()
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		if errors.Is(context.Cause(ctx), errRenderTimeout) {
+			p.errors.WithLabelValues("render_timeout", "").Inc()
+			logger.Errorf("Render timed out, killing %s process group", p.name)
+		} else {
+			p.errors.WithLabelValues("context_cancelled", ctx.Err().Error()).Inc()
+			logger.Errorf("Context cancelled, killing %s process group", p.name)
+		}
+		if err := killProcessGroup(cmd); err != nil {
+			logger.Errorf("Failed to kill process: %v", err)
+		}
+		<-done
+		stderr.Flush()
+		return nil, renderCancelledError(ctx)
+	case err := <-done:
+		stderr.Flush()
+		if err != nil {
+			logger.Errorf("%s process failed: %v", p.name, err)
+			apiErr := renderSandbox.limitError(cmd.ProcessState, stderr.Tail())
+			if apiErr != nil {
+				p.errors.WithLabelValues(apiErr.Code, "").Inc()
+			} else {
+				p.errors.WithLabelValues("process_failed", err.Error()).Inc()
+				apiErr = newAPIError(http.StatusInternalServerError, codeProcessFailed, err)
+			}
+			apiErr.Stderr = stderr.Tail()
+			apiErr.FailedResources = stderr.FailedResources()
+			return nil, apiErr
+		}
+	}
+
+	info, err := os.Stat(p.outPath)
+	if err != nil {
+		p.errors.WithLabelValues("read_output_failed", err.Error()).Inc()
+		return nil, newAPIError(http.StatusInternalServerError, codeReadOutputFailed, err)
+	}
+	if info.Size() == 0 {
+		p.errors.WithLabelValues("empty_output", "").Inc()
+		return nil, newAPIError(http.StatusInternalServerError, codeEmptyOutput, fmt.Errorf("%s produced empty output", p.name))
+	}
+
+	logger.Infof("%s process completed successfully", p.name)
+
+	return &renderResult{
+		Path:            p.outPath,
+		ContentType:     p.contentType,
+		Size:            info.Size(),
+		FailedResources: stderr.FailedResources(),
+	}, nil
+}
+
+// serveRenderResult streams the spooled output to the client with a
+// Content-Length, honouring Range requests.
+func serveRenderResult(ctx context.Context, w http.ResponseWriter, r *http.Request, result *renderResult) {
+	f, err := os.Open(result.Path)
+	if err != nil {
+		httpError(ctx, w, newAPIError(http.StatusInternalServerError, codeReadOutputFailed, err))
+		return
+	}
+	defer f.Close()
+
+	setFailedResourcesHeader(w, result.FailedResources)
+	w.Header().Set("Content-Type", result.ContentType)
+	if result.CacheKey != "" {
+		etag := `"` + result.CacheKey + `"`
+		w.Header().Set("ETag", etag)
+		if result.Cached {
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		// ServeContent answers a matching If-None-Match with 412 to a
+		// POST: the client already has this document.
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag,
+// using the weak comparison of RFC 9110.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setFailedResourcesHeader exposes resource-load failures to template
+// authors through the X-Render-Failed-Resources response header.
+func setFailedResourcesHeader(w http.ResponseWriter, resources []string) {
+	if len(resources) == 0 {
+		return
+	}
+	clean := make([]string, len(resources))
+	for i, r := range resources {
+		clean[i] = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || r == ',' {
+				return -1
+			}
+			return r
+		}, r)
+	}
+	w.Header().Set("X-Render-Failed-Resources", strings.Join(clean, ", "))
+}
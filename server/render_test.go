@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+const fakePDF = "%PDF-1.4\n% fake output of a test wkhtmltopdf\n%%EOF\n"
+
+// writeFakeWkhtmltopdf installs a fake wkhtmltopdf that writes fakePDF to the
+// output path given as its last argument.
+func writeFakeWkhtmltopdf(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fake-wkhtmltopdf.sh")
+	script := "#!/bin/sh\n" +
+		"# Fake wkhtmltopdf: last CLI arg is the output path.\n" +
+		"[ \"$1\" = --version ] && { echo 'wkhtmltopdf 0.12.6 (fake)'; exit 0; }\n" +
+		"for OUT in \"$@\"; do :; done\n" +
+		"printf '%s' '" + fakePDF + "' > \"$OUT\"\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", path)
+	return path
+}
+
+func TestPDFHandler_success(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A4"}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Body.String(); got != fakePDF {
+		t.Fatalf("body %q want %q", got, fakePDF)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(fakePDF)) {
+		t.Fatalf("Content-Length %q want %d", cl, len(fakePDF))
+	}
+}
+
+func TestPDFHandler_range(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+
+	req := newPDFRequest(t, nil)
+	req.Header.Set("Range", "bytes=0-7")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status %d want 206 body %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Body.String(); got != fakePDF[:8] {
+		t.Fatalf("body %q want %q", got, fakePDF[:8])
+	}
+}
+
+// writeArgsWkhtmltopdf installs a fake wkhtmltopdf like writeFakeWkhtmltopdf
+// that also writes its arguments to the returned file.
+func writeArgsWkhtmltopdf(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile, bin := filepath.Join(dir, "args"), filepath.Join(dir, "fake-wkhtmltopdf.sh")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" > " + argsFile + "\n" +
+		"for OUT in \"$@\"; do :; done\n" +
+		"printf '%s' '" + fakePDF + "' > \"$OUT\"\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", bin)
+	return argsFile
+}
+
+func TestPDFHandler_localFileAccess(t *testing.T) {
+	argsFile := writeArgsWkhtmltopdf(t)
+
+	for mode, want := range map[string]*regexp.Regexp{
+		localFileAccessTmpdir: regexp.MustCompile(`^--disable-local-file-access --allow (/\S+) --page-size A4 (/\S+)/index\.html `),
+		localFileAccessAny:    regexp.MustCompile(`^--enable-local-file-access --page-size A4 `),
+	} {
+		t.Run(mode, func(t *testing.T) {
+			setTestConfig(t, func(c *Config) { c.LocalFileAccess = mode })
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"page-size": "A4"}))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d body %s", rec.Code, rec.Body.String())
+			}
+			args, _ := os.ReadFile(argsFile)
+			m := want.FindStringSubmatch(string(args))
+			if m == nil || len(m) == 3 && m[1] != m[2] {
+				t.Fatalf("args %q", args)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Sandbox namespace modes, selected with the sandbox-namespaces setting.
+const (
+	sandboxOff  = "off"
+	sandboxAuto = "auto"
+	sandboxOn   = "on"
+)
+
+// sandboxCommand is the first argument of the server re-executed to start a
+// render process in its sandbox, see runSandbox.
+const sandboxCommand = "__sandbox"
+
+var errSandboxUnsupported = errors.New("the render sandbox requires Linux")
+
+// renderSandbox confines the render processes; main rebuilds it from the
+// effective config.
+var renderSandbox = &sandbox{}
+
+// renderLimits are the resource limits of one render process. Zero means no
+// limit.
+type renderLimits struct {
+	Memory    int64         // address space, in bytes
+	CPU       time.Duration // CPU time, rounded up to seconds
+	OpenFiles int
+	FileSize  int64 // largest file written, in bytes
+}
+
+func (l renderLimits) set() bool {
+	return l != renderLimits{}
+}
+
+func (l renderLimits) cpuSeconds() int64 {
+	return int64((l.CPU + time.Second - 1) / time.Second)
+}
+
+// sandbox starts the render processes through the server binary itself,
+// which applies the limits and, with namespaces, gives the process a
+// read-only view of the file system except its tmpdir, and no network when
+// the network policy is offline.
+type sandbox struct {
+	executable string
+	limits     renderLimits
+	namespaces bool
+	offline    bool // with namespaces: no network
+}
+
+// newSandbox checks that the sandbox of cfg can be set up by starting it
+// once. Unavailable namespaces are only an error with sandbox-namespaces on.
+func newSandbox(cfg *Config, logger *Logger) (*sandbox, error) {
+	s := &sandbox{
+		limits: renderLimits{
+			Memory:    cfg.RenderMaxMemory,
+			CPU:       cfg.RenderMaxCPU,
+			OpenFiles: cfg.RenderMaxOpenFiles,
+			FileSize:  cfg.RenderMaxFileSize,
+		},
+		namespaces: cfg.SandboxNamespaces != sandboxOff,
+		offline:    cfg.NetworkPolicy == networkOffline,
+	}
+	if !s.enabled() {
+		return s, nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	s.executable = executable
+
+	err = s.probe(cfg.TempDir)
+	if err != nil && s.namespaces && cfg.SandboxNamespaces == sandboxAuto {
+		logger.Warnf("Render processes run without namespaces: %v", err)
+		s.namespaces = false
+		err = s.probe(cfg.TempDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("render sandbox: %w", err)
+	}
+	return s, nil
+}
+
+func (s *sandbox) enabled() bool {
+	return s.namespaces || s.limits.set()
+}
+
+// probe sets the sandbox up without starting a render.
+func (s *sandbox) probe(tempRoot string) error {
+	tmpdir, err := os.MkdirTemp(tempRoot, "kwksandbox")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	cmd := exec.Command(s.executable, append(s.args(tmpdir), "--probe", "--", "probe")...)
+	if err := s.setNamespaces(cmd); err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
+
+// command returns the command running bin with args in the sandbox.
+func (s *sandbox) command(bin string, args []string, tmpdir string) (*exec.Cmd, error) {
+	if !s.enabled() {
+		return exec.Command(bin, args...), nil
+	}
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(s.executable, append(append(s.args(tmpdir), "--", path), args...)...)
+	if err := s.setNamespaces(cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// args returns the arguments of runSandbox for a render in tmpdir.
+func (s *sandbox) args(tmpdir string) []string {
+	args := []string{sandboxCommand,
+		"--memory", strconv.FormatInt(s.limits.Memory, 10),
+		"--cpu", strconv.FormatInt(s.limits.cpuSeconds(), 10),
+		"--open-files", strconv.Itoa(s.limits.OpenFiles),
+		"--file-size", strconv.FormatInt(s.limits.FileSize, 10),
+	}
+	if s.namespaces {
+		args = append(args, "--writable", tmpdir)
+	}
+	return args
+}
+
+// runSandbox is the server re-executed with sandboxCommand, already in its
+// namespaces: it makes the file system read-only except the writable
+// directory, sets the limits and executes the render process. It returns
+// only on failure.
+func runSandbox(args []string) int {
+	fs := flag.NewFlagSet(sandboxCommand, flag.ContinueOnError)
+	var limits renderLimits
+	var cpu int64
+	fs.Int64Var(&limits.Memory, "memory", 0, "")
+	fs.Int64Var(&cpu, "cpu", 0, "")
+	fs.IntVar(&limits.OpenFiles, "open-files", 0, "")
+	fs.Int64Var(&limits.FileSize, "file-size", 0, "")
+	writable := fs.String("writable", "", "")
+	probe := fs.Bool("probe", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		return 2
+	}
+	limits.CPU = time.Duration(cpu) * time.Second
+
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return 126
+	}
+	if *writable != "" {
+		dir, err := filepath.EvalSymlinks(*writable)
+		if err != nil {
+			return fail(err)
+		}
+		if err := isolateMounts(dir); err != nil {
+			return fail(err)
+		}
+		os.Setenv("TMPDIR", dir)
+	}
+	// Last, so that the limits apply to this process for as little as
+	// possible.
+	if err := setRenderLimits(limits); err != nil {
+		return fail(err)
+	}
+	if *probe {
+		return 0
+	}
+	return fail(execRender(fs.Arg(0), fs.Args()))
+}
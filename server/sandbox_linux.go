@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setNamespaces starts cmd in new user and mount namespaces, and a network
+// namespace when the network policy is offline. The user keeps its IDs.
+func (s *sandbox) setNamespaces(cmd *exec.Cmd) error {
+	if !s.namespaces {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if s.offline {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	return nil
+}
+
+// isolateMounts makes every mount of the namespace read-only, except a bind
+// mount of the writable directory. It needs Linux 5.12.
+func isolateMounts(writable string) error {
+	// Keep the changes in this namespace.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	if err := unix.Mount(writable, writable, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", writable, err)
+	}
+	readOnly := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+	if err := unix.MountSetattr(-1, "/", unix.AT_RECURSIVE, readOnly); err != nil {
+		return fmt.Errorf("make mounts read-only: %w", err)
+	}
+	writableAttr := &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}
+	if err := unix.MountSetattr(-1, writable, 0, writableAttr); err != nil {
+		return fmt.Errorf("make %s writable: %w", writable, err)
+	}
+	return nil
+}
+
+// setRenderLimits sets the limits of this process, inherited by the render
+// process. The CPU hard limit is a second above the soft one, so that the
+// process gets SIGXCPU before SIGKILL.
+func setRenderLimits(l renderLimits) error {
+	for _, limit := range []struct {
+		resource int
+		cur, max uint64
+	}{
+		{syscall.RLIMIT_AS, uint64(l.Memory), uint64(l.Memory)},
+		{syscall.RLIMIT_CPU, uint64(l.cpuSeconds()), uint64(l.cpuSeconds()) + 1},
+		{syscall.RLIMIT_NOFILE, uint64(l.OpenFiles), uint64(l.OpenFiles)},
+		{syscall.RLIMIT_FSIZE, uint64(l.FileSize), uint64(l.FileSize)},
+	} {
+		if limit.cur == 0 {
+			continue
+		}
+		// syscall.Setrlimit, unlike unix.Setrlimit, keeps the runtime
+		// from restoring its open files limit on exec.
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: limit.cur, Max: limit.max}); err != nil {
+			return fmt.Errorf("set limit %d: %w", limit.resource, err)
+		}
+	}
+	return nil
+}
+
+func execRender(path string, argv []string) error {
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// limitError reports the limit a failed render process exceeded, if any.
+func (s *sandbox) limitError(state *os.ProcessState, stderr string) *apiError {
+	var sig syscall.Signal
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		sig = status.Signal()
+	}
+	l := s.limits
+	switch {
+	case l.CPU > 0 && (sig == syscall.SIGXCPU || sig == syscall.SIGKILL && state.UserTime()+state.SystemTime() >= l.CPU):
+		return newAPIError(http.StatusUnprocessableEntity, codeCPULimitExceeded, fmt.Errorf("the render used more than %s of CPU time", l.CPU))
+	case l.FileSize > 0 && sig == syscall.SIGXFSZ:
+		return newAPIError(http.StatusUnprocessableEntity, codeFileSizeLimitExceeded, fmt.Errorf("the render wrote a file larger than %d bytes", l.FileSize))
+	case l.Memory > 0 && outOfMemory(stderr):
+		// A crash alone may have another cause: only an allocation failure
+		// reported on stderr counts.
+		return newAPIError(http.StatusUnprocessableEntity, codeMemoryLimitExceeded, fmt.Errorf("the render ran out of its %d bytes of memory", l.Memory))
+	case l.OpenFiles > 0 && strings.Contains(stderr, "Too many open files"):
+		return newAPIError(http.StatusUnprocessableEntity, codeOpenFilesLimitExceeded, fmt.Errorf("the render opened more than %d files", l.OpenFiles))
+	}
+	return nil
+}
+
+// outOfMemoryMessages are printed on stderr when an allocation fails: by the
+// C++ runtime, Qt and strerror(ENOMEM).
+var outOfMemoryMessages = []string{"bad_alloc", "out of memory", "cannot allocate memory"}
+
+// outOfMemory reports whether stderr shows that an allocation failed.
+func outOfMemory(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	return slices.ContainsFunc(outOfMemoryMessages, func(msg string) bool { return strings.Contains(stderr, msg) })
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for the server re-executed as the
+// sandbox helper.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == sandboxCommand {
+		os.Exit(runSandbox(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// useSandbox renders with the sandbox of the config changed by change.
+func useSandbox(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	setTestConfig(t, func(c *Config) {
+		c.TempDir = t.TempDir()
+		change(c)
+	})
+	s, err := newSandbox(config, GlobalLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := renderSandbox
+	renderSandbox = s
+	t.Cleanup(func() { renderSandbox = saved })
+}
+
+// writeScriptWkhtmltopdf installs the shell script body as wkhtmltopdf.
+func writeScriptWkhtmltopdf(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fake-wkhtmltopdf.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nfor OUT in \"$@\"; do :; done\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", path)
+}
+
+func TestPDFHandler_sandboxLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits func(c *Config)
+		script string
+		code   string
+	}{
+		{"cpu", func(c *Config) { c.RenderMaxCPU = time.Second }, "while :; do :; done\n", codeCPULimitExceeded},
+		{"file size", func(c *Config) { c.RenderMaxFileSize = 1024 }, "exec head -c 4096 /dev/zero > \"$OUT\"\n", codeFileSizeLimitExceeded},
+		{"open files", func(c *Config) { c.RenderMaxOpenFiles = 16 }, "echo 'Too many open files' >&2; exit 1\n", codeOpenFilesLimitExceeded},
+		{"memory", func(c *Config) { c.RenderMaxMemory = 1 << 30 }, "echo \"terminate called after throwing an instance of 'std::bad_alloc'\" >&2; kill -ABRT $$\n", codeMemoryLimitExceeded},
+		{"crash", func(c *Config) { c.RenderMaxMemory = 1 << 30 }, "kill -SEGV $$\n", codeProcessFailed},
+		{"within limits", func(c *Config) { c.RenderMaxFileSize = 1024 }, "printf '%s' '" + fakePDF + "' > \"$OUT\"\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeScriptWkhtmltopdf(t, tt.script)
+			useSandbox(t, tt.limits)
+
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, newPDFRequest(t, nil))
+			if tt.code == "" {
+				if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+					t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			status := http.StatusUnprocessableEntity
+			if tt.code == codeProcessFailed {
+				status = http.StatusInternalServerError
+			}
+			if rec.Code != status || rec.Header().Get("X-Error-Code") != tt.code {
+				t.Fatalf("status %d code %q body %q, want %s", rec.Code, rec.Header().Get("X-Error-Code"), rec.Body.String(), tt.code)
+			}
+		})
+	}
+}
+
+func TestPDFHandler_sandboxNamespaces(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "outside")
+	// The render can write its output but nothing outside its tmpdir.
+	writeScriptWkhtmltopdf(t, "touch "+outside+" 2>/dev/null && exit 3\n"+
+		"printf '%s' '"+fakePDF+"' > \"$OUT\"\n")
+	setTestConfig(t, func(c *Config) { c.SandboxNamespaces = sandboxOn })
+	if _, err := newSandbox(config, GlobalLogger); err != nil {
+		t.Skipf("namespaces unavailable: %v", err)
+	}
+	useSandbox(t, func(c *Config) {})
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Fatal("the render wrote outside its tmpdir")
+	}
+}
+
+func TestNewSandbox(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.TempDir = t.TempDir() })
+	if s, err := newSandbox(config, GlobalLogger); err != nil || s.enabled() {
+		t.Fatalf("no limits: %+v %v", s, err)
+	}
+
+	// Limits the kernel refuses are reported at startup.
+	setTestConfig(t, func(c *Config) { c.RenderMaxOpenFiles = 1 << 40 })
+	if _, err := newSandbox(config, GlobalLogger); err == nil {
+		t.Fatal("no error for an open files limit above fs.nr_open")
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func (s *sandbox) setNamespaces(cmd *exec.Cmd) error {
+	if s.namespaces {
+		return errSandboxUnsupported
+	}
+	return nil
+}
+
+func isolateMounts(writable string) error {
+	return errSandboxUnsupported
+}
+
+func setRenderLimits(l renderLimits) error {
+	if l.set() {
+		return errSandboxUnsupported
+	}
+	return nil
+}
+
+func execRender(path string, argv []string) error {
+	return errSandboxUnsupported
+}
+
+func (s *sandbox) limitError(state *os.ProcessState, stderr string) *apiError {
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set once a termination signal was received; /status then
+// reports the server as not ready.
+var shuttingDown atomic.Bool
+
+// renderTracker keeps track of running render processes and request
+// temporary directories, so that whatever is left when the shutdown grace
+// period expires can be killed and removed.
+type renderTracker struct {
+	mu      sync.Mutex
+	procs   map[*exec.Cmd]struct{}
+	tmpdirs map[string]struct{}
+}
+
+var activeRenders = newRenderTracker()
+
+func newRenderTracker() *renderTracker {
+	return &renderTracker{
+		procs:   map[*exec.Cmd]struct{}{},
+		tmpdirs: map[string]struct{}{},
+	}
+}
+
+// trackProcess registers a started process until the returned function is
+// called.
+func (t *renderTracker) trackProcess(cmd *exec.Cmd) func() {
+	t.mu.Lock()
+	t.procs[cmd] = struct{}{}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.procs, cmd)
+		t.mu.Unlock()
+	}
+}
+
+// tempDir creates a request temporary directory under the temp-dir setting.
+// The returned function removes it.
+func (t *renderTracker) tempDir(pattern string) (string, func(), error) {
+	dir, err := os.MkdirTemp(config.TempDir, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+
+	t.mu.Lock()
+	t.tmpdirs[dir] = struct{}{}
+	t.mu.Unlock()
+
+	return dir, func() {
+		os.RemoveAll(dir)
+		t.mu.Lock()
+		delete(t.tmpdirs, dir)
+		t.mu.Unlock()
+	}, nil
+}
+
+// killProcesses kills the process groups of every tracked process and
+// returns how many there were.
+func (t *renderTracker) killProcesses(logger *Logger) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for cmd := range t.procs {
+		if err := killProcessGroup(cmd); err != nil {
+			logger.Errorf("Failed to kill process %d: %v", cmd.Process.Pid, err)
+		}
+	}
+	return len(t.procs)
+}
+
+// removeTempDirs removes every tracked temporary directory.
+func (t *renderTracker) removeTempDirs(logger *Logger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for dir := range t.tmpdirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Errorf("Failed to remove %s: %v", dir, err)
+		}
+		delete(t.tmpdirs, dir)
+	}
+}
+
+func (t *renderTracker) processCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.procs)
+}
+
+// gracefulShutdown fails readiness, waits shutdown-delay for load balancers
+// to notice, stops accepting connections and waits up to
+// shutdown-grace-period for in-flight requests and background jobs. Renders
+// still running after that are killed and their temporary directories
+// removed.
+func gracefulShutdown(server *http.Server, logger *Logger) {
+	shuttingDown.Store(true)
+	logger.Infof("Shutting down: readiness failing, draining in %s", config.ShutdownDelay)
+	time.Sleep(config.ShutdownDelay)
+
+	logger.Infof("Waiting up to %s for %d active renders", config.ShutdownGracePeriod, activeRenders.processCount())
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = waitJobs(ctx)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		killed := activeRenders.killProcesses(logger)
+		logger.Warnf("Grace period expired, killed %d render processes", killed)
+		server.Close()
+	} else if err != nil {
+		logger.Errorf("Shutdown failed: %v", err)
+	}
+
+	activeRenders.removeTempDirs(logger)
+	logger.Infoln("Shutdown complete")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatusHandler_shuttingDown(t *testing.T) {
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d want 503", rec.Code)
+	}
+}
+
+func TestGracefulShutdown_killsRemainingRenders(t *testing.T) {
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	bin := filepath.Join(dir, "fake-wkhtmltopdf.sh")
+	script := "#!/bin/sh\ntouch " + started + "\nsleep 30\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, func(c *Config) {
+		c.WkhtmltopdfBin = bin
+		c.TempDir = t.TempDir()
+		c.ShutdownDelay = 0
+		c.ShutdownGracePeriod = 200 * time.Millisecond
+	})
+	defer shuttingDown.Store(false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: withTraceID(pdfHandler)}
+	go server.Serve(ln)
+
+	resp := make(chan int, 1)
+	go func() {
+		req := newPDFRequest(t, nil)
+		req.URL.Scheme, req.URL.Host, req.RequestURI = "http", ln.Addr().String(), ""
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			resp <- 0
+			return
+		}
+		r.Body.Close()
+		resp <- r.StatusCode
+	}()
+
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	gracefulShutdown(server, newLogger())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	<-resp
+
+	// The killed render returns shortly after the connection is closed.
+	deadline := time.Now().Add(2 * time.Second)
+	for activeRenders.processCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d processes still tracked", activeRenders.processCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := os.ReadDir(config.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("temp dirs left behind: %v", entries)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// stderrBufferSize bounds the stderr kept in memory per process.
+	stderrBufferSize = 64 << 10
+	// stderrTailSize bounds the stderr returned to the client on failure.
+	stderrTailSize = 4 << 10
+	// maxFailedResources bounds the resources listed in the response header.
+	maxFailedResources = 20
+)
+
+var (
+	progressLinePattern = regexp.MustCompile(`^\[[=> ]*\]`)
+	failedLoadPattern   = regexp.MustCompile(`Failed to load (\S+?)(?:,|\s|$)`)
+)
+
+// stderrCapture collects the stderr of one wkhtmltopdf/wkhtmltoimage process.
+// Complete lines are logged through the request logger as they arrive, so
+// they carry the request trace ID.
+type stderrCapture struct {
+	logger *Logger
+	tmpdir string
+
+	mu              sync.Mutex
+	partial         []byte
+	buf             []byte
+	failedResources []string
+}
+
+func newStderrCapture(logger *Logger, tmpdir string) *stderrCapture {
+	return &stderrCapture{logger: logger, tmpdir: tmpdir}
+}
+
+func (c *stderrCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.partial = append(c.partial, p...)
+	for {
+		// wkhtmltopdf redraws its progress bar with \r.
+		i := bytes.IndexAny(c.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		c.handleLine(string(c.partial[:i]))
+		c.partial = c.partial[i+1:]
+	}
+	if len(c.partial) > stderrBufferSize {
+		c.handleLine(string(c.partial))
+		c.partial = nil
+	}
+	return len(p), nil
+}
+
+// Flush handles a trailing line without a newline. Call it once the process
+// has exited.
+func (c *stderrCapture) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.partial) > 0 {
+		c.handleLine(string(c.partial))
+		c.partial = nil
+	}
+}
+
+func (c *stderrCapture) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || progressLinePattern.MatchString(line) {
+		return
+	}
+
+	c.buf = append(c.buf, line...)
+	c.buf = append(c.buf, '\n')
+	if len(c.buf) > stderrBufferSize {
+		c.buf = c.buf[len(c.buf)-stderrBufferSize:]
+	}
+
+	logger := c.logger.WithField("source", "stderr")
+	switch {
+	case strings.HasPrefix(line, "Error:"), strings.HasPrefix(line, "Exit with code"):
+		logger.Errorln(line)
+	case strings.HasPrefix(line, "Warning:"):
+		logger.Warnln(line)
+	default:
+		logger.Debugln(line)
+	}
+
+	if m := failedLoadPattern.FindStringSubmatch(line); m != nil {
+		c.addFailedResource(m[1])
+	}
+}
+
+func (c *stderrCapture) addFailedResource(resource string) {
+	if c.tmpdir != "" {
+		resource = strings.TrimPrefix(resource, "file://"+c.tmpdir+"/")
+	}
+	for _, r := range c.failedResources {
+		if r == resource {
+			return
+		}
+	}
+	if len(c.failedResources) < maxFailedResources {
+		c.failedResources = append(c.failedResources, resource)
+	}
+}
+
+// Tail returns the last lines of stderr, at most stderrTailSize bytes.
+func (c *stderrCapture) Tail() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tail := c.buf
+	if len(tail) > stderrTailSize {
+		tail = tail[len(tail)-stderrTailSize:]
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+	return strings.TrimRight(string(tail), "\n")
+}
+
+// FailedResources lists the resources the page failed to load, relative to
+// the request tmpdir for uploaded files.
+func (c *stderrCapture) FailedResources() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.failedResources...)
+}
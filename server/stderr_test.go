@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStderrCapture_linesAndResources(t *testing.T) {
+	c := newStderrCapture(newLogger(), "/tmp/kwk123")
+	input := "Loading pages (1/6)\n" +
+		"[>                                                           ] 0%\r[======>   ] 10%\r" +
+		"Warning: Failed to load file:///tmp/kwk123/img/logo.png (ignore)\n" +
+		"Error: Failed to load http://example.com/a.css, with network status code 203\n" +
+		"Exit with code 1 due to network error: ContentNotFoundError"
+	// Split the input across writes to exercise partial lines.
+	for _, chunk := range []string{input[:17], input[17:90], input[90:]} {
+		if _, err := c.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Flush()
+
+	tail := c.Tail()
+	if strings.Contains(tail, "%") {
+		t.Errorf("progress lines kept in tail: %q", tail)
+	}
+	if !strings.HasSuffix(tail, "Exit with code 1 due to network error: ContentNotFoundError") {
+		t.Errorf("unexpected tail: %q", tail)
+	}
+
+	got := c.FailedResources()
+	want := []string{"img/logo.png", "http://example.com/a.css"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("failed resources %q want %q", got, want)
+	}
+}
+
+func TestStderrCapture_bounded(t *testing.T) {
+	c := newStderrCapture(newLogger(), "")
+	line := strings.Repeat("x", 1000) + "\n"
+	for i := 0; i < 200; i++ {
+		c.Write([]byte(line))
+	}
+	c.Flush()
+	if len(c.buf) > stderrBufferSize {
+		t.Fatalf("buffer grew to %d bytes", len(c.buf))
+	}
+	if len(c.Tail()) > stderrTailSize {
+		t.Fatalf("tail is %d bytes", len(c.Tail()))
+	}
+}
+
+func TestPDFHandler_processFailureReportsStderr(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "fake-wkhtmltopdf.sh")
+	script := "#!/bin/sh\n" +
+		"echo 'Warning: Failed to load file:///nowhere/logo.png (ignore)' >&2\n" +
+		"echo 'Exit with code 1 due to network error: ContentNotFoundError' >&2\n" +
+		"exit 1\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KWKHTMLTOPDF_BIN", bin)
+
+	req := newPDFRequest(t, nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d want 500 body %s", rec.Code, rec.Body.String())
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != codeProcessFailed || !strings.Contains(body.Stderr, "ContentNotFoundError") {
+		t.Fatalf("unexpected envelope: %+v", body)
+	}
+	if got := rec.Header().Get("X-Render-Failed-Resources"); got != "file:///nowhere/logo.png" {
+		t.Fatalf("X-Render-Failed-Resources %q", got)
+	}
+}
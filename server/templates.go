@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// templateFuncs are the functions available to the templates, in addition to
+// the html/template builtins.
+var templateFuncs = template.FuncMap{
+	"date":          formatDate,
+	"indianNumber":  indianNumber,
+	"inr":           formatINR,
+	"amountInWords": amountInWords,
+}
+
+// maxTemplateOutput bounds the output of one template document.
+const maxTemplateOutput = 32 << 20
+
+var errTemplateOutputTooLarge = fmt.Errorf("template output is larger than %d bytes", maxTemplateOutput)
+
+// parseTemplateData decodes the data field of a template mode request, that
+// is one with a data field, or returns nil without one.
+func parseTemplateData(form *renderForm) (any, error) {
+	if form.data == nil {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(form.data))
+	dec.UseNumber()
+	var data any
+	if err := dec.Decode(&data); err != nil {
+		return nil, &optionValidationError{Errors: []optionError{{Field: "data", Reason: "invalid JSON: " + err.Error()}}}
+	}
+	return data, nil
+}
+
+// applyTemplates renders the documents of a template mode request against
+// data, see parseTemplateData, in place. Data keys missing from the data
+// fail the request unless template-strict is off.
+//
+// Templates come from clients: they run in a render slot, under the render
+// timeout given by ctx, and their output is bounded by maxTemplateOutput.
+func applyTemplates(ctx context.Context, form *renderForm, data any) error {
+	if form.data == nil {
+		return nil
+	}
+
+	missingKey := "missingkey=default"
+	if config.TemplateStrict {
+		missingKey = "missingkey=error"
+	}
+	for _, path := range form.documents() {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(filepath.Base(path)).Option(missingKey).Funcs(templateFuncs).Parse(string(src))
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeTemplateError, err)
+		}
+		out, err := executeTemplate(ctx, tmpl, data)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, out, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeTemplate executes tmpl against data until ctx is done. A template
+// that loops without writing cannot be interrupted: it is left to finish in
+// the background, its output discarded.
+func executeTemplate(ctx context.Context, tmpl *template.Template, data any) ([]byte, error) {
+	out := &templateWriter{ctx: ctx}
+	done := make(chan error, 1)
+	go func() { done <- tmpl.Execute(out, data) }()
+
+	select {
+	case err := <-done:
+		if ctx.Err() != nil {
+			return nil, renderCancelledError(ctx)
+		}
+		if errors.Is(err, errTemplateOutputTooLarge) {
+			return nil, newAPIError(http.StatusBadRequest, codeTemplateError, errTemplateOutputTooLarge)
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, codeTemplateError, err)
+		}
+		return out.buf.Bytes(), nil
+	case <-ctx.Done():
+		return nil, renderCancelledError(ctx)
+	}
+}
+
+// templateWriter collects the output of a template, failing the execution
+// once ctx is done or the output exceeds maxTemplateOutput.
+type templateWriter struct {
+	ctx context.Context
+	buf bytes.Buffer
+}
+
+func (w *templateWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if w.buf.Len()+len(p) > maxTemplateOutput {
+		return 0, errTemplateOutputTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+// checkTemplates parses the documents of form as templates, to report syntax
+// errors before any data is given.
+func checkTemplates(form *renderForm) error {
+	for _, path := range form.documents() {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(string(src)); err != nil {
+			return newAPIError(http.StatusBadRequest, codeTemplateError, err)
+		}
+	}
+	return nil
+}
+
+// documents returns the paths of the uploaded documents: index, header,
+// footer, cover and pages.
+func (f *renderForm) documents() []string {
+	var paths []string
+	for _, path := range []string{f.indexPath, f.headerPath, f.footerPath, f.coverPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	numbers := make([]int, 0, len(f.pagePaths))
+	for n := range f.pagePaths {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		paths = append(paths, f.pagePaths[n])
+	}
+	return paths
+}
+
+// dateLayouts are the date formats accepted by the date function, besides
+// Unix timestamps.
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// formatDate formats v, a date string or a Unix timestamp in seconds, with
+// the Go time layout, e.g. {{date "02 Jan 2006" .invoice_date}}.
+func formatDate(layout string, v any) (string, error) {
+	var s string
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(layout), nil
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	case float64:
+		return time.Unix(int64(v), 0).UTC().Format(layout), nil
+	case int:
+		return time.Unix(int64(v), 0).UTC().Format(layout), nil
+	case int64:
+		return time.Unix(v, 0).UTC().Format(layout), nil
+	default:
+		return "", fmt.Errorf("date: unsupported value %v (%T)", v, v)
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC().Format(layout), nil
+	}
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.Format(layout), nil
+		}
+	}
+	return "", fmt.Errorf("date: cannot parse %q", s)
+}
+
+var decimalPattern = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// maxIntegerDigits bounds the numbers the template functions format, so
+// that client data cannot keep a render busy: 10^30 is far beyond any amount.
+const maxIntegerDigits = 30
+
+// decimalString returns the number v, a JSON number, a string or a Go
+// number, as a plain decimal string.
+func decimalString(v any) (string, error) {
+	var s string
+	switch v := v.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = strings.TrimSpace(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		s = strconv.Itoa(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	default:
+		return "", fmt.Errorf("unsupported number %v (%T)", v, v)
+	}
+	if !decimalPattern.MatchString(s) {
+		return "", fmt.Errorf("invalid number %q", s)
+	}
+	if _, exp, ok := strings.Cut(strings.ToLower(s), "e"); ok {
+		if e, err := strconv.Atoi(exp); err != nil || e > maxIntegerDigits || e < -maxIntegerDigits {
+			return "", fmt.Errorf("number %q: exponent out of range", s)
+		}
+		// Expand the exponent, keeping the digits it leaves after the point.
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return "", fmt.Errorf("invalid number %q", s)
+		}
+		s = strings.TrimRight(strings.TrimRight(r.FloatString(20), "0"), ".")
+	}
+	s = strings.TrimPrefix(s, "+")
+	if intPart, _, _ := strings.Cut(strings.TrimPrefix(s, "-"), "."); len(intPart) > maxIntegerDigits {
+		return "", fmt.Errorf("number %q: more than %d integer digits", s[:maxIntegerDigits]+"...", maxIntegerDigits)
+	}
+	return s, nil
+}
+
+// decimalRat returns the number v as a big.Rat, see decimalString.
+func decimalRat(v any) (*big.Rat, error) {
+	s, err := decimalString(v)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	return r, nil
+}
+
+// groupIndian inserts the separators of the Indian numbering system in the
+// decimal string s: 1234567.5 becomes 12,34,567.5.
+func groupIndian(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, frac, hasFrac := strings.Cut(s, ".")
+
+	// From the right, then reversed once.
+	var groups []string
+	if len(intPart) > 3 {
+		groups = append(groups, intPart[len(intPart)-3:])
+		intPart = intPart[:len(intPart)-3]
+		for len(intPart) > 2 {
+			groups = append(groups, intPart[len(intPart)-2:])
+			intPart = intPart[:len(intPart)-2]
+		}
+	}
+	groups = append(groups, intPart)
+	slices.Reverse(groups)
+
+	s = sign + strings.Join(groups, ",")
+	if hasFrac {
+		s += "." + frac
+	}
+	return s
+}
+
+// indianNumber formats v with Indian digit grouping, keeping its decimals:
+// 12345678.5 gives 1,23,45,678.5.
+func indianNumber(v any) (string, error) {
+	s, err := decimalString(v)
+	if err != nil {
+		return "", fmt.Errorf("indianNumber: %w", err)
+	}
+	return groupIndian(s), nil
+}
+
+// formatINR formats v as an amount in rupees, rounded to the paisa:
+// 12345678.5 gives ₹1,23,45,678.50.
+func formatINR(v any) (string, error) {
+	r, err := decimalRat(v)
+	if err != nil {
+		return "", fmt.Errorf("inr: %w", err)
+	}
+	s := groupIndian(r.FloatString(2))
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		return "-₹" + rest, nil
+	}
+	return "₹" + s, nil
+}
+
+var (
+	unitWords = []string{"", "One", "Two", "Three", "Four", "Five", "Six", "Seven", "Eight", "Nine", "Ten",
+		"Eleven", "Twelve", "Thirteen", "Fourteen", "Fifteen", "Sixteen", "Seventeen", "Eighteen", "Nineteen"}
+	tensWords = []string{"", "", "Twenty", "Thirty", "Forty", "Fifty", "Sixty", "Seventy", "Eighty", "Ninety"}
+)
+
+// belowHundredWords spells 0 < n < 100.
+func belowHundredWords(n int64) string {
+	if n < 20 {
+		return unitWords[n]
+	}
+	if n%10 == 0 {
+		return tensWords[n/10]
+	}
+	return tensWords[n/10] + " " + unitWords[n%10]
+}
+
+// indianWords spells n > 0 in the Indian numbering system, with crores
+// beyond 99,99,99,999 spelled recursively.
+func indianWords(n int64) string {
+	var words []string
+	if crores := n / 1_00_00_000; crores > 0 {
+		words = append(words, indianWords(crores), "Crore")
+		n %= 1_00_00_000
+	}
+	for _, scale := range []struct {
+		size int64
+		name string
+	}{{1_00_000, "Lakh"}, {1_000, "Thousand"}, {100, "Hundred"}} {
+		if q := n / scale.size; q > 0 {
+			words = append(words, belowHundredWords(q), scale.name)
+			n %= scale.size
+		}
+	}
+	if n > 0 {
+		words = append(words, belowHundredWords(n))
+	}
+	return strings.Join(words, " ")
+}
+
+// amountInWords spells the amount v in rupees and paise, as printed on
+// invoices and cheques: 1234.5 gives "Rupees One Thousand Two Hundred Thirty
+// Four and Fifty Paise Only".
+func amountInWords(v any) (string, error) {
+	r, err := decimalRat(v)
+	if err != nil {
+		return "", fmt.Errorf("amountInWords: %w", err)
+	}
+	s := r.FloatString(2)
+	sign := ""
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		sign, s = "Minus ", rest
+	}
+	rupeesPart, paisePart, _ := strings.Cut(s, ".")
+	rupees, err := strconv.ParseInt(rupeesPart, 10, 64)
+	if err != nil {
+		return "", errors.New("amountInWords: amount too large")
+	}
+	paise, _ := strconv.ParseInt(paisePart, 10, 64)
+
+	words := "Zero"
+	if rupees > 0 {
+		words = indianWords(rupees)
+	}
+	if rupees == 0 && paise > 0 {
+		return sign + belowHundredWords(paise) + " Paise Only", nil
+	}
+	if paise > 0 {
+		return sign + "Rupees " + words + " and " + belowHundredWords(paise) + " Paise Only", nil
+	}
+	return sign + "Rupees " + words + " Only", nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndianNumber(t *testing.T) {
+	for in, want := range map[any]string{
+		json.Number("0"):           "0",
+		json.Number("999"):         "999",
+		json.Number("1000"):        "1,000",
+		json.Number("123456"):      "1,23,456",
+		json.Number("12345678.50"): "1,23,45,678.50",
+		json.Number("-1234567"):    "-12,34,567",
+		json.Number("1.5e6"):       "15,00,000",
+		"98765":                    "98,765",
+		1234567.25:                 "12,34,567.25",
+		42:                         "42",
+	} {
+		if got, err := indianNumber(in); err != nil || got != want {
+			t.Errorf("indianNumber(%v) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []any{"12,345", "0x1F", "1/3", true, nil} {
+		if _, err := indianNumber(in); err == nil {
+			t.Errorf("indianNumber(%v): no error", in)
+		}
+	}
+}
+
+func TestNumberFuncs_outOfRange(t *testing.T) {
+	huge := []any{
+		json.Number("1e100000000"),
+		json.Number("1e200000"),
+		"1e31",
+		strings.Repeat("9", 31),
+		"-" + strings.Repeat("1", 100000),
+		1e300,
+	}
+	for _, in := range huge {
+		start := time.Now()
+		for name, f := range map[string]func(any) (string, error){"indianNumber": indianNumber, "inr": formatINR, "amountInWords": amountInWords} {
+			if _, err := f(in); err == nil {
+				t.Errorf("%s(%.40v): no error", name, in)
+			}
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%.40v: rejected after %s", in, d)
+		}
+	}
+	if got, err := indianNumber(json.Number("1e29")); err != nil || len(got) != 30+14 {
+		t.Errorf("indianNumber(1e29) = %q, %v", got, err)
+	}
+}
+
+func TestFormatINR(t *testing.T) {
+	for in, want := range map[any]string{
+		json.Number("12345678.5"): "₹1,23,45,678.50",
+		json.Number("0.005"):      "₹0.01",
+		json.Number("999.994"):    "₹999.99",
+		json.Number("-1500"):      "-₹1,500.00",
+	} {
+		if got, err := formatINR(in); err != nil || got != want {
+			t.Errorf("formatINR(%v) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestAmountInWords(t *testing.T) {
+	for in, want := range map[any]string{
+		json.Number("0"):            "Rupees Zero Only",
+		json.Number("0.5"):          "Fifty Paise Only",
+		json.Number("15"):           "Rupees Fifteen Only",
+		json.Number("1234.5"):       "Rupees One Thousand Two Hundred Thirty Four and Fifty Paise Only",
+		json.Number("100000"):       "Rupees One Lakh Only",
+		json.Number("12345678.09"):  "Rupees One Crore Twenty Three Lakh Forty Five Thousand Six Hundred Seventy Eight and Nine Paise Only",
+		json.Number("250000000000"): "Rupees Twenty Five Thousand Crore Only",
+		json.Number("-90"):          "Minus Rupees Ninety Only",
+	} {
+		if got, err := amountInWords(in); err != nil || got != want {
+			t.Errorf("amountInWords(%v) = %q, %v\nwant %q", in, got, err, want)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	for in, want := range map[any]string{
+		"2026-03-31":                "31 Mar 2026",
+		"2026-03-31T18:30:00Z":      "31 Mar 2026",
+		"2026-03-31T23:30:00+05:30": "31 Mar 2026",
+		json.Number("1774915200"):   "31 Mar 2026",
+	} {
+		if got, err := formatDate("02 Jan 2006", in); err != nil || got != want {
+			t.Errorf("formatDate(%v) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := formatDate("02 Jan 2006", "31/03/2026"); err == nil {
+		t.Error("formatDate: no error for an unknown format")
+	}
+}
+
+// templateForm writes docs to a temp dir and returns a form using them.
+func templateForm(t *testing.T, data string, docs map[string]string) (*renderForm, string) {
+	t.Helper()
+	tmpdir := t.TempDir()
+	form := &renderForm{data: []byte(data)}
+	for name, src := range docs {
+		path := filepath.Join(tmpdir, name)
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		form.addFile(name, path)
+	}
+	return form, tmpdir
+}
+
+// renderTemplates applies the templates of form as the render does.
+func renderTemplates(ctx context.Context, form *renderForm) error {
+	data, err := parseTemplateData(form)
+	if err != nil {
+		return err
+	}
+	return applyTemplates(ctx, form, data)
+}
+
+func TestApplyTemplates(t *testing.T) {
+	form, tmpdir := templateForm(t, `{"customer": {"name": "A & B Traders"}, "total": 118000, "due": "2026-04-15"}`, map[string]string{
+		"index.html":  `<p>{{.customer.name}}</p><p>{{inr .total}}</p><p>{{amountInWords .total}}</p>`,
+		"footer.html": `<p>Due {{date "02/01/2006" .due}}</p>`,
+		"logo.svg":    `<svg>{{.unused}}</svg>`,
+	})
+	if err := renderTemplates(context.Background(), form); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"index.html":  `<p>A &amp; B Traders</p><p>₹1,18,000.00</p><p>Rupees One Lakh Eighteen Thousand Only</p>`,
+		"footer.html": `<p>Due 15/04/2026</p>`,
+		"logo.svg":    `<svg>{{.unused}}</svg>`, // assets are not templates
+	} {
+		if got, _ := os.ReadFile(filepath.Join(tmpdir, name)); string(got) != want {
+			t.Errorf("%s = %q\nwant %q", name, got, want)
+		}
+	}
+}
+
+func TestApplyTemplates_errors(t *testing.T) {
+	cases := map[string]struct {
+		data, index string
+		want        string // in the message
+	}{
+		"missing key":    {`{"a": 1}`, "<p>\n{{.b}}</p>", "index.html:2:"},
+		"syntax":         {`{}`, "<p>\n\n{{if .a}}</p>", "index.html:3:"},
+		"unknown func":   {`{}`, "{{rupees .a}}", `function "rupees" not defined`},
+		"function error": {`{"d": "tomorrow"}`, `{{date "2006" .d}}`, `cannot parse "tomorrow"`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			form, _ := templateForm(t, tc.data, map[string]string{"index.html": tc.index})
+			err := renderTemplates(context.Background(), form)
+			if apiErrorCode(err) != codeTemplateError || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %v, want %s with %q", err, codeTemplateError, tc.want)
+			}
+		})
+	}
+
+	form, _ := templateForm(t, `{"a": `, map[string]string{"index.html": "x"})
+	if _, ok := renderTemplates(context.Background(), form).(*optionValidationError); !ok {
+		t.Fatal("invalid data: want *optionValidationError")
+	}
+
+	// Missing keys render empty when template-strict is off.
+	setTestConfig(t, func(c *Config) { c.TemplateStrict = false })
+	form, tmpdir := templateForm(t, `{}`, map[string]string{"index.html": "<p>{{.b}}</p>"})
+	if err := renderTemplates(context.Background(), form); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpdir, "index.html")); string(got) != "<p></p>" {
+		t.Fatalf("index.html = %q", got)
+	}
+}
+
+func TestApplyTemplates_bounded(t *testing.T) {
+	// Nested ranges multiply the output: 1000^3 copies of the text.
+	items := "[" + strings.Repeat("0,", 999) + "0]"
+	nested := `{{range .a}}{{range $.a}}{{range $.a}}xxxxxxxx{{end}}{{end}}{{end}}`
+	form, _ := templateForm(t, `{"a": `+items+`}`, map[string]string{"index.html": nested})
+	err := renderTemplates(context.Background(), form)
+	if apiErrorCode(err) != codeTemplateError || !errors.Is(err, errTemplateOutputTooLarge) {
+		t.Fatalf("large output: %v", err)
+	}
+
+	// Loops writing nothing are bounded by the render timeout.
+	silent := `{{range .a}}{{range $.a}}{{range $.a}}{{end}}{{end}}{{end}}`
+	items = "[" + strings.Repeat("0,", 399) + "0]"
+	form, _ = templateForm(t, `{"a": `+items+`}`, map[string]string{"index.html": silent})
+	ctx, cancel := withRenderTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = renderTemplates(ctx, form)
+	if apiErrorCode(err) != codeRenderTimeout || time.Since(start) > 5*time.Second {
+		t.Fatalf("timeout: %v after %s", err, time.Since(start))
+	}
+}
+
+func TestPDFHandler_template(t *testing.T) {
+	writeFakeWkhtmltopdf(t)
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"index": "<p>{{.name}}</p>", "data": {"name": "x"}}`))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"data": `{"a": 1}`}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"index": "<p>{{.nme}}</p>", "data": {"name": "x"}}`))
+	var resp errorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusBadRequest || resp.Code != codeTemplateError || !strings.Contains(resp.Message, "index.html:1:") {
+		t.Fatalf("status %d response %+v", rec.Code, resp)
+	}
+
+	// Templates are executed in a render slot.
+	saved := renderSlots
+	renderSlots = newRenderLimiter(1, 0, time.Second)
+	defer func() { renderSlots = saved }()
+	release, err := renderSlots.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"index": "<p>{{.nme}}</p>", "data": {"name": "x"}}`))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("without a render slot: status %d body %s", rec.Code, rec.Body.String())
+	}
+}
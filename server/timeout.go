@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errRenderTimeout = errors.New("render timed out")
+
+// renderTimeout returns the render timeout requested with the
+// X-Render-Timeout header, either in seconds or as a Go duration (e.g. 90s),
+// capped to the max-render-timeout setting.
+func renderTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get("X-Render-Timeout")
+	if value == "" {
+		return min(config.RenderTimeout, config.MaxRenderTimeout), nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, ferr := strconv.ParseFloat(value, 64)
+		if ferr != nil {
+			return 0, newAPIError(http.StatusBadRequest, codeInvalidRenderTimeout,
+				fmt.Errorf("invalid X-Render-Timeout %q: expected seconds or a duration such as 90s", value))
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, newAPIError(http.StatusBadRequest, codeInvalidRenderTimeout,
+			fmt.Errorf("invalid X-Render-Timeout %q: must be positive", value))
+	}
+	return min(timeout, config.MaxRenderTimeout), nil
+}
+
+// withRenderTimeout bounds the render itself; the time spent uploading and
+// waiting for a render slot does not count.
+func withRenderTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, timeout, errRenderTimeout)
+}
+
+// renderCancelledError maps the cancellation of a render context to the error
+// reported to the client.
+func renderCancelledError(ctx context.Context) error {
+	if errors.Is(context.Cause(ctx), errRenderTimeout) {
+		return newAPIError(http.StatusGatewayTimeout, codeRenderTimeout, errRenderTimeout)
+	}
+	return newAPIError(http.StatusRequestTimeout, codeTimeout, ctx.Err())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenderTimeout_header(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", config.RenderTimeout, true},
+		{"10", 10 * time.Second, true},
+		{"2.5", 2500 * time.Millisecond, true},
+		{"90s", 90 * time.Second, true},
+		{"24h", config.MaxRenderTimeout, true},
+		{"0", 0, false},
+		{"-5s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/pdf", nil)
+		if tt.value != "" {
+			r.Header.Set("X-Render-Timeout", tt.value)
+		}
+		got, err := renderTimeout(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("renderTimeout(%q) error %v, want ok=%v", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("renderTimeout(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the TLS certificate from certFile/keyFile and reloads
+// it when either file changes, e.g. when a Kubernetes secret is rotated.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch checks the files every interval and reloads the certificate when they
+// changed. A failed reload keeps serving the previous certificate.
+func (cr *certReloader) watch(interval time.Duration, logger *Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTime, err := cr.latestModTime()
+		if err != nil {
+			logger.Errorf("Failed to check TLS certificate: %v", err)
+			continue
+		}
+
+		cr.mu.RLock()
+		changed := !modTime.Equal(cr.modTime)
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := cr.reload(); err != nil {
+			logger.Errorf("Failed to reload TLS certificate, keeping the previous one: %v", err)
+			continue
+		}
+		logger.Infoln("TLS certificate reloaded")
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
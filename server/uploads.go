@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errUploadPath   = errors.New("must be a relative path without ..")
+	errUploadExists = errors.New("given more than once")
+)
+
+// uploadName returns the file name of a multipart file part as sent by the
+// client. Unlike Part.FileName, it keeps the directories.
+func uploadName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+// cleanUploadName checks the name of an uploaded file and returns it in
+// canonical slash-separated form. Absolute names, names climbing out with ..
+// and backslashes are refused, so that every upload stays inside the request
+// temp dir.
+func cleanUploadName(name string) (string, error) {
+	if strings.Contains(name, `\`) || !filepath.IsLocal(name) {
+		return "", errUploadPath
+	}
+	return path.Clean(name), nil
+}
+
+// createUpload creates the file of the upload named name (a clean name) under
+// tmpdir, with its parent directories, and returns it with its path. It never
+// follows a symlink nor replaces an existing file: a name given twice, or
+// clashing with a directory, fails with errUploadExists.
+func createUpload(tmpdir, name string) (*os.File, string, error) {
+	dir := tmpdir
+	elems := strings.Split(name, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				return nil, "", err
+			}
+		case err != nil:
+			return nil, "", err
+		case !info.IsDir():
+			return nil, "", errUploadExists
+		}
+	}
+
+	p := filepath.Join(dir, elems[len(elems)-1])
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, "", errUploadExists
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return file, p, nil
+}
+
+// writeUpload writes data to the upload named name under tmpdir, like
+// createUpload.
+func writeUpload(tmpdir, name string, data []byte) (string, error) {
+	file, p, err := createUpload(tmpdir, name)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return p, err
+}
+
+// uploadError reports a refused upload name as a validation error of field.
+// Other errors are returned as is.
+func uploadError(field, name string, err error) error {
+	if errors.Is(err, errUploadPath) || errors.Is(err, errUploadExists) {
+		return &optionValidationError{Errors: []optionError{{Field: field, Value: name, Reason: err.Error()}}}
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// uploadedFile returns the path under tmpdir of the regular file uploaded as
+// name, or an error if there is none.
+func uploadedFile(tmpdir, name string) (string, error) {
+	name, err := cleanUploadName(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(tmpdir, filepath.FromSlash(name))
+	if info, err := os.Lstat(p); err != nil || !info.Mode().IsRegular() {
+		return "", errors.New("no such uploaded file")
+	}
+	return p, nil
+}
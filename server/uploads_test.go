@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanUploadName(t *testing.T) {
+	for name, want := range map[string]string{
+		"index.html":          "index.html",
+		"css/style.css":       "css/style.css",
+		"./img//logo.png":     "img/logo.png",
+		"css/../index.html":   "index.html",
+		"../index.html":       "",
+		"css/../../etc/x":     "",
+		"/etc/passwd":         "",
+		`..\..\windows\x.dll`: "",
+		"":                    "",
+	} {
+		got, err := cleanUploadName(name)
+		if (err != nil) != (want == "") || got != want {
+			t.Errorf("cleanUploadName(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestCreateUpload(t *testing.T) {
+	tmpdir := t.TempDir()
+	if _, err := writeUpload(tmpdir, "img/logo.png", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"img/logo.png", "img", "img/logo.png/x"} {
+		if _, err := writeUpload(tmpdir, name, []byte("b")); !errors.Is(err, errUploadExists) {
+			t.Errorf("writeUpload(%s): %v, want %v", name, err, errUploadExists)
+		}
+	}
+
+	// A symlink is neither followed nor replaced.
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(tmpdir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeUpload(tmpdir, "link/x.css", []byte("b")); !errors.Is(err, errUploadExists) {
+		t.Errorf("write through a symlink: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x.css")); err == nil {
+		t.Error("file written outside tmpdir")
+	}
+	if data, _ := os.ReadFile(filepath.Join(tmpdir, "img", "logo.png")); string(data) != "a" {
+		t.Errorf("logo.png overwritten: %q", data)
+	}
+}
+
+func TestParseMultipartForm_directories(t *testing.T) {
+	form, tmpdir := parsePDFForm(t, []string{"index.html", "css/style.css", "img/logo.png", "print/img/logo.png"}, nil)
+	if form.indexPath != filepath.Join(tmpdir, "index.html") {
+		t.Fatalf("index %q", form.indexPath)
+	}
+	for _, name := range []string{"css/style.css", "img/logo.png", "print/img/logo.png"} {
+		if _, err := os.Stat(filepath.Join(tmpdir, filepath.FromSlash(name))); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPDFHandler_badUploadNames(t *testing.T) {
+	for name, files := range map[string][]string{
+		"parent":    {"index.html", "../escape.css"},
+		"absolute":  {"index.html", "/tmp/escape.css"},
+		"duplicate": {"index.html", "img/logo.png", "img/logo.png"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			for _, file := range files {
+				fw, _ := mw.CreateFormFile("file", file)
+				fw.Write([]byte("x"))
+			}
+			mw.Close()
+			req := httptest.NewRequest(http.MethodPost, "/pdf", &buf)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+
+			rec := httptest.NewRecorder()
+			withTraceID(pdfHandler)(rec, req)
+			if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+				t.Fatalf("status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+			}
+		})
+	}
+}
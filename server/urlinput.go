@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// remoteURLs guards URL mode; main rebuilds it from the effective config.
+var remoteURLs = newURLGuard(config)
+
+var errPrivateAddress = errors.New("address is private")
+
+// blockedPrefixes are special-purpose ranges not covered by the netip
+// predicates used in isPrivateAddr.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, may map to private IPv4
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("fec0::/10"),       // deprecated site-local
+	netip.MustParsePrefix("::ffff:0:0:0/96"), // IPv4-translated
+}
+
+// isPrivateAddr reports whether ip is not a public unicast address.
+func isPrivateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlGuard checks the documents requested in URL mode against the host
+// lists and refuses private addresses, so that the server cannot be used to
+// reach internal services. A URL is resolved by fetching it with redirects
+// checked and capped, so that bad URLs fail early; wkhtmltopdf then gets the
+// final URL, and its own fetches go through a fetch proxy applying the same
+// checks, see networkPolicy.urlMode.
+type urlGuard struct {
+	allowHosts   []string
+	denyHosts    []string
+	allowPrivate bool
+	maxRedirects int
+	network      *networkPolicy
+	client       *http.Client
+	webhooks     *http.Client // job callbacks, see checkCallbackURL
+}
+
+func newURLGuard(cfg *Config) *urlGuard {
+	g := &urlGuard{
+		allowHosts:   cfg.URLAllowHosts,
+		denyHosts:    cfg.URLDenyHosts,
+		allowPrivate: cfg.URLAllowPrivate,
+		maxRedirects: cfg.URLMaxRedirects,
+		network:      newNetworkPolicy(cfg),
+	}
+	// The address is checked once resolved, at connection time, so that a
+	// host name cannot resolve to a public address for the check and to a
+	// private one for the request.
+	dialer := &net.Dialer{Timeout: cfg.URLTimeout, Control: g.checkDial}
+	g.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.URLTimeout,
+			ForceAttemptHTTP2:   true,
+		},
+		CheckRedirect: g.checkRedirect,
+		Timeout:       cfg.URLTimeout,
+	}
+	g.webhooks = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.URLTimeout,
+			ForceAttemptHTTP2:   true,
+		},
+		CheckRedirect: g.checkCallbackRedirect,
+	}
+	return g
+}
+
+// hostMatches reports whether host matches pattern: either the same name, or
+// a subdomain for a "*.example.com" pattern.
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+func matchesAny(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if hostMatches(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURL validates the scheme and the host of u.
+func (g *urlGuard) checkURL(u *url.URL) error {
+	if err := g.checkTarget(u); err != nil {
+		return err
+	}
+	// wkhtmltopdf fetches the document through the network policy.
+	if err := g.network.checkHost(u.Hostname()); err != nil {
+		return newAPIError(http.StatusForbidden, codeURLForbidden, fmt.Errorf("%s: %w", u.Redacted(), err))
+	}
+	return nil
+}
+
+// checkTarget validates the scheme of u and checks its host, see checkHost.
+func (g *urlGuard) checkTarget(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return newAPIError(http.StatusBadRequest, codeInvalidURL, fmt.Errorf("%s: only http and https URLs are supported", u.Redacted()))
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidURL, fmt.Errorf("%s: missing host", u.Redacted()))
+	}
+	if err := g.checkHost(host); err != nil {
+		return newAPIError(http.StatusForbidden, codeURLForbidden, fmt.Errorf("%s: %w", u.Redacted(), err))
+	}
+	return nil
+}
+
+// checkCallbackURL validates a job callback URL. Callbacks are sent by the
+// server itself, so they get the URL mode checks but not the network
+// policy, which applies to renders; private addresses are refused again at
+// connection time and on redirects.
+func (g *urlGuard) checkCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidURL, err)
+	}
+	return g.checkTarget(u)
+}
+
+func (g *urlGuard) checkCallbackRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > g.maxRedirects {
+		return fmt.Errorf("%s: more than %d redirects", via[0].URL.Redacted(), g.maxRedirects)
+	}
+	return g.checkTarget(req.URL)
+}
+
+// checkHost reports why host may not be fetched in URL mode, or nil if it
+// may. Private addresses are refused again once host is resolved.
+func (g *urlGuard) checkHost(host string) error {
+	if matchesAny(g.denyHosts, host) || (len(g.allowHosts) > 0 && !matchesAny(g.allowHosts, host)) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !g.allowPrivate && isPrivateAddr(ip) {
+		return fmt.Errorf("%s: %w", ip, errPrivateAddress)
+	}
+	return nil
+}
+
+func (g *urlGuard) checkDial(network, address string, _ syscall.RawConn) error {
+	if g.allowPrivate {
+		return nil
+	}
+	return checkPublicDial(network, address, nil)
+}
+
+func (g *urlGuard) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > g.maxRedirects {
+		return newAPIError(http.StatusBadGateway, codeURLFetchFailed, fmt.Errorf("%s: more than %d redirects", via[0].URL.Redacted(), g.maxRedirects))
+	}
+	return g.checkURL(req.URL)
+}
+
+// resolve checks raw, follows its redirects and returns the final URL.
+func (g *urlGuard) resolve(ctx context.Context, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidURL, err)
+	}
+	if err := g.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidURL, err)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return nil, apiErr
+		}
+		if errors.Is(err, errPrivateAddress) {
+			return nil, newAPIError(http.StatusForbidden, codeURLForbidden, err)
+		}
+		return nil, newAPIError(http.StatusBadGateway, codeURLFetchFailed, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(http.StatusBadGateway, codeURLFetchFailed, fmt.Errorf("%s: %s", resp.Request.URL.Redacted(), resp.Status))
+	}
+	return resp.Request.URL, nil
+}
+
+// resolveForm resolves the URLs of a URL mode request in place. A document
+// cannot be given both as a URL and as an upload.
+func (g *urlGuard) resolveForm(ctx context.Context, form *renderForm) error {
+	var conflicts []optionError
+	for _, doc := range []struct {
+		field, url, path string
+	}{
+		{"url", form.url, form.indexPath},
+		{"header-url", form.headerURL, form.headerPath},
+		{"footer-url", form.footerURL, form.footerPath},
+	} {
+		if doc.url != "" && doc.path != "" {
+			conflicts = append(conflicts, optionError{Field: doc.field, Value: doc.url, Reason: "cannot be combined with an uploaded file"})
+		}
+	}
+	if form.remote() {
+		for _, arg := range form.args {
+			if name, ok := strings.CutPrefix(arg, "--"); ok && networkOptions[name] {
+				conflicts = append(conflicts, optionError{Field: name, Reason: "set by the server: URL mode fetches through its proxy"})
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return &optionValidationError{Errors: conflicts}
+	}
+
+	logger := loggerFromContext(ctx)
+	for _, u := range []*string{&form.url, &form.headerURL, &form.footerURL} {
+		if *u == "" {
+			continue
+		}
+		start := time.Now()
+		resolved, err := g.resolve(ctx, *u)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Resolved input URL %s in %s", resolved.Redacted(), time.Since(start))
+		*u = resolved.String()
+	}
+	return nil
+}
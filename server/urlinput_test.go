@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsPrivateAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.16.0.1":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"fd00::1":          true,
+		"fe80::1":          true,
+		"::ffff:10.0.0.1":  true,
+		"8.8.8.8":          false,
+		"2606:4700::1111":  false,
+		"::ffff:1.1.1.1":   false,
+		"198.51.100.7":     false,
+		"100.128.0.1":      false,
+		"64:ff9b::a00:1":   true,
+		"255.255.255.255":  true,
+		"224.0.0.1":        true,
+		"2001:db8::dead":   true,
+		"2001:4860::8888":  false,
+		"192.0.0.170":      true,
+		"198.18.0.1":       true,
+		"198.20.0.1":       false,
+		"fec0::1":          true,
+		"ff02::1":          true,
+		"::":               true,
+		"203.0.113.200":    false,
+		"93.184.215.14":    false,
+		"::ffff:127.0.0.1": true,
+	} {
+		if got := isPrivateAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPrivateAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+	} {
+		if got := hostMatches(tc.pattern, tc.host); got != tc.want {
+			t.Errorf("hostMatches(%q, %q) = %v", tc.pattern, tc.host, got)
+		}
+	}
+}
+
+// newRedirectServer serves /page and /redirect/<n>, which redirects n times
+// before landing on /page.
+func newRedirectServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, ok := strings.CutPrefix(r.URL.Path, "/redirect/"); ok {
+			left, _ := strconv.Atoi(n)
+			if left == 0 {
+				http.Redirect(w, r, "/page", http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, "/redirect/"+strconv.Itoa(left-1), http.StatusFound)
+			return
+		}
+		if r.URL.Path != "/page" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testURLGuard(t *testing.T, change func(c *Config)) *urlGuard {
+	t.Helper()
+	cfg := *defaultConfig()
+	change(&cfg)
+	return newURLGuard(&cfg)
+}
+
+func apiErrorCode(err error) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+func TestURLGuard_resolve(t *testing.T) {
+	srv := newRedirectServer(t)
+	guard := testURLGuard(t, func(c *Config) {
+		c.URLAllowPrivate = true
+		c.URLMaxRedirects = 3
+	})
+
+	u, err := guard.resolve(context.Background(), srv.URL+"/redirect/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != srv.URL+"/page" {
+		t.Fatalf("resolved to %s", u)
+	}
+
+	for raw, code := range map[string]string{
+		srv.URL + "/redirect/3": codeURLFetchFailed,
+		srv.URL + "/missing":    codeURLFetchFailed,
+		"ftp://example.com/x":   codeInvalidURL,
+		"/relative":             codeInvalidURL,
+	} {
+		if _, err := guard.resolve(context.Background(), raw); apiErrorCode(err) != code {
+			t.Errorf("resolve(%s): %v, want %s", raw, err, code)
+		}
+	}
+}
+
+func TestURLGuard_forbidden(t *testing.T) {
+	srv := newRedirectServer(t)
+	port := srv.URL[strings.LastIndex(srv.URL, ":"):]
+
+	guard := testURLGuard(t, func(c *Config) {})
+	for _, raw := range []string{
+		srv.URL + "/page",                         // private IP literal
+		"http://localhost" + port + "/page",       // resolves to a private IP
+		"http://169.254.169.254/latest/meta-data", // cloud metadata
+	} {
+		if _, err := guard.resolve(context.Background(), raw); apiErrorCode(err) != codeURLForbidden {
+			t.Errorf("resolve(%s): %v, want %s", raw, err, codeURLForbidden)
+		}
+	}
+
+	guard = testURLGuard(t, func(c *Config) {
+		c.URLAllowPrivate = true
+		c.URLAllowHosts = []string{"*.example.com"}
+	})
+	if _, err := guard.resolve(context.Background(), srv.URL+"/page"); apiErrorCode(err) != codeURLForbidden {
+		t.Errorf("host not in allowlist: %v", err)
+	}
+
+	guard = testURLGuard(t, func(c *Config) {
+		c.URLAllowPrivate = true
+		c.URLDenyHosts = []string{"localhost"}
+	})
+	if _, err := guard.resolve(context.Background(), "http://localhost"+port+"/page"); apiErrorCode(err) != codeURLForbidden {
+		t.Errorf("denied host: %v", err)
+	}
+
+	// wkhtmltopdf could not fetch the document.
+	guard = testURLGuard(t, func(c *Config) {
+		c.URLAllowPrivate = true
+		c.NetworkPolicy = networkOffline
+	})
+	if _, err := guard.resolve(context.Background(), srv.URL+"/page"); apiErrorCode(err) != codeURLForbidden {
+		t.Errorf("offline network policy: %v", err)
+	}
+}
+
+func TestPDFHandler_url(t *testing.T) {
+	argsFile := writeArgsWkhtmltopdf(t)
+	srv := newRedirectServer(t)
+	saved := remoteURLs
+	remoteURLs = testURLGuard(t, func(c *Config) { c.URLAllowPrivate = true })
+	t.Cleanup(func() { remoteURLs = saved })
+
+	rec := httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"url": "`+srv.URL+`/redirect/1", "footer-url": "`+srv.URL+`/page"}`))
+	if rec.Code != http.StatusOK || rec.Body.String() != fakePDF {
+		t.Fatalf("status %d body %q", rec.Code, rec.Body.String())
+	}
+	// wkhtmltopdf fetches through the proxy even with the open network policy.
+	if args, _ := os.ReadFile(argsFile); !strings.HasPrefix(string(args), "--proxy http://127.0.0.1:") {
+		t.Fatalf("args %q", args)
+	}
+
+	// A document given twice is rejected.
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newPDFRequest(t, map[string]string{"url": srv.URL + "/page"}))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+		t.Fatalf("status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+
+	// So is a proxy option, even when option-allow names it.
+	setTestConfig(t, func(c *Config) { c.OptionAllow = []string{"proxy"} })
+	rec = httptest.NewRecorder()
+	withTraceID(pdfHandler)(rec, newJSONRequest(t, "/pdf", `{"url": "`+srv.URL+`/page", "options": {"proxy": "http://attacker.example.com:3128"}}`))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Error-Code") != codeInvalidOption {
+		t.Fatalf("proxy option: status %d code %q", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
@@ -9,37 +9,15 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-func imageAbort(ctx context.Context, w http.ResponseWriter, err error) {
-	logger := loggerFromContext(ctx)
-
-	logger.Errorf("HTTP abort: %v", err)
-
-	if sr, ok := w.(*statusRecorder); ok {
-		sr.statusCode = http.StatusInternalServerError
-	}
-
-	wh, ok := w.(http.Hijacker)
-	if !ok {
-		imageErrorTotal.WithLabelValues("hijack_unsupported", err.Error()).Inc()
-		logger.Errorln("cannot abort connection, error not reported to client: http.Hijacker not supported")
-		return
-	}
-	c, _, err := wh.Hijack()
-	if err != nil {
-		imageErrorTotal.WithLabelValues("hijack_failed", err.Error()).Inc()
-		logger.Errorln("cannot abort connection, error not reported to client: ", err)
-		return
-	}
-	c.Close()
-}
-
 func wkhtmltoimageBin() string {
+	if config.WkhtmltoimageBin != "" {
+		return config.WkhtmltoimageBin
+	}
 	b := os.Getenv("KWKHTMLTOIMAGE_BIN")
 	if b != "" {
 		return b
@@ -53,7 +31,7 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPost {
 		imageErrorTotal.WithLabelValues("method_not_allowed", r.Method).Inc()
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		httpError(ctx, w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, errors.New("Method Not Allowed")))
 		return
 	}
 
@@ -64,48 +42,122 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
 	defer func() {
 		duration := time.Since(start).Seconds()
-		imageRequestDuration.WithLabelValues(r.URL.Path).Observe(duration)
-		imageRequestsTotal.WithLabelValues(r.URL.Path, fmt.Sprintf("%d", rec.statusCode)).Inc()
+		client := clientIDFromContext(ctx)
+		imageRequestDuration.WithLabelValues(r.URL.Path, client).Observe(duration)
+		imageRequestsTotal.WithLabelValues(r.URL.Path, fmt.Sprintf("%d", rec.statusCode), client).Inc()
 	}()
 
-	tmpdir, err := os.MkdirTemp("", "kwkimg")
+	tmpdir, cleanup, err := activeRenders.tempDir("kwkimg")
 	if err != nil {
 		imageErrorTotal.WithLabelValues("tempdir_creation_failed", err.Error()).Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
+		httpError(ctx, rec, newAPIError(http.StatusInternalServerError, codeTempDirFailed, err))
 		return
 	}
-	defer os.RemoveAll(tmpdir)
+	defer cleanup()
 
 	logger.Infof("Temporary directory created: %s", tmpdir)
 
-	reader, err := r.MultipartReader()
+	prepared, err := prepareImage(ctx, r, tmpdir)
 	if err != nil {
-		imageErrorTotal.WithLabelValues("multipart_reader_creation_failed", err.Error()).Inc()
-		logger.Errorf("Failed to create multipart reader: %v", err)
-		httpError(ctx, w, err, http.StatusBadRequest)
+		httpError(ctx, rec, err)
 		return
 	}
 
-	args, indexPath, err := parseMultipartFormImage(ctx, reader, tmpdir)
+	result, err := prepared.execute(ctx, nil)
 	if err != nil {
-		imageErrorTotal.WithLabelValues("parse_multipart_form_failed", err.Error()).Inc()
-		logger.Errorf("Failed to parse multipart form: %v", err)
-		httpError(ctx, w, err, http.StatusBadRequest)
+		httpError(ctx, rec, err)
 		return
 	}
 
-	if indexPath == "" {
+	serveRenderResult(ctx, rec, r, result)
+
+	logger.Infof("Generated image size: %d bytes", result.Size)
+	imageSize.Observe(float64(result.Size))
+}
+
+// prepareImage parses an /image request, saving its files to tmpdir, and
+// returns the render to run.
+func prepareImage(ctx context.Context, r *http.Request, tmpdir string) (*preparedRender, error) {
+	logger := loggerFromContext(ctx)
+
+	timeout, err := renderTimeout(r)
+	if err != nil {
+		imageErrorTotal.WithLabelValues("invalid_render_timeout", err.Error()).Inc()
+		return nil, err
+	}
+
+	var form *renderForm
+	if isJSONRequest(r) {
+		form, err = parseJSONBody(ctx, r.Body, tmpdir, imageOptions)
+		if err == nil && (form.header() != "" || form.footer() != "") {
+			err = &optionValidationError{Errors: []optionError{{Field: "header", Reason: "header and footer are not supported by wkhtmltoimage"}}}
+		}
+		if err == nil && (len(form.pages) > 0 || form.toc || form.coverPath != "") {
+			err = &optionValidationError{Errors: []optionError{{Field: "pages", Reason: "wkhtmltoimage renders a single page"}}}
+		}
+		if err != nil {
+			imageErrorTotal.WithLabelValues("parse_json_body_failed", err.Error()).Inc()
+			logger.Errorf("Failed to parse JSON body: %v", err)
+			return nil, parseFormError(err)
+		}
+	} else {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			imageErrorTotal.WithLabelValues("multipart_reader_creation_failed", err.Error()).Inc()
+			logger.Errorf("Failed to create multipart reader: %v", err)
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidMultipart, err)
+		}
+
+		form, err = parseMultipartFormImage(ctx, reader, tmpdir)
+		if err != nil {
+			imageErrorTotal.WithLabelValues("parse_multipart_form_failed", err.Error()).Inc()
+			logger.Errorf("Failed to parse multipart form: %v", err)
+			return nil, parseFormError(err)
+		}
+	}
+
+	if err := remoteURLs.resolveForm(ctx, form); err != nil {
+		imageErrorTotal.WithLabelValues("url_rejected", err.Error()).Inc()
+		logger.Errorf("Rejected input URL: %v", err)
+		return nil, parseFormError(err)
+	}
+
+	data, err := parseTemplateData(form)
+	if err != nil {
+		imageErrorTotal.WithLabelValues("template_error", err.Error()).Inc()
+		logger.Errorf("Invalid template data: %v", err)
+		return nil, parseFormError(err)
+	}
+
+	index := form.index()
+	if index == "" {
 		imageErrorTotal.WithLabelValues("index_html_file_not_found", "").Inc()
 		logger.Errorln("index.html file is required but not found")
-		httpError(ctx, w, errors.New("index.html file is required"), http.StatusBadRequest)
-		return
+		return nil, newAPIError(http.StatusBadRequest, codeMissingIndexHTML, errors.New("index.html file is required"))
 	}
 
+	args := form.args
 	ensureImageFormatDefault(&args)
-	runWkhtmltoimage(ctx, rec, args, indexPath, tmpdir)
+	network := form.network()
+
+	return &preparedRender{
+		render: func(ctx context.Context) (*renderResult, error) {
+			renderCtx, cancel := withRenderTimeout(ctx, timeout)
+			defer cancel()
+			if err := applyTemplates(renderCtx, form, data); err != nil {
+				imageErrorTotal.WithLabelValues("template_error", err.Error()).Inc()
+				loggerFromContext(ctx).Errorf("Failed to render templates: %v", err)
+				return nil, err
+			}
+			return runWkhtmltoimage(renderCtx, args, index, tmpdir, network)
+		},
+		tmpdir: tmpdir,
+		key:    renderKey(ctx, wkhtmltoimageBin(), tmpdir, args, []string{index}, form.data),
+		errors: imageErrorTotal,
+	}, nil
 }
 
-func parseMultipartFormImage(ctx context.Context, reader *multipart.Reader, tmpdir string) (args []string, indexPath string, err error) {
+func parseMultipartFormImage(ctx context.Context, reader *multipart.Reader, tmpdir string) (form *renderForm, err error) {
 	logger := loggerFromContext(ctx)
 
 	defer func() {
@@ -114,6 +166,14 @@ func parseMultipartFormImage(ctx context.Context, reader *multipart.Reader, tmpd
 		}
 	}()
 
+	form = &renderForm{}
+	checker := newOptionChecker(imageOptions, tmpdir)
+	bundled := false
+	addIndex := func(name, path string) {
+		if name == "index.html" {
+			form.indexPath = path
+		}
+	}
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
@@ -121,42 +181,70 @@ func parseMultipartFormImage(ctx context.Context, reader *multipart.Reader, tmpd
 		}
 		if err != nil {
 			logger.Errorln(err)
-			return nil, "", err
+			return nil, err
 		}
 
-		if part.FormName() == "file" {
-			base := filepath.Base(part.FileName())
-			path := filepath.Join(tmpdir, base)
-			file, err := os.Create(path)
+		if part.FormName() == "bundle" {
+			if bundled {
+				return nil, bundleError("only one bundle part is allowed")
+			}
+			bundled = true
+			if err := extractBundle(part, tmpdir, addIndex); err != nil {
+				logger.Errorln(err)
+				return nil, err
+			}
+		} else if part.FormName() == "file" {
+			name, err := cleanUploadName(uploadName(part))
+			if err != nil {
+				return nil, uploadError("file", uploadName(part), err)
+			}
+			file, path, err := createUpload(tmpdir, name)
 			if err != nil {
 				logger.Errorln(err)
-				return nil, "", err
+				return nil, uploadError("file", name, err)
 			}
 			_, err = io.Copy(file, part)
 			file.Close()
 			if err != nil {
 				logger.Errorln(err)
-				return nil, "", err
-			}
-			if base == "index.html" {
-				indexPath = path
+				return nil, err
 			}
+			addIndex(name, path)
 		} else {
 			buf := new(bytes.Buffer)
 			if _, err := io.Copy(buf, part); err != nil {
 				logger.Errorln(err)
-				return nil, "", err
+				return nil, err
 			}
 			arg := buf.String()
+			switch part.FormName() {
+			case "url":
+				form.url = arg
+				continue
+			case "entrypoint":
+				form.entrypoint = arg
+				continue
+			case "data":
+				form.data = []byte(arg)
+				continue
+			}
+			arg = checker.check(part.FormName(), arg)
 			if arg == "" {
-				args = append(args, fmt.Sprintf("--%s", part.FormName()))
+				form.args = append(form.args, fmt.Sprintf("--%s", part.FormName()))
 			} else {
-				args = append(args, fmt.Sprintf("--%s", part.FormName()), arg)
+				form.args = append(form.args, fmt.Sprintf("--%s", part.FormName()), arg)
 			}
 		}
 	}
 
-	return args, indexPath, nil
+	if err := checker.err(logger); err != nil {
+		return nil, err
+	}
+	if err := form.useEntrypoint(tmpdir); err != nil {
+		return nil, err
+	}
+
+	return form, nil
 }
 
 func hasImageFormatOption(args []string) bool {
@@ -211,75 +299,19 @@ func imageContentType(ext string) string {
 	}
 }
 
-func runWkhtmltoimage(ctx context.Context, w http.ResponseWriter, args []string, indexPath, tmpdir string) {
-	logger := loggerFromContext(ctx)
-
+func runWkhtmltoimage(ctx context.Context, args []string, input, tmpdir string, network *networkPolicy) (*renderResult, error) {
 	ext := imageOutputExt(args)
 	outPath := filepath.Join(tmpdir, "output."+ext)
 
-	runArgs := append(append([]string{}, args...), "--enable-local-file-access", indexPath, outPath)
-	logger.Infoln("Args", runArgs)
-
-	logger.Infoln("Starting wkhtmltoimage process")
-	cmd := exec.Command(wkhtmltoimageBin(), runArgs...)
-	cmd.Stderr = os.Stderr
-	done := make(chan error, 1)
-
-	err := cmd.Start()
-	if err != nil {
-		imageErrorTotal.WithLabelValues("process_start_failed", err.Error()).Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
-		return
+	process := &renderProcess{
+		name:        "wkhtmltoimage",
+		bin:         wkhtmltoimageBin(),
+		args:        append(append(localFileAccessArgs(tmpdir), args...), input, outPath),
+		tmpdir:      tmpdir,
+		outPath:     outPath,
+		contentType: imageContentType(ext),
+		network:     network,
+		errors:      imageErrorTotal,
 	}
-
-	logger.Infoln("wkhtmltoimage process started")
-
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	select {
-	case <-ctx.Done():
-		if ctx.Err() != nil {
-			imageErrorTotal.WithLabelValues("context_cancelled", ctx.Err().Error()).Inc()
-		}
-		logger.Errorln("Context cancelled, killing wkhtmltoimage process")
-		if err := cmd.Process.Kill(); err != nil {
-			logger.Errorf("Failed to kill process: %v", err)
-		}
-		httpError(ctx, w, ctx.Err(), http.StatusRequestTimeout)
-		return
-	case err := <-done:
-		if err != nil {
-			logger.Errorf("wkhtmltoimage process failed: %v", err)
-			imageErrorTotal.WithLabelValues("process_failed", err.Error()).Inc()
-			httpError(ctx, w, err, http.StatusInternalServerError)
-			return
-		}
-	}
-
-	data, err := os.ReadFile(outPath)
-	if err != nil {
-		imageErrorTotal.WithLabelValues("read_output_failed", err.Error()).Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
-		return
-	}
-	if len(data) == 0 {
-		err := errors.New("wkhtmltoimage produced empty output")
-		imageErrorTotal.WithLabelValues("empty_output", "").Inc()
-		httpError(ctx, w, err, http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", imageContentType(ext))
-	_, err = w.Write(data)
-	if err != nil {
-		logger.Errorf("Failed to write image to response: %v", err)
-		imageAbort(ctx, w, err)
-		return
-	}
-
-	logger.Infof("Generated image size: %d bytes", len(data))
-	imageSize.Observe(float64(len(data)))
-	logger.Infoln("wkhtmltoimage process completed successfully")
+	return process.run(ctx)
 }